@@ -1,9 +1,266 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
 	"fund78/tunnel_system"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "minimize":
+			minimize(os.Args[2:])
+			return
+		case "simulate":
+			simulate(os.Args[2:])
+			return
+		case "fuzz":
+			fuzz(os.Args[2:])
+			return
+		case "retention":
+			retention(os.Args[2:])
+			return
+		case "replays":
+			replays(os.Args[2:])
+			return
+		}
+	}
+
 	tunnel_system.NewTunnelSystem(tunnel_system.Config{}, []tunnel_system.InputGenerator{})
 }
+
+// minimize finds the smallest input sequence of a replay that still fails
+// usage: minimize -predicate divergence|dead_letter|state [-assert expr] [-topic name] [-ignore fields] [-name name] [-journal dir] [-postgres dsn] {replay id}
+func minimize(args []string) {
+	flags := flag.NewFlagSet("minimize", flag.ExitOnError)
+	predicate := flags.String("predicate", "divergence", "failure to preserve: divergence, dead_letter or state")
+	assertion := flags.String("assert", "", "state assertion for the state predicate, e.g. logged_on.bob<2")
+	topic := flags.String("topic", "", "only count dead letters of this topic")
+	ignore := flags.String("ignore", "", "comma separated fields ignored when looking for divergence")
+	name := flags.String("name", "", "name of the minimized child replay")
+	maxTrials := flags.Int("max-trials", 1000, "maximum number of sandbox reruns")
+	journal := flags.String("journal", "", "directory of the action journal, when the engine runs with one")
+	postgres := flags.String("postgres", "", "DSN of the postgres action log, when the engine runs with one")
+	flags.Parse(args)
+
+	replayID, err := strconv.ParseInt(flags.Arg(0), 10, 64)
+	if err != nil {
+		fail("usage: minimize [flags] {replay id}")
+	}
+
+	opts, err := tunnel_system.ParseMinimizeOptions(*predicate, *assertion, *topic, *ignore, *name)
+	if err != nil {
+		fail(err.Error())
+	}
+	opts.MaxTrials = *maxTrials
+
+	config := tunnel_system.DefaultConfig()
+	if *postgres != "" {
+		config.Postgres = &tunnel_system.PostgresConfig{DSN: *postgres}
+	}
+	if *journal != "" {
+		config.Journal = &tunnel_system.JournalConfig{Dir: *journal}
+	}
+	result, err := tunnel_system.MinimizeReplay(config, replayID, opts)
+	if err != nil {
+		fail(err.Error())
+	}
+	printJSON(result)
+}
+
+// simulate runs the engine's scheduled generators on virtual time
+// usage: simulate [-start RFC3339 time] [-duration 168h]
+func simulate(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	start := flags.String("start", "", "virtual start time (RFC3339), defaults to now")
+	duration := flags.Duration("duration", 24*time.Hour, "virtual time to simulate")
+	flags.Parse(args)
+
+	simulation := &tunnel_system.SimulationConfig{Duration: *duration}
+	if *start != "" {
+		t, err := time.Parse(time.RFC3339, *start)
+		if err != nil {
+			fail("invalid start time: " + err.Error())
+		}
+		simulation.Start = t
+	}
+
+	config := tunnel_system.DefaultConfig()
+	config.Simulation = simulation
+	tunnel_system.NewTunnelSystem(config, []tunnel_system.InputGenerator{})
+}
+
+// fuzz runs seeded random input streams through the handlers in a sandbox and
+// saves every seed that dead-letters or breaks an assertion as a replay
+// usage: fuzz -topic LOGON=3:alice,bob [-topic TICK=1:0..1000] [-assert logged_on.bob<2] [-seeds 100] [-first-seed 1] [-steps 1000] [-journal dir] [-postgres dsn]
+func fuzz(args []string) {
+	flags := flag.NewFlagSet("fuzz", flag.ExitOnError)
+	var topics []tunnel_system.TopicWeight
+	var invariants []tunnel_system.Invariant
+	flags.Func("topic", "topic to generate as TOPIC=weight[:a,b,c or :min..max], repeatable", func(spec string) error {
+		topic, err := tunnel_system.ParseTopicWeight(spec)
+		topics = append(topics, topic)
+		return err
+	})
+	flags.Func("assert", "state assertion checked after every visitor, e.g. logged_on.bob<2, repeatable", func(assertion string) error {
+		invariant, err := tunnel_system.StateInvariant(assertion)
+		invariants = append(invariants, invariant)
+		return err
+	})
+	seeds := flags.Int("seeds", 100, "number of seeds to run")
+	firstSeed := flags.Int64("first-seed", 1, "first seed to run")
+	steps := flags.Int("steps", 1000, "visitors generated per seed")
+	journal := flags.String("journal", "", "directory of the action journal, when the engine runs with one")
+	postgres := flags.String("postgres", "", "DSN of the postgres action log, when the engine runs with one")
+	flags.Parse(args)
+	if len(topics) == 0 {
+		fail("usage: fuzz -topic TOPIC=weight[:payloads] [flags]")
+	}
+
+	config := tunnel_system.DefaultConfig()
+	if *postgres != "" {
+		config.Postgres = &tunnel_system.PostgresConfig{DSN: *postgres}
+	}
+	if *journal != "" {
+		config.Journal = &tunnel_system.JournalConfig{Dir: *journal}
+	}
+	generator := tunnel_system.NewSimulationGenerator(0, *steps, topics, invariants...)
+	failures, err := tunnel_system.FuzzSimulation(config, *generator, *firstSeed, *seeds)
+	if err != nil {
+		fail(err.Error())
+	}
+	printJSON(failures)
+}
+
+// retention archives and deletes old replays and compacts the TICKs of finished runs
+// usage: retention [-max-age 720h] [-max-count n] [-compact-ticks] [-archive dir] [-dry-run] [-journal dir] [-postgres dsn]
+func retention(args []string) {
+	flags := flag.NewFlagSet("retention", flag.ExitOnError)
+	maxAge := flags.Duration("max-age", 0, "delete replay trees whose newest replay is older, 0 for any age")
+	maxCount := flags.Int("max-count", 0, "keep only this many of the newest unpinned replay trees, 0 for any number")
+	compactTicks := flags.Bool("compact-ticks", false, "collapse consecutive TICKs of finished runs")
+	archive := flags.String("archive", tunnel_system.DefaultArchiveDir, "directory receiving a bundle of every tree before it is deleted")
+	dryRun := flags.Bool("dry-run", false, "report what would be done without doing it")
+	journal := flags.String("journal", "", "directory of the action journal, when the engine runs with one")
+	postgres := flags.String("postgres", "", "DSN of the postgres action log, when the engine runs with one")
+	flags.Parse(args)
+
+	config := tunnel_system.DefaultConfig()
+	if *postgres != "" {
+		config.Postgres = &tunnel_system.PostgresConfig{DSN: *postgres}
+	}
+	if *journal != "" {
+		config.Journal = &tunnel_system.JournalConfig{Dir: *journal}
+	}
+	policy := tunnel_system.RetentionPolicy{MaxAge: *maxAge, MaxCount: *maxCount, CompactTicks: *compactTicks, ArchiveDir: *archive}
+	report, err := tunnel_system.EnforceRetention(config, policy, *dryRun)
+	if err != nil {
+		fail(err.Error())
+	}
+	printJSON(report)
+}
+
+// replays lists, annotates and deletes replays
+// usage: replays [-journal dir] [-postgres dsn] list [-tag tag] | show {id} | rename {id} {name} | notes {id} {text} | tag {id} {tags} | untag {id} {tags} | pin {id} | unpin {id} | delete [-archive dir] {id}
+func replays(args []string) {
+	flags := flag.NewFlagSet("replays", flag.ExitOnError)
+	journal := flags.String("journal", "", "directory of the action journal, when the engine runs with one")
+	postgres := flags.String("postgres", "", "DSN of the postgres action log, when the engine runs with one")
+	flags.Parse(args)
+	usage := "usage: replays [flags] list|show|rename|notes|tag|untag|pin|unpin|delete ..."
+	if flags.NArg() == 0 {
+		fail(usage)
+	}
+
+	config := tunnel_system.DefaultConfig()
+	if *postgres != "" {
+		config.Postgres = &tunnel_system.PostgresConfig{DSN: *postgres}
+	}
+	if *journal != "" {
+		config.Journal = &tunnel_system.JournalConfig{Dir: *journal}
+	}
+	actionLogger := tunnel_system.OpenActionLogger(config)
+	defer actionLogger.Close()
+
+	operation, operands := flags.Arg(0), flags.Args()[1:]
+	if operation == "list" {
+		listFlags := flag.NewFlagSet("replays list", flag.ExitOnError)
+		tag := listFlags.String("tag", "", "only list the replays with this tag")
+		listFlags.Parse(operands)
+		list, err := actionLogger.ListReplays(*tag)
+		if err != nil {
+			fail(err.Error())
+		}
+		printJSON(list)
+		return
+	}
+
+	archive := ""
+	if operation == "delete" {
+		deleteFlags := flag.NewFlagSet("replays delete", flag.ExitOnError)
+		deleteFlags.StringVar(&archive, "archive", "", "directory receiving a bundle of the replays before they are deleted")
+		deleteFlags.Parse(operands)
+		operands = deleteFlags.Args()
+	}
+	if len(operands) == 0 {
+		fail(usage)
+	}
+	replayID, err := strconv.ParseInt(operands[0], 10, 64)
+	if err != nil {
+		fail("invalid replay id " + operands[0])
+	}
+	text := strings.Join(operands[1:], " ")
+
+	switch operation {
+	case "show":
+	case "delete":
+		deletion, err := actionLogger.DeleteReplay(replayID, archive)
+		if err != nil {
+			fail(err.Error())
+		}
+		printJSON(deletion)
+		return
+	case "rename":
+		err = actionLogger.RenameReplay(replayID, text)
+	case "notes":
+		err = actionLogger.SetReplayNotes(replayID, text)
+	case "tag":
+		err = actionLogger.TagReplay(replayID, tunnel_system.ParseTags(strings.Join(operands[1:], ",")), nil)
+	case "untag":
+		err = actionLogger.TagReplay(replayID, nil, tunnel_system.ParseTags(strings.Join(operands[1:], ",")))
+	case "pin":
+		err = actionLogger.PinReplay(replayID, true)
+	case "unpin":
+		err = actionLogger.PinReplay(replayID, false)
+	default:
+		fail(usage)
+	}
+	if err != nil {
+		fail(err.Error())
+	}
+	replay, err := actionLogger.GetReplay(replayID)
+	if err != nil {
+		fail(err.Error())
+	}
+	if replay == nil {
+		fail(fmt.Sprintf("replay %d not found", replayID))
+	}
+	printJSON(replay)
+}
+
+func printJSON(value interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+func fail(message string) {
+	fmt.Fprintln(os.Stderr, message)
+	os.Exit(1)
+}
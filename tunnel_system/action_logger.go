@@ -3,10 +3,32 @@ package tunnel_system
 import (
 	"database/sql"
 	"log"
+	"log/slog"
+	"sync"
+	"time"
 )
 
 type ActionLogger struct {
-	db *sql.DB
+	db      *sql.DB
+	dialect dialect
+	// actions keeps the action rows: the action table, unless a journal
+	// replaced it
+	actions actionStore
+
+	// batch, when set, collects action inserts into one transaction;
+	// batchWrites counts the writes it holds
+	batchMu     sync.Mutex
+	batch       *sql.Tx
+	batchWrites int
+
+	// stmts caches the prepared statements by their SQL, before rebinding
+	stmtsMu sync.Mutex
+	stmts   map[string]*sql.Stmt
+
+	// handlerVersion is recorded with every replay this logger starts
+	handlerVersion string
+	// owner names this process in the leases of the replays it runs
+	owner string
 }
 
 type Replay struct {
@@ -15,9 +37,34 @@ type Replay struct {
 	FileID         string `json:"file_id"`
 	Version        int    `json:"version"`
 	ParentReplayID *int64 `json:"parent_replay_id,omitempty"`
-	CreatedAt      int64  `json:"created_at"`
+	Filter         string `json:"filter,omitempty"`
+	// Status tells whether a normal run is still running or was shut down
+	Status ReplayStatus `json:"status"`
+	// ResumedFrom links a continuation run to the crashed run it picked up
+	ResumedFrom *int64 `json:"resumed_from,omitempty"`
+	// Pinned keeps the replay, and every replay in its tree, out of retention
+	Pinned bool `json:"pinned"`
+	// Compacted tells the consecutive TICKs of the replay were collapsed
+	Compacted bool `json:"compacted"`
+	// HandlerVersion is the build of the handlers that produced the replay
+	HandlerVersion string `json:"handler_version,omitempty"`
+	// Notes is free text about the replay, and Tags label it for listing
+	Notes     string   `json:"notes,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	CreatedAt int64    `json:"created_at"`
 }
 
+type ReplayStatus string
+
+const (
+	REPLAY_RUNNING  ReplayStatus = "running"
+	REPLAY_FINISHED ReplayStatus = "finished"
+	// REPLAY_RECOVERED marks a crashed run a continuation run took over
+	REPLAY_RECOVERED ReplayStatus = "recovered"
+	// REPLAY_ABORTED marks a debug rerun the process stopped in the middle of
+	REPLAY_ABORTED ReplayStatus = "aborted"
+)
+
 type ActionRow struct {
 	ID          int64  `json:"id"`
 	ReplayID    int64  `json:"replay_id"`
@@ -28,11 +75,19 @@ type ActionRow struct {
 	Direction   string `json:"direction"`
 	Payload     string `json:"payload"`
 	ActionType  string `json:"action_type"`
+	VirtualTime int64  `json:"virtual_time,omitempty"`
 	CreatedAt   int64  `json:"created_at"`
 }
 
 func NewActionLogger() *ActionLogger {
-	db, err := sql.Open("sqlite3", "./fund78db")
+	return openSQLiteActionLogger("./fund78db")
+}
+
+// openSQLiteActionLogger opens the action log in a SQLite file. WAL mode lets
+// the engine commit while a compare or a replay download holds a read cursor
+// open for as long as its client takes.
+func openSQLiteActionLogger(path string) *ActionLogger {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -44,15 +99,53 @@ CREATE TABLE IF NOT EXISTS replay_input (
     file_id TEXT NOT NULL,
     version INTEGER NOT NULL,
     parent_replay_id INTEGER,
+    filter TEXT NOT NULL DEFAULT '',
     created_at INTEGER DEFAULT (strftime('%s','now')) NOT NULL,
     FOREIGN KEY (parent_replay_id) REFERENCES replay_input(id)
 );
+CREATE INDEX IF NOT EXISTS replay_input_parent ON replay_input (parent_replay_id);
+CREATE TABLE IF NOT EXISTS replay_tag (
+    replay_id INTEGER NOT NULL,
+    tag TEXT NOT NULL,
+    PRIMARY KEY (replay_id, tag)
+);
+CREATE INDEX IF NOT EXISTS replay_tag_tag ON replay_tag (tag);
 `
 	_, err = db.Exec(sqlText)
 	if err != nil {
 		panic("the create table statement for replay_input failed because: " + err.Error())
 	}
 
+	err = addColumnIfMissing(db, "replay_input", "filter", "TEXT NOT NULL DEFAULT ''")
+	if err == nil {
+		// runs from before statuses existed count as finished, never as crashed
+		err = addColumnIfMissing(db, "replay_input", "status", "TEXT NOT NULL DEFAULT 'finished'")
+	}
+	if err == nil {
+		err = addColumnIfMissing(db, "replay_input", "resumed_from", "INTEGER")
+	}
+	if err == nil {
+		err = addColumnIfMissing(db, "replay_input", "pinned", "BOOLEAN NOT NULL DEFAULT 0")
+	}
+	if err == nil {
+		err = addColumnIfMissing(db, "replay_input", "compacted", "BOOLEAN NOT NULL DEFAULT 0")
+	}
+	if err == nil {
+		err = addColumnIfMissing(db, "replay_input", "handler_version", "TEXT NOT NULL DEFAULT ''")
+	}
+	if err == nil {
+		err = addColumnIfMissing(db, "replay_input", "notes", "TEXT NOT NULL DEFAULT ''")
+	}
+	if err == nil {
+		err = addColumnIfMissing(db, "replay_input", "owner", "TEXT NOT NULL DEFAULT ''")
+	}
+	if err == nil {
+		err = addColumnIfMissing(db, "replay_input", "heartbeat_at", "INTEGER NOT NULL DEFAULT 0")
+	}
+	if err != nil {
+		panic("the migration of replay_input failed because: " + err.Error())
+	}
+
 	actionSql := `
 CREATE TABLE IF NOT EXISTS action (
     id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
@@ -64,8 +157,11 @@ CREATE TABLE IF NOT EXISTS action (
     direction TEXT NOT NULL,
     payload TEXT NOT NULL,
     action_type TEXT NOT NULL,
+    virtual_time INTEGER NOT NULL DEFAULT 0,
     created_at INTEGER DEFAULT (strftime('%s','now')) NOT NULL
 );
+CREATE INDEX IF NOT EXISTS action_replay ON action (replay_id, id);
+CREATE INDEX IF NOT EXISTS action_message ON action (message_id);
 `
 
 	_, err = db.Exec(actionSql)
@@ -73,25 +169,438 @@ CREATE TABLE IF NOT EXISTS action (
 		panic("the create table statement for action failed because: " + err.Error())
 	}
 
-	return &ActionLogger{db: db}
+	err = addColumnIfMissing(db, "action", "virtual_time", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		panic("the migration of action failed because: " + err.Error())
+	}
+
+	timerSql := `
+CREATE TABLE IF NOT EXISTS timer (
+    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    replay_id INTEGER NOT NULL,
+    message_id TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    caused_by TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    fire_at INTEGER NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    created_at INTEGER DEFAULT (strftime('%s','now')) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS timer_pending ON timer (replay_id, status, fire_at);
+`
+	_, err = db.Exec(timerSql)
+	if err != nil {
+		panic("the create table statement for timer failed because: " + err.Error())
+	}
+
+	checkpointSql := `
+CREATE TABLE IF NOT EXISTS generator_checkpoint (
+    name TEXT NOT NULL PRIMARY KEY,
+    value TEXT NOT NULL,
+    updated_at INTEGER DEFAULT (strftime('%s','now')) NOT NULL
+);
+`
+	_, err = db.Exec(checkpointSql)
+	if err != nil {
+		panic("the create table statement for generator_checkpoint failed because: " + err.Error())
+	}
+
+	outboxSql := `
+CREATE TABLE IF NOT EXISTS outbox (
+    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    replay_id INTEGER NOT NULL,
+    message_id TEXT NOT NULL,
+    sink TEXT NOT NULL,
+    visitor TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at INTEGER DEFAULT (strftime('%s','now')) NOT NULL,
+    delivered_at INTEGER,
+    delivery_key TEXT NOT NULL,
+    UNIQUE (sink, delivery_key)
+);
+CREATE INDEX IF NOT EXISTS outbox_pending ON outbox (sink, status, id);
+`
+	_, err = db.Exec(outboxSql)
+	if err != nil {
+		panic("the create table statement for outbox failed because: " + err.Error())
+	}
+	if err = rekeyOutbox(db, outboxSql); err != nil {
+		panic("the migration of outbox failed because: " + err.Error())
+	}
+
+	idempotencySql := `
+CREATE TABLE IF NOT EXISTS idempotency_key (
+    key TEXT NOT NULL PRIMARY KEY,
+    replay_id INTEGER NOT NULL,
+    message_id TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    created_at INTEGER DEFAULT (strftime('%s','now')) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idempotency_key_created ON idempotency_key (created_at);
+`
+	_, err = db.Exec(idempotencySql)
+	if err != nil {
+		panic("the create table statement for idempotency_key failed because: " + err.Error())
+	}
+
+	snapshotSql := `
+CREATE TABLE IF NOT EXISTS state_snapshot (
+    replay_id INTEGER NOT NULL PRIMARY KEY,
+    message_id TEXT NOT NULL,
+    state TEXT NOT NULL,
+    created_at INTEGER DEFAULT (strftime('%s','now')) NOT NULL
+);
+`
+	_, err = db.Exec(snapshotSql)
+	if err != nil {
+		panic("the create table statement for state_snapshot failed because: " + err.Error())
+	}
+	err = addColumnIfMissing(db, "state_snapshot", "handled_id", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		panic("the migration of state_snapshot failed because: " + err.Error())
+	}
+
+	handledSql := `
+CREATE TABLE IF NOT EXISTS handled_visitor (
+    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    replay_id INTEGER NOT NULL,
+    message_id TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS handled_visitor_replay ON handled_visitor (replay_id, id);
+`
+	_, err = db.Exec(handledSql)
+	if err != nil {
+		panic("the create table statement for handled_visitor failed because: " + err.Error())
+	}
+
+	comparisonSql := `
+CREATE TABLE IF NOT EXISTS comparison_report (
+    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    original_replay_id INTEGER NOT NULL,
+    debug_replay_id INTEGER NOT NULL,
+    original_handler_version TEXT NOT NULL,
+    debug_handler_version TEXT NOT NULL,
+    filter TEXT NOT NULL DEFAULT '',
+    identical BOOLEAN NOT NULL,
+    first_divergence INTEGER,
+    original_actions INTEGER NOT NULL,
+    debug_actions INTEGER NOT NULL,
+    inserted INTEGER NOT NULL,
+    deleted INTEGER NOT NULL,
+    changed INTEGER NOT NULL,
+    created_at INTEGER DEFAULT (strftime('%s','now')) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS comparison_report_original ON comparison_report (original_replay_id, id);
+CREATE INDEX IF NOT EXISTS comparison_report_debug ON comparison_report (debug_replay_id, id);
+`
+	_, err = db.Exec(comparisonSql)
+	if err != nil {
+		panic("the create table statement for comparison_report failed because: " + err.Error())
+	}
+
+	fx := &ActionLogger{db: db, dialect: sqliteDialect, handlerVersion: buildHandlerVersion(), owner: processOwner()}
+	fx.actions = sqliteActions{fx: fx}
+	return fx
 }
 
-func (fx *ActionLogger) InsertAction(replayId int64, messageId string, topic string, causedBy string, messageType string, direction string, payload string, actionType string) {
-	sqlText := "INSERT INTO action (replay_id, message_id, topic, caused_by, message_type, direction, payload, action_type) VALUES (?, ?, ?, ?, ?, ?, ?, ?);"
-	_, err := fx.db.Exec(sqlText, replayId, messageId, topic, causedBy, messageType, direction, payload, actionType)
+// UseJournal moves the action rows written from now on to an append-only
+// journal. Replays, timers and everything else stay in the database, and so
+// do the action rows of replays recorded before, which are still read from
+// there.
+func (fx *ActionLogger) UseJournal(config JournalConfig, logger *slog.Logger) error {
+	journal, err := OpenJournal(config, logger)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	fx.actions = layeredActions{journal: journal, table: sqliteActions{fx: fx}}
+	return nil
+}
+
+// Close flushes and closes the action log
+func (fx *ActionLogger) Close() error {
+	err := fx.actions.close()
+	fx.stmtsMu.Lock()
+	for _, stmt := range fx.stmts {
+		stmt.Close()
+	}
+	fx.stmts = nil
+	fx.stmtsMu.Unlock()
+	if dbErr := fx.db.Close(); err == nil {
+		err = dbErr
+	}
+	return err
+}
+
+// addColumnIfMissing upgrades tables created by older versions of the schema
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	found, err := hasColumn(db, table, column)
+	if err != nil || found {
+		return err
 	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition + ";")
+	return err
 }
 
-func (fx *ActionLogger) InsertReplay(name string, fileId string, version int, parentReplayId *int64) (int64, error) {
-	sqlText := "INSERT INTO replay_input (name, file_id, version, parent_replay_id) VALUES (?, ?, ?, ?);"
-	result, err := fx.db.Exec(sqlText, name, fileId, version, parentReplayId)
+func hasColumn(db *sql.DB, table string, column string) (bool, error) {
+	rows, err := db.Query("PRAGMA table_info(" + table + ");")
 	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err = rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// rekeyOutbox rebuilds an outbox from before delivery keys, which was unique
+// by message ID and sink, as createSql describes it. The entries it had keep
+// their message ID as delivery key, the key their sink was sent.
+func rekeyOutbox(db *sql.DB, createSql string) error {
+	found, err := hasColumn(db, "outbox", "delivery_key")
+	if err != nil || found {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, sqlText := range []string{
+		"ALTER TABLE outbox RENAME TO outbox_unkeyed;",
+		"DROP INDEX IF EXISTS outbox_pending;",
+		createSql,
+		"INSERT INTO outbox (id, replay_id, message_id, sink, visitor, status, attempts, next_attempt_at, last_error, created_at, delivered_at, delivery_key) SELECT id, replay_id, message_id, sink, visitor, status, attempts, next_attempt_at, last_error, created_at, delivered_at, message_id FROM outbox_unkeyed;",
+		"DROP TABLE outbox_unkeyed;",
+	} {
+		if _, err = tx.Exec(sqlText); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (fx *ActionLogger) InsertAction(replayId int64, messageId string, topic string, causedBy string, messageType string, direction string, payload string, actionType string, virtualTime int64) {
+	start := time.Now()
+	defer engineMetrics.dbInsertDuration.ObserveSince(start, "action")
+
+	row := ActionRow{ReplayID: replayId, MessageID: messageId, Topic: topic, CausedBy: causedBy, MessageType: messageType, Direction: direction, Payload: payload, ActionType: actionType, VirtualTime: virtualTime}
+	if err := fx.actions.appendAction(nil, row); err != nil {
 		log.Fatal(err)
 	}
+}
+
+// InsertHandledAction records the last action of a visitor, its exit or its
+// dead letter, together with an outbox entry per sink and, for a normal run,
+// the marker that the visitor was handled. It is one transaction, so a visitor
+// is either logged, queued for delivery and marked handled or none of them.
+// Entries are keyed by replay, message and sink, so a visitor whose exit is
+// recorded again is still delivered once.
+//
+// A journal is not part of the transaction. The action is appended to it
+// first, so a crash in between can lose a delivery and handle the visitor
+// again after recovery, but never deliver an output that was not logged.
+func (fx *ActionLogger) InsertHandledAction(replayId int64, messageId string, topic string, causedBy string, messageType string, direction string, payload string, actionType string, virtualTime int64, visitor string, sinks []string, handled bool) {
+	start := time.Now()
+	defer engineMetrics.dbInsertDuration.ObserveSince(start, "action")
 
-	id, err := result.LastInsertId()
+	row := ActionRow{ReplayID: replayId, MessageID: messageId, Topic: topic, CausedBy: causedBy, MessageType: messageType, Direction: direction, Payload: payload, ActionType: actionType, VirtualTime: virtualTime}
+	fx.inTx(func(tx *sql.Tx) {
+		if err := fx.actions.appendAction(tx, row); err != nil {
+			log.Fatal(err)
+		}
+		for _, sink := range sinks {
+			_, err := fx.txExec(tx, "INSERT OR IGNORE INTO outbox (replay_id, message_id, sink, visitor, delivery_key) VALUES (?, ?, ?, ?, ?);", replayId, messageId, sink, visitor, deliveryKey(replayId, messageId, sink))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if handled {
+			if _, err := fx.txExec(tx, "INSERT INTO handled_visitor (replay_id, message_id) VALUES (?, ?);", replayId, messageId); err != nil {
+				log.Fatal(err)
+			}
+		}
+	})
+}
+
+// MarkHandled records that a visitor left nothing to log once handled, as a
+// TICK does, so recovery knows it got through
+func (fx *ActionLogger) MarkHandled(replayID int64, messageID string) {
+	fx.inTx(func(tx *sql.Tx) {
+		if _, err := fx.txExec(tx, "INSERT INTO handled_visitor (replay_id, message_id) VALUES (?, ?);", replayID, messageID); err != nil {
+			log.Fatal(err)
+		}
+	})
+}
+
+// InsertActionOnce records an action unless the idempotency key was already
+// used since windowStart, in unix seconds. For a duplicate it records nothing
+// and returns the message ID recorded with the key. The key and the action are
+// written in one transaction, so a key never points at an input that was not
+// logged. With a journal the action is appended before the key commits, so a
+// crash in between lets a retry of the input in again.
+func (fx *ActionLogger) InsertActionOnce(key string, windowStart int64, replayId int64, messageId string, topic string, causedBy string, messageType string, direction string, payload string, actionType string, virtualTime int64) (string, bool) {
+	start := time.Now()
+	defer engineMetrics.dbInsertDuration.ObserveSince(start, "action")
+
+	original, duplicate := messageId, false
+	fx.inTx(func(tx *sql.Tx) {
+		// the upsert only takes a key over once it left the window, so of two
+		// inputs racing with the same key only one claims it
+		sqlText := "INSERT INTO idempotency_key (key, replay_id, message_id, topic, created_at) VALUES (?, ?, ?, ?, strftime('%s','now')) ON CONFLICT(key) DO UPDATE SET replay_id = excluded.replay_id, message_id = excluded.message_id, topic = excluded.topic, created_at = excluded.created_at WHERE idempotency_key.created_at < ?;"
+		result, err := fx.txExec(tx, sqlText, key, replayId, messageId, topic, windowStart)
+		if err != nil {
+			log.Fatal(err)
+		}
+		claimed, err := result.RowsAffected()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if claimed == 0 {
+			if err = fx.txQueryRow(tx, "SELECT message_id FROM idempotency_key WHERE key = ?;", key).Scan(&original); err != nil {
+				log.Fatal(err)
+			}
+			duplicate = true
+			return
+		}
+		row := ActionRow{ReplayID: replayId, MessageID: messageId, Topic: topic, CausedBy: causedBy, MessageType: messageType, Direction: direction, Payload: payload, ActionType: actionType, VirtualTime: virtualTime}
+		if err = fx.actions.appendAction(tx, row); err != nil {
+			log.Fatal(err)
+		}
+	})
+	return original, duplicate
+}
+
+// InsertActionWithCheckpoint records an input action and moves a generator
+// checkpoint past it in one transaction, so a restart neither enters the input
+// twice nor skips it. With a journal the action is appended before the
+// checkpoint commits, so a crash in between enters the input again.
+func (fx *ActionLogger) InsertActionWithCheckpoint(name string, value string, replayId int64, messageId string, topic string, causedBy string, messageType string, direction string, payload string, actionType string, virtualTime int64) {
+	start := time.Now()
+	defer engineMetrics.dbInsertDuration.ObserveSince(start, "action")
+
+	row := ActionRow{ReplayID: replayId, MessageID: messageId, Topic: topic, CausedBy: causedBy, MessageType: messageType, Direction: direction, Payload: payload, ActionType: actionType, VirtualTime: virtualTime}
+	fx.inTx(func(tx *sql.Tx) {
+		if err := fx.actions.appendAction(tx, row); err != nil {
+			log.Fatal(err)
+		}
+		sqlText := "INSERT INTO generator_checkpoint (name, value) VALUES (?, ?) ON CONFLICT(name) DO UPDATE SET value = excluded.value, updated_at = strftime('%s','now');"
+		if _, err := fx.txExec(tx, sqlText, name, value); err != nil {
+			log.Fatal(err)
+		}
+	})
+}
+
+// inTx runs fn in the open batch, or in a transaction of its own
+func (fx *ActionLogger) inTx(fn func(tx *sql.Tx)) {
+	fx.batchMu.Lock()
+	defer fx.batchMu.Unlock()
+
+	tx := fx.batch
+	if tx != nil {
+		fx.batchWrites++
+	} else {
+		var err error
+		if tx, err = fx.db.Begin(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fn(tx)
+	if tx != fx.batch {
+		if err := tx.Commit(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// writeTx runs fn in a transaction of its own, committed when fn returns no
+// error. The other writers of the action log wait until it is done.
+func (fx *ActionLogger) writeTx(fn func(tx *sql.Tx) error) error {
+	fx.batchMu.Lock()
+	defer fx.batchMu.Unlock()
+
+	tx, err := fx.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PruneIdempotencyKeys forgets the keys used before windowStart, in unix seconds
+func (fx *ActionLogger) PruneIdempotencyKeys(windowStart int64) (int64, error) {
+	result, err := fx.exec("DELETE FROM idempotency_key WHERE created_at < ?;", windowStart)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// exec runs a write inside the open batch, if there is one
+func (fx *ActionLogger) exec(sqlText string, args ...interface{}) (sql.Result, error) {
+	fx.batchMu.Lock()
+	defer fx.batchMu.Unlock()
+	if fx.batch != nil {
+		fx.batchWrites++
+		return fx.txExec(fx.batch, sqlText, args...)
+	}
+	stmt, err := fx.stmt(sqlText)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Exec(args...)
+}
+
+// beginBatch groups the following action inserts into one transaction. Only
+// virtual time runs use it: nothing outside the process observes them while
+// they run, so they can trade per-row durability for speed.
+func (fx *ActionLogger) beginBatch() error {
+	fx.batchMu.Lock()
+	defer fx.batchMu.Unlock()
+	tx, err := fx.db.Begin()
+	if err != nil {
+		return err
+	}
+	fx.batch = tx
+	fx.batchWrites = 0
+	return nil
+}
+
+func (fx *ActionLogger) commitBatch() error {
+	fx.batchMu.Lock()
+	defer fx.batchMu.Unlock()
+	if fx.batch == nil {
+		return nil
+	}
+	err := fx.batch.Commit()
+	if err == nil {
+		engineMetrics.dbBatchSize.Observe(float64(fx.batchWrites))
+	}
+	fx.batch = nil
+	return err
+}
+
+func (fx *ActionLogger) InsertReplay(name string, fileId string, version int, parentReplayId *int64, filter string) (int64, error) {
+	start := time.Now()
+	defer engineMetrics.dbInsertDuration.ObserveSince(start, "replay_input")
+
+	sqlText := "INSERT INTO replay_input (name, file_id, version, parent_replay_id, filter, handler_version) VALUES (?, ?, ?, ?, ?, ?);"
+	id, err := fx.insertID(sqlText, name, fileId, version, parentReplayId, filter, fx.handlerVersion)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -99,9 +608,103 @@ func (fx *ActionLogger) InsertReplay(name string, fileId string, version int, pa
 	return id, nil
 }
 
+// InsertRerun records a debug rerun of a replay, running until the side
+// entrance has handled its visitors, under a lease of this process
+func (fx *ActionLogger) InsertRerun(name string, parentReplayID int64, filter string) (int64, error) {
+	start := time.Now()
+	defer engineMetrics.dbInsertDuration.ObserveSince(start, "replay_input")
+
+	sqlText := "INSERT INTO replay_input (name, file_id, version, parent_replay_id, filter, status, handler_version, owner, heartbeat_at) VALUES (?, '', 1, ?, ?, ?, ?, ?, ?);"
+	return fx.insertID(sqlText, name, parentReplayID, filter, string(REPLAY_RUNNING), fx.handlerVersion, fx.owner, time.Now().Unix())
+}
+
+// AbortReruns marks the debug reruns a stopped process left running as
+// aborted, so they can be deleted. Reruns whose owner still holds its lease
+// are left alone. It returns how many there were.
+func (fx *ActionLogger) AbortReruns() (int64, error) {
+	now := time.Now()
+	leases, err := fx.runningLeases(true)
+	if err != nil {
+		return 0, err
+	}
+	var aborted int64
+	for _, lease := range leases {
+		if !fx.leaseExpired(lease, now) {
+			continue
+		}
+		result, err := fx.exec("UPDATE replay_input SET status = ? WHERE id = ? AND status = ? AND owner = ? AND heartbeat_at = ?;", string(REPLAY_ABORTED), lease.replayID, string(REPLAY_RUNNING), lease.owner, lease.heartbeatAt)
+		if err != nil {
+			return aborted, err
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return aborted, err
+		}
+		aborted += updated
+	}
+	return aborted, nil
+}
+
+// InsertRun records a new normal run, running under a lease of this process
+// until SetReplayStatus says otherwise. resumedFrom links it to the crashed
+// run it continues.
+func (fx *ActionLogger) InsertRun(name string, fileId string, resumedFrom *int64) (int64, error) {
+	start := time.Now()
+	defer engineMetrics.dbInsertDuration.ObserveSince(start, "replay_input")
+
+	sqlText := "INSERT INTO replay_input (name, file_id, version, filter, status, resumed_from, handler_version, owner, heartbeat_at) VALUES (?, ?, 1, '', ?, ?, ?, ?, ?);"
+	return fx.insertID(sqlText, name, fileId, string(REPLAY_RUNNING), resumedFrom, fx.handlerVersion, fx.owner, time.Now().Unix())
+}
+
+func (fx *ActionLogger) SetReplayStatus(replayID int64, status ReplayStatus) error {
+	_, err := fx.exec("UPDATE replay_input SET status = ? WHERE id = ?;", string(status), replayID)
+	return err
+}
+
+const replayColumns = "id, name, file_id, version, parent_replay_id, filter, status, resumed_from, pinned, compacted, handler_version, notes, created_at"
+
+// PinReplay keeps a replay and its tree out of retention, or lets them age out again
+func (fx *ActionLogger) PinReplay(replayID int64, pinned bool) error {
+	return fx.updateReplay(replayID, "UPDATE replay_input SET pinned = ? WHERE id = ?;", pinned, replayID)
+}
+
+// GetReplay returns a replay with its tags, or nil when there is none with
+// that ID
+func (fx *ActionLogger) GetReplay(replayID int64) (*Replay, error) {
+	sqlText := "SELECT " + replayColumns + " FROM replay_input WHERE id = ?;"
+	var replay Replay
+	err := fx.queryRow(sqlText, replayID).Scan(&replay.ID, &replay.Name, &replay.FileID, &replay.Version, &replay.ParentReplayID, &replay.Filter, &replay.Status, &replay.ResumedFrom, &replay.Pinned, &replay.Compacted, &replay.HandlerVersion, &replay.Notes, &replay.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if replay.Tags, err = fx.replayTags(replayID); err != nil {
+		return nil, err
+	}
+	return &replay, nil
+}
+
+// GetUnfinishedRun returns the latest normal run that never shut down, or
+// nil when the last process stopped cleanly. The run may belong to another
+// engine sharing the action log; ClaimUnfinishedRun takes one over.
+func (fx *ActionLogger) GetUnfinishedRun() (*Replay, error) {
+	sqlText := "SELECT " + replayColumns + " FROM replay_input WHERE parent_replay_id IS NULL AND status = ? ORDER BY id DESC LIMIT 1;"
+	var replay Replay
+	err := fx.queryRow(sqlText, string(REPLAY_RUNNING)).Scan(&replay.ID, &replay.Name, &replay.FileID, &replay.Version, &replay.ParentReplayID, &replay.Filter, &replay.Status, &replay.ResumedFrom, &replay.Pinned, &replay.Compacted, &replay.HandlerVersion, &replay.Notes, &replay.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &replay, nil
+}
+
 func (fx *ActionLogger) GetAllReplays() ([]Replay, error) {
-	sqlText := "SELECT id, name, file_id, version, parent_replay_id, created_at FROM replay_input ORDER BY created_at DESC;"
-	rows, err := fx.db.Query(sqlText)
+	sqlText := "SELECT " + replayColumns + " FROM replay_input ORDER BY created_at DESC;"
+	rows, err := fx.query(sqlText)
 	if err != nil {
 		return nil, err
 	}
@@ -110,7 +713,7 @@ func (fx *ActionLogger) GetAllReplays() ([]Replay, error) {
 	replays := make([]Replay, 0)
 	for rows.Next() {
 		var replay Replay
-		err = rows.Scan(&replay.ID, &replay.Name, &replay.FileID, &replay.Version, &replay.ParentReplayID, &replay.CreatedAt)
+		err = rows.Scan(&replay.ID, &replay.Name, &replay.FileID, &replay.Version, &replay.ParentReplayID, &replay.Filter, &replay.Status, &replay.ResumedFrom, &replay.Pinned, &replay.Compacted, &replay.HandlerVersion, &replay.Notes, &replay.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -124,8 +727,8 @@ func (fx *ActionLogger) GetAllReplays() ([]Replay, error) {
 }
 
 func (fx *ActionLogger) GetChildReplays(parentReplayID int64) ([]Replay, error) {
-	sqlText := "SELECT id, name, file_id, version, parent_replay_id, created_at FROM replay_input WHERE parent_replay_id = ? ORDER BY created_at ASC;"
-	rows, err := fx.db.Query(sqlText, parentReplayID)
+	sqlText := "SELECT " + replayColumns + " FROM replay_input WHERE parent_replay_id = ? ORDER BY created_at ASC;"
+	rows, err := fx.query(sqlText, parentReplayID)
 	if err != nil {
 		return nil, err
 	}
@@ -134,7 +737,7 @@ func (fx *ActionLogger) GetChildReplays(parentReplayID int64) ([]Replay, error)
 	replays := make([]Replay, 0)
 	for rows.Next() {
 		var replay Replay
-		err = rows.Scan(&replay.ID, &replay.Name, &replay.FileID, &replay.Version, &replay.ParentReplayID, &replay.CreatedAt)
+		err = rows.Scan(&replay.ID, &replay.Name, &replay.FileID, &replay.Version, &replay.ParentReplayID, &replay.Filter, &replay.Status, &replay.ResumedFrom, &replay.Pinned, &replay.Compacted, &replay.HandlerVersion, &replay.Notes, &replay.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -158,54 +761,473 @@ func (fx *ActionLogger) PrintAllReplays() {
 }
 
 func (fx *ActionLogger) GetRecentMessages(limit int) ([]ActionRow, error) {
-	sqlText := "SELECT id, replay_id, message_id, topic, caused_by, message_type, direction, payload, action_type, created_at FROM action ORDER BY id DESC LIMIT ?;"
-	rows, err := fx.db.Query(sqlText, limit)
+	return fx.actions.recentActions(limit)
+}
+
+func (fx *ActionLogger) GetMessagesByReplayID(replayID int64) ([]ActionRow, error) {
+	messages := make([]ActionRow, 0)
+	err := fx.actions.eachAction(replayID, func(row ActionRow) error {
+		messages = append(messages, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (fx *ActionLogger) CountMessages(replayID int64) (int, error) {
+	return fx.actions.countActions(replayID)
+}
+
+// EachMessage calls fn with the actions of a replay in order without holding
+// them all in memory, stopping at the first error fn returns
+func (fx *ActionLogger) EachMessage(replayID int64, fn func(row ActionRow) error) error {
+	return fx.actions.eachAction(replayID, fn)
+}
+
+func (fx *ActionLogger) scheduleTimer(timer Timer) error {
+	start := time.Now()
+	defer engineMetrics.dbInsertDuration.ObserveSince(start, "timer")
+
+	sqlText := "INSERT INTO timer (replay_id, message_id, topic, caused_by, payload, fire_at, status) VALUES (?, ?, ?, ?, ?, ?, ?);"
+	_, err := fx.exec(sqlText, timer.ReplayID, timer.MessageID, timer.Topic, timer.CausedBy, timer.Payload, timer.FireAt, string(TIMER_PENDING))
+	return err
+}
+
+func (fx *ActionLogger) cancelTimer(replayID int64, messageID string) error {
+	sqlText := "UPDATE timer SET status = ? WHERE replay_id = ? AND message_id = ? AND status = ?;"
+	_, err := fx.exec(sqlText, string(TIMER_CANCELED), replayID, messageID, string(TIMER_PENDING))
+	return err
+}
+
+func (fx *ActionLogger) markTimerFired(id int64) error {
+	sqlText := "UPDATE timer SET status = ? WHERE id = ?;"
+	_, err := fx.exec(sqlText, string(TIMER_FIRED), id)
+	return err
+}
+
+// dueTimers returns the pending timers of a replay due at engine time now, in
+// firing order. It reads through the open batch so timers scheduled in it count.
+func (fx *ActionLogger) dueTimers(replayID int64, now int64) ([]Timer, error) {
+	sqlText := "SELECT id, replay_id, message_id, topic, caused_by, payload, fire_at, status, created_at FROM timer WHERE replay_id = ? AND status = ? AND fire_at <= ? ORDER BY fire_at ASC, id ASC;"
+	fx.batchMu.Lock()
+	defer fx.batchMu.Unlock()
+	var rows *sql.Rows
+	var err error
+	if fx.batch != nil {
+		rows, err = fx.txQuery(fx.batch, sqlText, replayID, string(TIMER_PENDING), now)
+	} else {
+		rows, err = fx.query(sqlText, replayID, string(TIMER_PENDING), now)
+	}
 	if err != nil {
 		return nil, err
 	}
+	return scanTimers(rows)
+}
+
+func (fx *ActionLogger) GetPendingTimers(replayID int64) ([]Timer, error) {
+	sqlText := "SELECT id, replay_id, message_id, topic, caused_by, payload, fire_at, status, created_at FROM timer WHERE replay_id = ? AND status = ? ORDER BY fire_at ASC, id ASC;"
+	rows, err := fx.query(sqlText, replayID, string(TIMER_PENDING))
+	if err != nil {
+		return nil, err
+	}
+	return scanTimers(rows)
+}
+
+// orphanedTimers returns the timers still pending in normal runs other than
+// replayID, in the order they are due. A timer is leased with the run that
+// set it, so the timers of runs another engine still holds are left out.
+func (fx *ActionLogger) orphanedTimers(replayID int64) ([]Timer, error) {
+	now := time.Now()
+	leases, err := fx.runningLeases(false)
+	if err != nil {
+		return nil, err
+	}
+	held := make(map[int64]bool)
+	for _, lease := range leases {
+		if !fx.leaseExpired(lease, now) {
+			held[lease.replayID] = true
+		}
+	}
+
+	sqlText := "SELECT id, replay_id, message_id, topic, caused_by, payload, fire_at, status, created_at FROM timer WHERE status = ? AND replay_id != ? AND replay_id IN (SELECT id FROM replay_input WHERE parent_replay_id IS NULL) ORDER BY fire_at ASC, id ASC;"
+	rows, err := fx.query(sqlText, string(TIMER_PENDING), replayID)
+	if err != nil {
+		return nil, err
+	}
+	timers, err := scanTimers(rows)
+	if err != nil {
+		return nil, err
+	}
+	orphaned := timers[:0]
+	for _, timer := range timers {
+		if !held[timer.ReplayID] {
+			orphaned = append(orphaned, timer)
+		}
+	}
+	return orphaned, nil
+}
+
+// InsertTimerAdoption records the input that carries a pending timer of an
+// earlier run into a new one and marks the timer adopted, in one transaction,
+// so the timer fires in exactly one run. It records nothing and returns false
+// when the timer is no longer pending.
+func (fx *ActionLogger) InsertTimerAdoption(timerID int64, replayId int64, messageId string, topic string, causedBy string, messageType string, direction string, payload string, actionType string, virtualTime int64) bool {
+	start := time.Now()
+	defer engineMetrics.dbInsertDuration.ObserveSince(start, "action")
+
+	adopted := false
+	fx.inTx(func(tx *sql.Tx) {
+		result, err := fx.txExec(tx, "UPDATE timer SET status = ? WHERE id = ? AND status = ?;", string(TIMER_ADOPTED), timerID, string(TIMER_PENDING))
+		if err != nil {
+			log.Fatal(err)
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if updated == 0 {
+			return
+		}
+		row := ActionRow{ReplayID: replayId, MessageID: messageId, Topic: topic, CausedBy: causedBy, MessageType: messageType, Direction: direction, Payload: payload, ActionType: actionType, VirtualTime: virtualTime}
+		if err = fx.actions.appendAction(tx, row); err != nil {
+			log.Fatal(err)
+		}
+		adopted = true
+	})
+	return adopted
+}
+
+// InsertFiredTimer logs the visitor a timer fires and marks the timer fired,
+// in one transaction, so a fired timer always has its visitor in the log
+func (fx *ActionLogger) InsertFiredTimer(timerID int64, replayId int64, messageId string, topic string, causedBy string, messageType string, direction string, payload string, actionType string, virtualTime int64) {
+	start := time.Now()
+	defer engineMetrics.dbInsertDuration.ObserveSince(start, "action")
+
+	row := ActionRow{ReplayID: replayId, MessageID: messageId, Topic: topic, CausedBy: causedBy, MessageType: messageType, Direction: direction, Payload: payload, ActionType: actionType, VirtualTime: virtualTime}
+	fx.inTx(func(tx *sql.Tx) {
+		if err := fx.actions.appendAction(tx, row); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := fx.txExec(tx, "UPDATE timer SET status = ? WHERE id = ?;", string(TIMER_FIRED), timerID); err != nil {
+			log.Fatal(err)
+		}
+	})
+}
+
+// SaveSnapshot keeps the state of a replay as it was right after the visitor
+// messageID exited, replacing the previous snapshot. The snapshot remembers the
+// last visitor marked handled, which has to be messageID.
+func (fx *ActionLogger) SaveSnapshot(replayID int64, messageID string, state string) error {
+	start := time.Now()
+	defer engineMetrics.dbInsertDuration.ObserveSince(start, "state_snapshot")
+
+	sqlText := "INSERT INTO state_snapshot (replay_id, message_id, state, handled_id) VALUES (?, ?, ?, (SELECT COALESCE(MAX(id), 0) FROM handled_visitor WHERE replay_id = ?)) ON CONFLICT(replay_id) DO UPDATE SET message_id = excluded.message_id, state = excluded.state, handled_id = excluded.handled_id, created_at = strftime('%s','now');"
+	_, err := fx.exec(sqlText, replayID, messageID, state, replayID)
+	return err
+}
+
+// handledVisitors returns the message IDs of the visitors a replay marked
+// handled, in the order it handled them, and how many of them its snapshot
+// already holds
+func (fx *ActionLogger) handledVisitors(replayID int64) ([]string, int, error) {
+	var snapshotAt int64
+	err := fx.queryRow("SELECT handled_id FROM state_snapshot WHERE replay_id = ?;", replayID).Scan(&snapshotAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, 0, err
+	}
+
+	rows, err := fx.query("SELECT id, message_id FROM handled_visitor WHERE replay_id = ? ORDER BY id ASC;", replayID)
+	if err != nil {
+		return nil, 0, err
+	}
 	defer rows.Close()
 
-	messages := make([]ActionRow, 0)
+	var handled []string
+	inSnapshot := 0
 	for rows.Next() {
-		var msg ActionRow
-		err = rows.Scan(&msg.ID, &msg.ReplayID, &msg.MessageID, &msg.Topic, &msg.CausedBy, &msg.MessageType, &msg.Direction, &msg.Payload, &msg.ActionType, &msg.CreatedAt)
+		var id int64
+		var messageID string
+		if err = rows.Scan(&id, &messageID); err != nil {
+			return nil, 0, err
+		}
+		if id <= snapshotAt {
+			inSnapshot++
+		}
+		handled = append(handled, messageID)
+	}
+	return handled, inSnapshot, rows.Err()
+}
+
+// GetSnapshot returns the last snapshot of a replay, if one was saved
+func (fx *ActionLogger) GetSnapshot(replayID int64) (messageID string, state string, found bool, err error) {
+	err = fx.queryRow("SELECT message_id, state FROM state_snapshot WHERE replay_id = ?;", replayID).Scan(&messageID, &state)
+	if err == sql.ErrNoRows {
+		return "", "", false, nil
+	}
+	if err != nil {
+		return "", "", false, err
+	}
+	return messageID, state, true, nil
+}
+
+// GetCheckpoint returns where a generator left off, if it saved a checkpoint
+func (fx *ActionLogger) GetCheckpoint(name string) (string, bool, error) {
+	var value string
+	err := fx.queryRow("SELECT value FROM generator_checkpoint WHERE name = ?;", name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (fx *ActionLogger) SaveCheckpoint(name string, value string) error {
+	start := time.Now()
+	defer engineMetrics.dbInsertDuration.ObserveSince(start, "generator_checkpoint")
+
+	sqlText := "INSERT INTO generator_checkpoint (name, value) VALUES (?, ?) ON CONFLICT(name) DO UPDATE SET value = excluded.value, updated_at = strftime('%s','now');"
+	_, err := fx.exec(sqlText, name, value)
+	return err
+}
+
+func scanTimers(rows *sql.Rows) ([]Timer, error) {
+	defer rows.Close()
+
+	timers := make([]Timer, 0)
+	for rows.Next() {
+		var timer Timer
+		var status string
+		err := rows.Scan(&timer.ID, &timer.ReplayID, &timer.MessageID, &timer.Topic, &timer.CausedBy, &timer.Payload, &timer.FireAt, &status, &timer.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
-		messages = append(messages, msg)
+		timer.Status = TimerStatus(status)
+		timers = append(timers, timer)
 	}
-	if err = rows.Err(); err != nil {
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+	return timers, nil
+}
 
-	// Reverse the slice to get chronological order
-	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-		messages[i], messages[j] = messages[j], messages[i]
-	}
+type OutboxStatus string
 
-	return messages, nil
+const (
+	OUTBOX_PENDING   OutboxStatus = "pending"
+	OUTBOX_DELIVERED OutboxStatus = "delivered"
+	OUTBOX_FAILED    OutboxStatus = "failed"
+)
+
+// OutboxEntry is a visitor waiting to be delivered to a sink, or the record
+// that it was. NextAttemptAt is in unix milliseconds.
+type OutboxEntry struct {
+	ID            int64        `json:"id"`
+	ReplayID      int64        `json:"replay_id"`
+	MessageID     string       `json:"message_id"`
+	Sink          string       `json:"sink"`
+	Visitor       string       `json:"visitor"`
+	Status        OutboxStatus `json:"status"`
+	Attempts      int          `json:"attempts"`
+	NextAttemptAt int64        `json:"next_attempt_at"`
+	LastError     string       `json:"last_error,omitempty"`
+	CreatedAt     int64        `json:"created_at"`
+	DeliveredAt   *int64       `json:"delivered_at,omitempty"`
+	// DeliveryKey identifies the delivery to the sink across its retries
+	DeliveryKey string `json:"delivery_key"`
 }
 
-func (fx *ActionLogger) GetMessagesByReplayID(replayID int64) ([]ActionRow, error) {
-	sqlText := "SELECT id, replay_id, message_id, topic, caused_by, message_type, direction, payload, action_type, created_at FROM action WHERE replay_id = ? ORDER BY id ASC;"
-	rows, err := fx.db.Query(sqlText, replayID)
+const outboxColumns = "id, replay_id, message_id, sink, visitor, status, attempts, next_attempt_at, last_error, created_at, delivered_at, delivery_key"
+
+// pendingOutbox returns the oldest entries a sink still has to deliver
+func (fx *ActionLogger) pendingOutbox(sink string, limit int) ([]OutboxEntry, error) {
+	sqlText := "SELECT " + outboxColumns + " FROM outbox WHERE sink = ? AND status = ? ORDER BY id ASC LIMIT ?;"
+	rows, err := fx.query(sqlText, sink, string(OUTBOX_PENDING), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanOutbox(rows)
+}
+
+// GetOutbox lists the entries with a status, or all of them when status is
+// empty, newest first
+func (fx *ActionLogger) GetOutbox(status OutboxStatus, limit int) ([]OutboxEntry, error) {
+	var rows *sql.Rows
+	var err error
+	if status == "" {
+		rows, err = fx.query("SELECT "+outboxColumns+" FROM outbox ORDER BY id DESC LIMIT ?;", limit)
+	} else {
+		rows, err = fx.query("SELECT "+outboxColumns+" FROM outbox WHERE status = ? ORDER BY id DESC LIMIT ?;", string(status), limit)
+	}
 	if err != nil {
 		return nil, err
 	}
+	return scanOutbox(rows)
+}
+
+// markOutboxDelivered closes an entry. Only a pending entry is closed, so a
+// delivery is counted once however often it is marked.
+func (fx *ActionLogger) markOutboxDelivered(id int64, attempts int) (bool, error) {
+	sqlText := "UPDATE outbox SET status = ?, attempts = ?, last_error = '', delivered_at = strftime('%s','now') WHERE id = ? AND status = ?;"
+	result, err := fx.exec(sqlText, string(OUTBOX_DELIVERED), attempts, id, string(OUTBOX_PENDING))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// retryOutbox keeps an entry pending until nextAttemptAt
+func (fx *ActionLogger) retryOutbox(id int64, attempts int, nextAttemptAt int64, lastError string) error {
+	sqlText := "UPDATE outbox SET attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ? AND status = ?;"
+	_, err := fx.exec(sqlText, attempts, nextAttemptAt, lastError, id, string(OUTBOX_PENDING))
+	return err
+}
+
+func (fx *ActionLogger) failOutbox(id int64, attempts int, lastError string) error {
+	sqlText := "UPDATE outbox SET status = ?, attempts = ?, last_error = ? WHERE id = ? AND status = ?;"
+	_, err := fx.exec(sqlText, string(OUTBOX_FAILED), attempts, lastError, id, string(OUTBOX_PENDING))
+	return err
+}
+
+// RetryFailedOutbox puts the failed entries of a sink, or of every sink when
+// sink is empty, back in the queue with fresh attempts
+func (fx *ActionLogger) RetryFailedOutbox(sink string) (int64, error) {
+	var result sql.Result
+	var err error
+	if sink == "" {
+		result, err = fx.exec("UPDATE outbox SET status = ?, attempts = 0, next_attempt_at = 0 WHERE status = ?;", string(OUTBOX_PENDING), string(OUTBOX_FAILED))
+	} else {
+		result, err = fx.exec("UPDATE outbox SET status = ?, attempts = 0, next_attempt_at = 0 WHERE status = ? AND sink = ?;", string(OUTBOX_PENDING), string(OUTBOX_FAILED), sink)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func scanOutbox(rows *sql.Rows) ([]OutboxEntry, error) {
 	defer rows.Close()
 
-	messages := make([]ActionRow, 0)
+	entries := make([]OutboxEntry, 0)
 	for rows.Next() {
-		var msg ActionRow
-		err = rows.Scan(&msg.ID, &msg.ReplayID, &msg.MessageID, &msg.Topic, &msg.CausedBy, &msg.MessageType, &msg.Direction, &msg.Payload, &msg.ActionType, &msg.CreatedAt)
+		var entry OutboxEntry
+		var status string
+		var deliveredAt sql.NullInt64
+		err := rows.Scan(&entry.ID, &entry.ReplayID, &entry.MessageID, &entry.Sink, &entry.Visitor, &status, &entry.Attempts, &entry.NextAttemptAt, &entry.LastError, &entry.CreatedAt, &deliveredAt, &entry.DeliveryKey)
 		if err != nil {
 			return nil, err
 		}
-		messages = append(messages, msg)
+		entry.Status = OutboxStatus(status)
+		if deliveredAt.Valid {
+			entry.DeliveredAt = &deliveredAt.Int64
+		}
+		entries = append(entries, entry)
 	}
-	if err = rows.Err(); err != nil {
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+	return entries, nil
+}
 
-	return messages, nil
+// ComparisonReport is the stored summary of one debug run compared to its
+// original replay. FirstDivergence is the index in the original of the first
+// difference, nil when the run was identical.
+type ComparisonReport struct {
+	ID                     int64  `json:"id"`
+	OriginalReplayID       int64  `json:"original_replay_id"`
+	DebugReplayID          int64  `json:"debug_replay_id"`
+	OriginalHandlerVersion string `json:"original_handler_version"`
+	DebugHandlerVersion    string `json:"debug_handler_version"`
+	Filter                 string `json:"filter,omitempty"`
+	Identical              bool   `json:"identical"`
+	FirstDivergence        *int   `json:"first_divergence,omitempty"`
+	OriginalActions        int    `json:"original_actions"`
+	DebugActions           int    `json:"debug_actions"`
+	Inserted               int    `json:"inserted"`
+	Deleted                int    `json:"deleted"`
+	Changed                int    `json:"changed"`
+	CreatedAt              int64  `json:"created_at"`
+}
+
+const comparisonReportColumns = "id, original_replay_id, debug_replay_id, original_handler_version, debug_handler_version, filter, identical, first_divergence, original_actions, debug_actions, inserted, deleted, changed, created_at"
+
+// InsertComparisonReport stores a report, unless the newest report of the
+// same debug run says the same. Then it returns that report's ID, so looking
+// at a compare again does not add to the history.
+func (fx *ActionLogger) InsertComparisonReport(report ComparisonReport) (int64, error) {
+	latest, err := fx.latestComparisonReport(report.OriginalReplayID, report.DebugReplayID)
+	if err != nil {
+		return 0, err
+	}
+	if latest != nil && latest.sameAs(report) {
+		return latest.ID, nil
+	}
+
+	start := time.Now()
+	defer engineMetrics.dbInsertDuration.ObserveSince(start, "comparison_report")
+
+	sqlText := "INSERT INTO comparison_report (original_replay_id, debug_replay_id, original_handler_version, debug_handler_version, filter, identical, first_divergence, original_actions, debug_actions, inserted, deleted, changed) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);"
+	return fx.insertID(sqlText, report.OriginalReplayID, report.DebugReplayID, report.OriginalHandlerVersion, report.DebugHandlerVersion, report.Filter, report.Identical, report.FirstDivergence, report.OriginalActions, report.DebugActions, report.Inserted, report.Deleted, report.Changed)
+}
+
+// latestComparisonReport returns the newest report of a debug run compared to
+// its original, or nil if it was never compared
+func (fx *ActionLogger) latestComparisonReport(originalReplayID int64, debugReplayID int64) (*ComparisonReport, error) {
+	sqlText := "SELECT " + comparisonReportColumns + " FROM comparison_report WHERE original_replay_id = ? AND debug_replay_id = ? ORDER BY id DESC LIMIT 1;"
+	rows, err := fx.query(sqlText, originalReplayID, debugReplayID)
+	if err != nil {
+		return nil, err
+	}
+	reports, err := scanComparisonReports(rows)
+	if err != nil || len(reports) == 0 {
+		return nil, err
+	}
+	return &reports[0], nil
+}
+
+// sameAs reports whether two reports compared the same runs, handler versions
+// and filter with the same outcome
+func (r ComparisonReport) sameAs(other ComparisonReport) bool {
+	sameDivergence := r.FirstDivergence == nil && other.FirstDivergence == nil ||
+		r.FirstDivergence != nil && other.FirstDivergence != nil && *r.FirstDivergence == *other.FirstDivergence
+	r.ID, r.CreatedAt, r.FirstDivergence = other.ID, other.CreatedAt, other.FirstDivergence
+	return sameDivergence && r == other
+}
+
+// GetComparisonReports lists the newest reports a replay took part in, as the
+// original or as the debug run
+func (fx *ActionLogger) GetComparisonReports(replayID int64, limit int) ([]ComparisonReport, error) {
+	sqlText := "SELECT " + comparisonReportColumns + " FROM comparison_report WHERE original_replay_id = ? OR debug_replay_id = ? ORDER BY id DESC LIMIT ?;"
+	rows, err := fx.query(sqlText, replayID, replayID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanComparisonReports(rows)
+}
+
+func scanComparisonReports(rows *sql.Rows) ([]ComparisonReport, error) {
+	defer rows.Close()
+
+	reports := make([]ComparisonReport, 0)
+	for rows.Next() {
+		var report ComparisonReport
+		var firstDivergence sql.NullInt64
+		err := rows.Scan(&report.ID, &report.OriginalReplayID, &report.DebugReplayID, &report.OriginalHandlerVersion, &report.DebugHandlerVersion, &report.Filter, &report.Identical, &firstDivergence, &report.OriginalActions, &report.DebugActions, &report.Inserted, &report.Deleted, &report.Changed, &report.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if firstDivergence.Valid {
+			index := int(firstDivergence.Int64)
+			report.FirstDivergence = &index
+		}
+		reports = append(reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return reports, nil
 }
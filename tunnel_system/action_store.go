@@ -0,0 +1,197 @@
+package tunnel_system
+
+import "database/sql"
+
+// actionStore keeps the action rows of every replay, in the order they were
+// appended. Row IDs grow with every append, across replays and restarts.
+type actionStore interface {
+	// appendAction adds a row. tx is the database transaction the row belongs
+	// to, if any; stores outside the database append on their own.
+	appendAction(tx *sql.Tx, row ActionRow) error
+	// eachAction calls fn with the rows of a replay in order, reading them as
+	// it goes, until fn returns an error
+	eachAction(replayID int64, fn func(row ActionRow) error) error
+	countActions(replayID int64) (int, error)
+	// recentActions returns the last rows of all replays, oldest first
+	recentActions(limit int) ([]ActionRow, error)
+	// deleteReplays drops the rows of the replays, in tx when the store is in
+	// the database
+	deleteReplays(tx *sql.Tx, replayIDs []int64) error
+	// deleteActions drops single rows and returns how many it dropped
+	deleteActions(tx *sql.Tx, ids []int64) (int64, error)
+	// deletesActions tells whether deleteActions is supported
+	deletesActions() bool
+	// sync forces the rows appended so far to disk
+	sync() error
+	close() error
+}
+
+// sqliteActions keeps the action rows in the action table
+type sqliteActions struct {
+	fx *ActionLogger
+}
+
+const actionColumns = "id, replay_id, message_id, topic, caused_by, message_type, direction, payload, action_type, virtual_time, created_at"
+
+func (s sqliteActions) appendAction(tx *sql.Tx, row ActionRow) error {
+	sqlText := "INSERT INTO action (replay_id, message_id, topic, caused_by, message_type, direction, payload, action_type, virtual_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);"
+	args := []interface{}{row.ReplayID, row.MessageID, row.Topic, row.CausedBy, row.MessageType, row.Direction, row.Payload, row.ActionType, row.VirtualTime}
+	var err error
+	if tx != nil {
+		_, err = s.fx.txExec(tx, sqlText, args...)
+	} else {
+		_, err = s.fx.exec(sqlText, args...)
+	}
+	return err
+}
+
+func (s sqliteActions) eachAction(replayID int64, fn func(row ActionRow) error) error {
+	rows, err := s.fx.query("SELECT "+actionColumns+" FROM action WHERE replay_id = ? ORDER BY id ASC;", replayID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row ActionRow
+		if err = scanAction(rows, &row); err != nil {
+			return err
+		}
+		if err = fn(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s sqliteActions) countActions(replayID int64) (int, error) {
+	var count int
+	err := s.fx.queryRow("SELECT COUNT(*) FROM action WHERE replay_id = ?;", replayID).Scan(&count)
+	return count, err
+}
+
+func (s sqliteActions) recentActions(limit int) ([]ActionRow, error) {
+	rows, err := s.fx.query("SELECT "+actionColumns+" FROM action ORDER BY id DESC LIMIT ?;", limit)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanActions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reverse the slice to get chronological order
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func (s sqliteActions) deleteReplays(tx *sql.Tx, replayIDs []int64) error {
+	_, err := s.fx.deleteIn(tx, "DELETE FROM action WHERE replay_id IN (%s);", replayIDs)
+	return err
+}
+
+func (s sqliteActions) deleteActions(tx *sql.Tx, ids []int64) (int64, error) {
+	return s.fx.deleteIn(tx, "DELETE FROM action WHERE id IN (%s);", ids)
+}
+
+func (s sqliteActions) deletesActions() bool {
+	return true
+}
+
+// sync has nothing to do: a row is on disk once its transaction commits
+func (s sqliteActions) sync() error {
+	return nil
+}
+
+func (s sqliteActions) close() error {
+	return nil
+}
+
+// layeredActions appends to a journal that replaced the action table, and
+// keeps reading the replays recorded in the table before it did
+type layeredActions struct {
+	journal *Journal
+	table   sqliteActions
+}
+
+func (l layeredActions) appendAction(tx *sql.Tx, row ActionRow) error {
+	return l.journal.appendAction(tx, row)
+}
+
+// eachAction reads the table first; a replay has rows in only one of the two,
+// as the store is chosen when the engine starts
+func (l layeredActions) eachAction(replayID int64, fn func(row ActionRow) error) error {
+	if err := l.table.eachAction(replayID, fn); err != nil {
+		return err
+	}
+	return l.journal.eachAction(replayID, fn)
+}
+
+func (l layeredActions) countActions(replayID int64) (int, error) {
+	inTable, err := l.table.countActions(replayID)
+	if err != nil {
+		return 0, err
+	}
+	inJournal, err := l.journal.countActions(replayID)
+	return inTable + inJournal, err
+}
+
+// recentActions tops the journal's rows up with the older ones of the table
+func (l layeredActions) recentActions(limit int) ([]ActionRow, error) {
+	recent, err := l.journal.recentActions(limit)
+	if err != nil || len(recent) >= limit {
+		return recent, err
+	}
+	older, err := l.table.recentActions(limit - len(recent))
+	if err != nil {
+		return nil, err
+	}
+	return append(older, recent...), nil
+}
+
+func (l layeredActions) deleteReplays(tx *sql.Tx, replayIDs []int64) error {
+	if err := l.table.deleteReplays(tx, replayIDs); err != nil {
+		return err
+	}
+	return l.journal.deleteReplays(tx, replayIDs)
+}
+
+// deleteActions is refused, as the IDs of the table and the journal overlap
+func (l layeredActions) deleteActions(tx *sql.Tx, ids []int64) (int64, error) {
+	return l.journal.deleteActions(tx, ids)
+}
+
+func (l layeredActions) deletesActions() bool {
+	return false
+}
+
+func (l layeredActions) sync() error {
+	return l.journal.sync()
+}
+
+func (l layeredActions) close() error {
+	return l.journal.close()
+}
+
+func scanActions(rows *sql.Rows) ([]ActionRow, error) {
+	defer rows.Close()
+
+	messages := make([]ActionRow, 0)
+	for rows.Next() {
+		var msg ActionRow
+		if err := scanAction(rows, &msg); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func scanAction(rows *sql.Rows, row *ActionRow) error {
+	return rows.Scan(&row.ID, &row.ReplayID, &row.MessageID, &row.Topic, &row.CausedBy, &row.MessageType, &row.Direction, &row.Payload, &row.ActionType, &row.VirtualTime, &row.CreatedAt)
+}
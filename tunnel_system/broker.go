@@ -0,0 +1,285 @@
+package tunnel_system
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// BrokerMessage is one record read from a broker topic
+type BrokerMessage struct {
+	Topic     string            `json:"topic"`
+	Partition int               `json:"partition"`
+	Offset    int64             `json:"offset"`
+	Key       string            `json:"key,omitempty"`
+	Value     []byte            `json:"value"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// Broker hands out consumers of a message broker. A Kafka or NATS client is
+// plugged in by implementing it; MemoryBroker runs in process.
+type Broker interface {
+	Subscribe(group string, topics []string) (Consumer, error)
+}
+
+// Consumer reads the messages of a consumer group. Fetch waits up to timeout
+// and reports false when nothing arrived. Commit records that a message was
+// handled, so the group resumes after it.
+type Consumer interface {
+	Fetch(timeout time.Duration) (BrokerMessage, bool, error)
+	Commit(msg BrokerMessage) error
+	Close() error
+}
+
+// BrokerGenerator enters the messages of broker topics as visitors. An offset
+// is committed only once Enter has written the visitor to the action log and
+// a journal has synced it to disk, so a crash redelivers a message instead of
+// losing it.
+type BrokerGenerator struct {
+	Name   string
+	Broker Broker
+	Group  string
+	Topics []string
+	// Map turns a message into a visitor input, DefaultBrokerMapping if nil
+	Map func(msg BrokerMessage) (VisitorInput, error)
+	// PollTimeout bounds how long a fetch waits, and so how quickly the
+	// generator notices it was paused or removed
+	PollTimeout time.Duration
+
+	generatorControl
+}
+
+func NewBrokerGenerator(name string, broker Broker, group string, topics ...string) *BrokerGenerator {
+	return &BrokerGenerator{
+		Name:        name,
+		Broker:      broker,
+		Group:       group,
+		Topics:      topics,
+		PollTimeout: time.Second,
+	}
+}
+
+// DefaultBrokerMapping reads a message holding a VisitorInput as JSON, and
+// otherwise uses the broker topic as topic and the message value as payload
+func DefaultBrokerMapping(msg BrokerMessage) (VisitorInput, error) {
+	var input VisitorInput
+	if err := json.Unmarshal(msg.Value, &input); err == nil && input.Topic != "" {
+		return input, nil
+	}
+	return VisitorInput{Topic: msg.Topic, Payload: string(msg.Value)}, nil
+}
+
+func (g *BrokerGenerator) Start(ts *TunnelSystem) {
+	logger := ts.logger.With("component", "broker", "generator", g.Name, "group", g.Group)
+	consumer, err := g.Broker.Subscribe(g.Group, g.Topics)
+	if err != nil {
+		logger.Error("broker subscription failed", "topics", g.Topics, "error", err)
+		return
+	}
+
+	mapping := g.Map
+	if mapping == nil {
+		mapping = DefaultBrokerMapping
+	}
+
+	go func() {
+		defer consumer.Close()
+		// held is a message fetched while the generator was being paused,
+		// entered once it is resumed
+		var held *BrokerMessage
+		for g.wait(0) {
+			// A paused generator stops fetching, so messages wait on the broker
+			if g.isPaused() {
+				g.wait(g.PollTimeout)
+				continue
+			}
+
+			if held == nil {
+				msg, ok, err := consumer.Fetch(g.PollTimeout)
+				if err != nil {
+					logger.Error("broker fetch failed", "error", err)
+					g.wait(g.PollTimeout)
+					continue
+				}
+				if !ok {
+					continue
+				}
+				held = &msg
+				if g.isPaused() {
+					continue
+				}
+			}
+
+			msg := *held
+			held = nil
+			g.enter(ts, logger, mapping, msg)
+			if actionLogger := ts.mainEntrance.actionLogger; actionLogger != nil {
+				if err := actionLogger.actions.sync(); err != nil {
+					logger.Error("syncing the action log failed, leaving the offset uncommitted", "topic", msg.Topic, "offset", msg.Offset, "error", err)
+					continue
+				}
+			}
+			if err := consumer.Commit(msg); err != nil {
+				logger.Error("broker commit failed, message may be delivered again", "topic", msg.Topic, "offset", msg.Offset, "error", err)
+			}
+		}
+		logger.Info("broker generator stopped")
+	}()
+	logger.Info("started broker generator", "topics", g.Topics)
+}
+
+// enter maps and enters one message. A message that cannot be mapped, or has
+// no handler, is dead-lettered in the run so it cannot block the topic and is
+// not lost with its offset.
+func (g *BrokerGenerator) enter(ts *TunnelSystem, logger *slog.Logger, mapping func(BrokerMessage) (VisitorInput, error), msg BrokerMessage) {
+	input, err := mapping(msg)
+	if err != nil {
+		logger.Warn("dead-lettering unmappable broker message", "topic", msg.Topic, "offset", msg.Offset, "error", err)
+		g.deadLetter(ts, msg.Topic, msg, err.Error())
+		return
+	}
+	if !knownTopic(ActionName(input.Topic)) {
+		logger.Warn("dead-lettering broker message without a handler", "topic", msg.Topic, "offset", msg.Offset, "visitor_topic", input.Topic)
+		g.deadLetter(ts, input.Topic, msg, "no handler for topic "+input.Topic)
+		return
+	}
+
+	v := NewInputAction(ActionName(input.Topic), input.Payload)
+	ts.mainEntrance.Enter(v)
+	g.countEmit()
+	engineMetrics.generatorEmits.Inc("broker", input.Topic)
+}
+
+// deadLetter records a message the generator skips as a DEAD_LETTER row of
+// the run, holding the reason and where the message came from
+func (g *BrokerGenerator) deadLetter(ts *TunnelSystem, topic string, msg BrokerMessage, reason string) {
+	main := ts.mainEntrance
+	v := NewInputAction(ActionName(topic), string(msg.Value))
+	main.admit(v)
+	main.recordDeadLetter(v, fmt.Sprintf("%s: %s partition %d offset %d: %s", reason, msg.Topic, msg.Partition, msg.Offset, msg.Value))
+}
+
+// MemoryBroker is an in-process broker with one partition per topic, for
+// tests and local runs. Committed offsets outlive consumers, so a new
+// consumer of a group resumes where the last one committed.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	topics    map[string][]BrokerMessage
+	committed map[string]int64
+	published chan struct{}
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		topics:    make(map[string][]BrokerMessage),
+		committed: make(map[string]int64),
+		published: make(chan struct{}),
+	}
+}
+
+// Publish appends a message to a topic and returns its offset
+func (b *MemoryBroker) Publish(topic string, key string, value []byte) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	offset := int64(len(b.topics[topic]))
+	b.topics[topic] = append(b.topics[topic], BrokerMessage{
+		Topic:     topic,
+		Offset:    offset,
+		Key:       key,
+		Value:     value,
+		Timestamp: time.Now(),
+	})
+	close(b.published)
+	b.published = make(chan struct{})
+	return offset
+}
+
+// Committed returns the next offset a group will read from a topic
+func (b *MemoryBroker) Committed(group string, topic string) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.committed[memoryOffsetKey(group, topic)]
+}
+
+func (b *MemoryBroker) Subscribe(group string, topics []string) (Consumer, error) {
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("subscribing group %q needs at least one topic", group)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	positions := make(map[string]int64, len(topics))
+	for _, topic := range topics {
+		positions[topic] = b.committed[memoryOffsetKey(group, topic)]
+	}
+	return &memoryConsumer{broker: b, group: group, topics: topics, positions: positions}, nil
+}
+
+func memoryOffsetKey(group string, topic string) string {
+	return group + "\x00" + topic
+}
+
+type memoryConsumer struct {
+	broker    *MemoryBroker
+	group     string
+	topics    []string
+	positions map[string]int64
+	next      int
+	closed    bool
+}
+
+// Fetch returns the next message of the subscribed topics, taking the topics
+// in turn so a busy one cannot starve the others
+func (c *memoryConsumer) Fetch(timeout time.Duration) (BrokerMessage, bool, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		c.broker.mu.Lock()
+		if c.closed {
+			c.broker.mu.Unlock()
+			return BrokerMessage{}, false, fmt.Errorf("consumer of group %q is closed", c.group)
+		}
+		for i := range c.topics {
+			topic := c.topics[(c.next+i)%len(c.topics)]
+			messages := c.broker.topics[topic]
+			if position := c.positions[topic]; position < int64(len(messages)) {
+				msg := messages[position]
+				c.positions[topic] = position + 1
+				c.next = (c.next + i + 1) % len(c.topics)
+				c.broker.mu.Unlock()
+				return msg, true, nil
+			}
+		}
+		published := c.broker.published
+		c.broker.mu.Unlock()
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return BrokerMessage{}, false, nil
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-published:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (c *memoryConsumer) Commit(msg BrokerMessage) error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	key := memoryOffsetKey(c.group, msg.Topic)
+	if msg.Offset+1 > c.broker.committed[key] {
+		c.broker.committed[key] = msg.Offset + 1
+	}
+	return nil
+}
+
+func (c *memoryConsumer) Close() error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	c.closed = true
+	return nil
+}
@@ -0,0 +1,162 @@
+package tunnel_system
+
+import (
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryBrokerResumesAfterCommit(t *testing.T) {
+	broker := NewMemoryBroker()
+	for _, value := range []string{"a", "b", "c"} {
+		broker.Publish("orders", "", []byte(value))
+	}
+
+	consumer, err := broker.Subscribe("engine", []string{"orders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := fetch(t, consumer)
+	if err = consumer.Commit(first); err != nil {
+		t.Fatal(err)
+	}
+	// fetched but never committed, so delivered again to the next consumer
+	fetch(t, consumer)
+	consumer.Close()
+
+	if committed := broker.Committed("engine", "orders"); committed != 1 {
+		t.Errorf("committed offset %d, want 1", committed)
+	}
+	consumer, err = broker.Subscribe("engine", []string{"orders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	if msg := fetch(t, consumer); string(msg.Value) != "b" {
+		t.Errorf("resumed at %q, want b", msg.Value)
+	}
+
+	other, err := broker.Subscribe("audit", []string{"orders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if msg := fetch(t, other); string(msg.Value) != "a" {
+		t.Errorf("a new group started at %q, want a", msg.Value)
+	}
+}
+
+func TestMemoryBrokerTakesTopicsInTurn(t *testing.T) {
+	broker := NewMemoryBroker()
+	for i := 0; i < 3; i++ {
+		broker.Publish("busy", "", []byte("busy"))
+	}
+	broker.Publish("quiet", "", []byte("quiet"))
+
+	consumer, err := broker.Subscribe("engine", []string{"busy", "quiet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	var topics []string
+	for i := 0; i < 4; i++ {
+		topics = append(topics, fetch(t, consumer).Topic)
+	}
+	if topics[0] != "busy" || topics[1] != "quiet" {
+		t.Errorf("fetched %v, want the quiet topic second", topics)
+	}
+}
+
+func TestMemoryBrokerFetchWaits(t *testing.T) {
+	broker := NewMemoryBroker()
+	consumer, err := broker.Subscribe("engine", []string{"orders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := consumer.Fetch(10 * time.Millisecond); ok || err != nil {
+		t.Fatalf("fetch from an empty topic returned %v, %v", ok, err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		broker.Publish("orders", "", []byte("late"))
+	}()
+	msg, ok, err := consumer.Fetch(5 * time.Second)
+	if err != nil || !ok || string(msg.Value) != "late" {
+		t.Fatalf("fetch returned %q, %v, %v, want the message published while waiting", msg.Value, ok, err)
+	}
+
+	consumer.Close()
+	if _, _, err = consumer.Fetch(0); err == nil {
+		t.Error("fetch from a closed consumer succeeded")
+	}
+	if _, err = broker.Subscribe("engine", nil); err == nil {
+		t.Error("subscribing to no topics succeeded")
+	}
+}
+
+func TestBrokerGeneratorCommitsEnteredAndDeadLetteredMessages(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	actionLogger := openSQLiteActionLogger(filepath.Join(t.TempDir(), "broker.db"))
+	defer actionLogger.Close()
+	ts := &TunnelSystem{mainEntrance: NewNormalTunnel(actionLogger, logger, false), logger: logger}
+
+	broker := NewMemoryBroker()
+	broker.Publish("ticks", "", []byte(`{"topic":"TICK","payload":"1"}`))
+	broker.Publish("ticks", "", []byte(`{"topic":"NO_SUCH_TOPIC","payload":"2"}`))
+	broker.Publish("ticks", "", []byte("3"))
+
+	generator := NewBrokerGenerator("broker", broker, "engine", "ticks")
+	generator.PollTimeout = 10 * time.Millisecond
+	generator.Start(ts)
+	defer generator.stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for broker.Committed("engine", "ticks") < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if committed := broker.Committed("engine", "ticks"); committed != 3 {
+		t.Fatalf("committed offset %d, want 3", committed)
+	}
+
+	rows, err := actionLogger.GetMessagesByReplayID(ts.mainEntrance.replayId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payloads, deadLetters []string
+	for _, row := range rows {
+		if row.ActionType == string(DEAD_LETTER) {
+			deadLetters = append(deadLetters, row.Topic)
+			continue
+		}
+		if row.Topic != string(TICK) {
+			t.Errorf("entered a visitor for %s, which has no handler", row.Topic)
+		}
+		payloads = append(payloads, row.Payload)
+	}
+	if len(payloads) != 1 || payloads[0] != "1" {
+		t.Errorf("entered %v, want [1]", payloads)
+	}
+	// the raw message is mapped to its broker topic, which has no handler
+	if len(deadLetters) != 2 || deadLetters[0] != "NO_SUCH_TOPIC" || deadLetters[1] != "ticks" {
+		t.Errorf("dead-lettered %v, want [NO_SUCH_TOPIC ticks]", deadLetters)
+	}
+	if emitted := generator.emitCount(); emitted != 1 {
+		t.Errorf("generator counted %d visitors, want 1", emitted)
+	}
+}
+
+func fetch(t *testing.T, consumer Consumer) BrokerMessage {
+	t.Helper()
+	msg, ok, err := consumer.Fetch(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("nothing to fetch")
+	}
+	return msg
+}
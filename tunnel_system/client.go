@@ -3,8 +3,9 @@ package tunnel_system
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"os"
+	"time"
 )
 
 type server struct {
@@ -21,15 +22,34 @@ func (s *server) start(port string) {
 	http.HandleFunc("/replay/", s.handleGetReplay)
 	http.HandleFunc("/rerun/", s.handleRerunReplay)
 	http.HandleFunc("/compare/", s.handleCompareReplay)
-
-	log.Printf("Server starting on http://localhost%s", port)
-	log.Printf("Get replay actions: GET http://localhost%s/replay/{id}", port)
-	log.Printf("Re-run replay: GET http://localhost%s/rerun/{id}", port)
-	log.Printf("Compare replay to debug runs: GET http://localhost%s/compare/{id}", port)
+	http.HandleFunc("/comparisons/", s.handleGetComparisons)
+	http.HandleFunc("/minimize/", s.handleMinimizeReplay)
+	http.HandleFunc("/timers/", s.handleGetTimers)
+	http.HandleFunc("/outbox", s.handleGetOutbox)
+	http.HandleFunc("/outbox/retry", s.handleRetryOutbox)
+	http.HandleFunc("/metrics", s.handleMetrics)
+	s.registerDebuggerRoutes()
+	s.registerGeneratorRoutes()
+	s.registerReplayRoutes()
+
+	logger := s.tunnelSystem.logger.With("component", "server")
+	logger.Info("server starting", "address", "http://localhost"+port)
+	logger.Info("get replay actions: GET /replay/{id}")
+	logger.Info("re-run replay: GET /rerun/{id}?debug=true&start=&stop=&from=&to=&include=&exclude=&where=path=value")
+	logger.Info("compare replay to debug runs: GET /compare/{id}?ignore=message_id,payload.ts&max_diffs=100&window=1000&stream=true")
+	logger.Info("comparison history of a replay: GET /comparisons/{id}?limit=100")
+	logger.Info("minimize failing replay: GET /minimize/{id}?predicate=divergence|dead_letter|state&assert=&topic=&name= (runs in the background, poll the child replay for its status)")
+	logger.Info("pending timers: GET /timers/{id}")
+	logger.Info("sink outbox: GET /outbox?status=pending|delivered|failed&limit=100, POST /outbox/retry?sink=")
+	logger.Info("generators: GET /generators, POST /generators, GET|DELETE /generators/{name}, POST /generators/{name}/pause|resume|interval?every=5s")
+	logger.Info("replays: GET /replays?tag=, GET|DELETE /replays/{id}?archive=true, POST /replays/{id}/rename?name=|notes|tags?add=&remove=|pin|unpin")
+	logger.Info("metrics: GET /metrics")
+	logger.Info("debugger: GET /debug, /debug/state, POST /debug/pause, /debug/resume, /debug/step?count={n} with ?replay={id}, /debug/breakpoints")
 
 	go func() {
 		if err := http.ListenAndServe(port, nil); err != nil {
-			log.Fatal(err)
+			logger.Error("server error", "error", err)
+			os.Exit(1)
 		}
 	}()
 }
@@ -44,27 +64,37 @@ func (s *server) handleGetReplay(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get messages for this replay (already ordered from first to most recent)
-	messages, err := s.tunnelSystem.sideEntrance.actionLogger.GetMessagesByReplayID(replayID)
+	actionLogger := s.tunnelSystem.sideEntrance.actionLogger
+	total, err := actionLogger.CountMessages(replayID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error fetching messages: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Print them out in order
+	// Print the messages in order as they are read, so a long replay is never
+	// held in memory
 	w.Header().Set("Content-Type", "text/plain")
 	fmt.Fprintf(w, "Replay ID: %d\n", replayID)
-	fmt.Fprintf(w, "Total Actions: %d\n", len(messages))
+	fmt.Fprintf(w, "Total Actions: %d\n", total)
 	fmt.Fprintf(w, "%s\n\n", "===========================================")
 
-	for i, msg := range messages {
-		fmt.Fprintf(w, "[%d] Message ID: %s\n", i+1, msg.MessageID)
+	i := 0
+	err = actionLogger.EachMessage(replayID, func(msg ActionRow) error {
+		i++
+		fmt.Fprintf(w, "[%d] Message ID: %s\n", i, msg.MessageID)
 		fmt.Fprintf(w, "    ActionName: %s\n", msg.Topic)
 		fmt.Fprintf(w, "    Type: %s | ActionDirection: %s | Action Type: %s\n", msg.MessageType, msg.Direction, msg.ActionType)
 		fmt.Fprintf(w, "    Caused By: %s\n", msg.CausedBy)
 		fmt.Fprintf(w, "    Payload: %s\n", msg.Payload)
+		if msg.VirtualTime != 0 {
+			fmt.Fprintf(w, "    Virtual Time: %s\n", time.Unix(0, msg.VirtualTime).UTC().Format(time.RFC3339Nano))
+		}
 		fmt.Fprintf(w, "    Created At: %d\n", msg.CreatedAt)
-		fmt.Fprintf(w, "\n")
+		_, err := fmt.Fprintf(w, "\n")
+		return err
+	})
+	if err != nil {
+		s.tunnelSystem.logger.Error("writing replay failed", "replay_id", replayID, "error", err)
 	}
 }
 
@@ -84,8 +114,15 @@ func (s *server) handleRerunReplay(w http.ResponseWriter, r *http.Request) {
 		debugName = fmt.Sprintf("Debug of replay %d", replayID)
 	}
 
+	// Optional selection of the actions to replay, recorded on the child replay
+	filter, err := ParseReplayFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filter: %v", err), http.StatusBadRequest)
+		return
+	}
+
 	// Create a new replay entry as a child of the original
-	debugReplayID, err := s.tunnelSystem.sideEntrance.actionLogger.InsertReplay(debugName, "", 1, &replayID)
+	debugReplayID, err := s.tunnelSystem.sideEntrance.actionLogger.InsertRerun(debugName, replayID, filter.JSON())
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error creating debug replay: %v", err), http.StatusInternalServerError)
 		return
@@ -97,26 +134,122 @@ func (s *server) handleRerunReplay(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Error fetching messages: %v", err), http.StatusInternalServerError)
 		return
 	}
+	messages = filter.Apply(messages)
 
-	// Re-enqueue all messages in order with the NEW debug replay ID
-	for _, msg := range messages {
-		visitor := NewVisitorFromActionRow(
-			msg.MessageID,
-			msg.Topic,
-			msg.CausedBy,
-			msg.MessageType,
-			msg.Direction,
-			msg.Payload,
-			debugReplayID,
-		)
-		s.tunnelSystem.sideEntrance.Enter(visitor)
+	// In debug mode the rerun stops before its first visitor so it can be stepped
+	debugMode := r.URL.Query().Get("debug") == "true"
+	if debugMode {
+		s.tunnelSystem.debugger.start(debugReplayID)
 	}
 
+	// Re-enqueue all messages in order with the NEW debug replay ID.
+	// The side entrance handles them again so exits are produced by this run.
+	visitors := NewVisitorsFromActionRows(messages, debugReplayID)
+
+	// Entering may block on a paused debugger, so do not hold up the response
+	s.tunnelSystem.sideEntrance.rerun(debugReplayID, visitors)
+
+	requeued := len(visitors)
+	engineMetrics.rerunBatchSize.Observe(float64(requeued))
+	s.tunnelSystem.logger.Info("rerun queued", "component", "server", "replay_id", replayID, "debug_replay_id", debugReplayID, "actions", requeued)
+
 	// Send response
 	w.Header().Set("Content-Type", "text/plain")
 	fmt.Fprintf(w, "Created debug replay %d (parent: %d) named '%s'\n", debugReplayID, replayID, debugName)
-	fmt.Fprintf(w, "Successfully re-queued %d messages\n", len(messages))
-	fmt.Fprintf(w, "Messages will be processed by the main loop\n")
+	if !filter.IsEmpty() {
+		fmt.Fprintf(w, "Filter: %s\n", filter.JSON())
+	}
+	fmt.Fprintf(w, "Successfully re-queued %d messages\n", requeued)
+	if debugMode {
+		fmt.Fprintf(w, "Debugger is paused, step with /debug/step?replay=%d or resume with /debug/resume?replay=%d\n", debugReplayID, debugReplayID)
+	} else {
+		fmt.Fprintf(w, "Messages will be processed by the side entrance\n")
+	}
+}
+
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	engineMetrics.WritePrometheus(w)
+}
+
+func (s *server) handleGetTimers(w http.ResponseWriter, r *http.Request) {
+	var replayID int64
+	_, err := fmt.Sscanf(r.URL.Path, "/timers/%d", &replayID)
+	if err != nil {
+		http.Error(w, "Invalid replay ID. Use /timers/{id}", http.StatusBadRequest)
+		return
+	}
+
+	timers, err := s.tunnelSystem.mainEntrance.actionLogger.GetPendingTimers(replayID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching timers: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, timers)
+}
+
+func (s *server) handleGetOutbox(w http.ResponseWriter, r *http.Request) {
+	status := OutboxStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "", OUTBOX_PENDING, OUTBOX_DELIVERED, OUTBOX_FAILED:
+	default:
+		http.Error(w, "Invalid status. Use pending, delivered or failed", http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if _, err := fmt.Sscanf(value, "%d", &limit); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := s.tunnelSystem.mainEntrance.actionLogger.GetOutbox(status, limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching outbox: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+// handleGetComparisons lists the stored comparison reports of a replay,
+// newest first, to follow a divergence across handler versions
+func (s *server) handleGetComparisons(w http.ResponseWriter, r *http.Request) {
+	var replayID int64
+	if _, err := fmt.Sscanf(r.URL.Path, "/comparisons/%d", &replayID); err != nil {
+		http.Error(w, "Invalid replay ID. Use /comparisons/{id}", http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if _, err := fmt.Sscanf(value, "%d", &limit); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	reports, err := s.tunnelSystem.sideEntrance.actionLogger.GetComparisonReports(replayID, limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching comparison reports: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, reports)
+}
+
+// handleRetryOutbox gives the failed deliveries of a sink another round
+func (s *server) handleRetryOutbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Use POST /outbox/retry?sink=", http.StatusMethodNotAllowed)
+		return
+	}
+	sink := r.URL.Query().Get("sink")
+	retried, err := s.tunnelSystem.mainEntrance.actionLogger.RetryFailedOutbox(sink)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrying outbox: %v", err), http.StatusInternalServerError)
+		return
+	}
+	s.tunnelSystem.mainEntrance.sinks.notifyAll()
+	writeJSON(w, map[string]int64{"retried": retried})
 }
 
 // Alternative handler if you prefer query parameter instead of path parameter
@@ -147,21 +280,6 @@ func (s *server) handleGetReplayQuery(w http.ResponseWriter, r *http.Request) {
 	//}
 }
 
-type ComparisonResult struct {
-	OriginalReplayID int64                `json:"original_replay_id"`
-	OriginalName     string               `json:"original_name"`
-	ActionCount      int                  `json:"action_count"`
-	DebugRuns        []DebugRunComparison `json:"debug_runs"`
-}
-
-type DebugRunComparison struct {
-	ReplayID    int64    `json:"replay_id"`
-	Name        string   `json:"name"`
-	ActionCount int      `json:"action_count"`
-	Identical   bool     `json:"identical"`
-	Differences []string `json:"differences,omitempty"`
-}
-
 func (s *server) handleCompareReplay(w http.ResponseWriter, r *http.Request) {
 	// Extract replay ID from URL path
 	var replayID int64
@@ -172,66 +290,48 @@ func (s *server) handleCompareReplay(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get the original replay info
-	allReplays, err := s.tunnelSystem.sideEntrance.actionLogger.GetAllReplays()
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching replays: %v", err), http.StatusInternalServerError)
-		return
+	// Optional ignore rules, e.g. ?ignore=message_id,payload.timestamp
+	opts := DefaultCompareOptions()
+	if ignore := r.URL.Query().Get("ignore"); ignore != "" {
+		opts.Diff.IgnoreFields = append(opts.Diff.IgnoreFields, ParseIgnoreFields(ignore)...)
 	}
-
-	var originalReplay *Replay
-	for _, r := range allReplays {
-		if r.ID == replayID {
-			originalReplay = &r
-			break
+	for _, limit := range []struct {
+		param  string
+		target *int
+	}{
+		{"max_diffs", &opts.MaxDifferences},
+		{"window", &opts.ResyncWindow},
+	} {
+		if value := r.URL.Query().Get(limit.param); value != "" {
+			if _, err := fmt.Sscanf(value, "%d", limit.target); err != nil || *limit.target <= 0 {
+				http.Error(w, fmt.Sprintf("Invalid %s %q", limit.param, value), http.StatusBadRequest)
+				return
+			}
 		}
 	}
 
-	if originalReplay == nil {
+	actionLogger := s.tunnelSystem.sideEntrance.actionLogger
+	original, err := actionLogger.GetReplay(replayID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching replays: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if original == nil {
 		http.Error(w, fmt.Sprintf("Replay %d not found", replayID), http.StatusNotFound)
 		return
 	}
 
-	// Get original actions
-	originalActions, err := s.tunnelSystem.sideEntrance.actionLogger.GetMessagesByReplayID(replayID)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching original actions: %v", err), http.StatusInternalServerError)
+	if r.URL.Query().Get("stream") == "true" {
+		s.streamCompare(w, actionLogger, *original, opts)
 		return
 	}
 
-	// Get all child replays (debug runs)
-	childReplays, err := s.tunnelSystem.sideEntrance.actionLogger.GetChildReplays(replayID)
+	result, err := compareReplay(actionLogger, *original, opts)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching child replays: %v", err), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Compare each debug run to the original
-	debugRuns := make([]DebugRunComparison, 0)
-	for _, child := range childReplays {
-		debugActions, err := s.tunnelSystem.sideEntrance.actionLogger.GetMessagesByReplayID(child.ID)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error fetching debug actions: %v", err), http.StatusInternalServerError)
-			return
-		}
-
-		comparison := compareActions(originalActions, debugActions)
-		debugRuns = append(debugRuns, DebugRunComparison{
-			ReplayID:    child.ID,
-			Name:        child.Name,
-			ActionCount: len(debugActions),
-			Identical:   comparison.Identical,
-			Differences: comparison.Differences,
-		})
-	}
-
-	result := ComparisonResult{
-		OriginalReplayID: replayID,
-		OriginalName:     originalReplay.Name,
-		ActionCount:      len(originalActions),
-		DebugRuns:        debugRuns,
-	}
-
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(result); err != nil {
 		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
@@ -239,68 +339,24 @@ func (s *server) handleCompareReplay(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-type actionComparison struct {
-	Identical   bool
-	Differences []string
-}
-
-func compareActions(original, debug []ActionRow) actionComparison {
-	differences := make([]string, 0)
-
-	// Check count
-	if len(original) != len(debug) {
-		differences = append(differences, fmt.Sprintf("Action count mismatch: original has %d, debug has %d", len(original), len(debug)))
-
-		// Still compare the common actions
-		minLen := len(original)
-		if len(debug) < minLen {
-			minLen = len(debug)
+// streamCompare writes a compare as newline delimited JSON events, flushed as
+// they come. A failure after the first event ends the stream with an error
+// event, since the status is already sent.
+func (s *server) streamCompare(w http.ResponseWriter, actionLogger *ActionLogger, original Replay, opts CompareOptions) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	_, err := streamCompareReplay(actionLogger, original, opts, func(event CompareEvent) error {
+		if err := encoder.Encode(event); err != nil {
+			return err
 		}
-
-		for i := 0; i < minLen; i++ {
-			diff := compareMessage(original[i], debug[i], i)
-			differences = append(differences, diff...)
-		}
-
-		return actionComparison{
-			Identical:   false,
-			Differences: differences,
+		if flusher != nil {
+			flusher.Flush()
 		}
+		return nil
+	})
+	if err != nil {
+		s.tunnelSystem.logger.Error("streaming compare failed", "replay_id", original.ID, "error", err)
+		encoder.Encode(map[string]string{"type": "error", "error": err.Error()})
 	}
-
-	// Compare each action
-	for i := 0; i < len(original); i++ {
-		diff := compareMessage(original[i], debug[i], i)
-		differences = append(differences, diff...)
-	}
-
-	return actionComparison{
-		Identical:   len(differences) == 0,
-		Differences: differences,
-	}
-}
-
-func compareMessage(orig, dbg ActionRow, index int) []string {
-	differences := make([]string, 0)
-
-	if orig.MessageID != dbg.MessageID {
-		differences = append(differences, fmt.Sprintf("Index %d: MessageID differs (%s vs %s)", index, orig.MessageID, dbg.MessageID))
-	}
-	if orig.Topic != dbg.Topic {
-		differences = append(differences, fmt.Sprintf("Index %d: ActionName differs (%s vs %s)", index, orig.Topic, dbg.Topic))
-	}
-	if orig.CausedBy != dbg.CausedBy {
-		differences = append(differences, fmt.Sprintf("Index %d: CausedBy differs (%s vs %s)", index, orig.CausedBy, dbg.CausedBy))
-	}
-	if orig.MessageType != dbg.MessageType {
-		differences = append(differences, fmt.Sprintf("Index %d: ActionType differs (%s vs %s)", index, orig.MessageType, dbg.MessageType))
-	}
-	if orig.Direction != dbg.Direction {
-		differences = append(differences, fmt.Sprintf("Index %d: ActionDirection differs (%s vs %s)", index, orig.Direction, dbg.Direction))
-	}
-	if orig.Payload != dbg.Payload {
-		differences = append(differences, fmt.Sprintf("Index %d: Payload differs (%s vs %s)", index, orig.Payload, dbg.Payload))
-	}
-
-	return differences
 }
@@ -0,0 +1,99 @@
+package tunnel_system
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the engine's source of time
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// VirtualClock only moves when the virtual scheduler advances it
+type VirtualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// scheduledGenerator is implemented by generators that fire on a schedule,
+// which lets the virtual scheduler run them without sleeping
+type scheduledGenerator interface {
+	InputGenerator
+	firstFire(start time.Time) time.Time
+	nextFire(last time.Time) time.Time
+	inputAt(at time.Time) VisitorInput
+}
+
+type scheduledEntry struct {
+	generator scheduledGenerator
+	next      time.Time
+}
+
+// VirtualScheduler runs scheduled generators on a virtual clock, always firing
+// the generator with the earliest next fire time (the first registered wins a
+// tie) and jumping the clock straight to it
+type VirtualScheduler struct {
+	clock   *VirtualClock
+	entries []*scheduledEntry
+}
+
+func NewVirtualScheduler(clock *VirtualClock) *VirtualScheduler {
+	return &VirtualScheduler{clock: clock}
+}
+
+func (s *VirtualScheduler) add(generator scheduledGenerator) {
+	s.entries = append(s.entries, &scheduledEntry{
+		generator: generator,
+		next:      generator.firstFire(s.clock.Now()),
+	})
+}
+
+// run fires every generator due up to and including until, in time order
+func (s *VirtualScheduler) run(until time.Time, fire func(at time.Time, input VisitorInput)) int {
+	fired := 0
+	for {
+		var earliest *scheduledEntry
+		for _, entry := range s.entries {
+			if entry.next.IsZero() {
+				continue
+			}
+			if earliest == nil || entry.next.Before(earliest.next) {
+				earliest = entry
+			}
+		}
+		if earliest == nil || earliest.next.After(until) {
+			break
+		}
+
+		at := earliest.next
+		s.clock.set(at)
+		fire(at, earliest.generator.inputAt(at))
+		fired++
+		earliest.next = earliest.generator.nextFire(at)
+	}
+	s.clock.set(until)
+	return fired
+}
@@ -0,0 +1,501 @@
+package tunnel_system
+
+import (
+	"errors"
+	"fmt"
+)
+
+type ComparisonResult struct {
+	OriginalReplayID int64                `json:"original_replay_id"`
+	OriginalName     string               `json:"original_name"`
+	ActionCount      int                  `json:"action_count"`
+	DebugRuns        []DebugRunComparison `json:"debug_runs"`
+}
+
+type DebugRunComparison struct {
+	ReplayID    int64  `json:"replay_id"`
+	Name        string `json:"name"`
+	Filter      string `json:"filter,omitempty"`
+	ActionCount int    `json:"action_count"`
+	Identical   bool   `json:"identical"`
+	Inserted    int    `json:"inserted"`
+	Deleted     int    `json:"deleted"`
+	Changed     int    `json:"changed"`
+	// FirstDivergence is the index in the original where the run first
+	// differs, nil when it is identical
+	FirstDivergence *int `json:"first_divergence,omitempty"`
+	// Truncated tells the run has more differences than were reported; the
+	// counts cover all of them
+	Truncated bool `json:"truncated,omitempty"`
+	// ReportID is the stored comparison report of the run
+	ReportID    int64        `json:"report_id,omitempty"`
+	Differences []ActionDiff `json:"differences,omitempty"`
+}
+
+// CompareOptions control a streaming compare
+type CompareOptions struct {
+	Diff DiffOptions
+	// MaxDifferences caps the differences reported per debug run. Zero means
+	// DefaultMaxDifferences.
+	MaxDifferences int
+	// ResyncWindow is how many actions ahead a compare looks in both replays
+	// to line them up again after a difference, and how far apart the actions
+	// of a message may be to be grouped. Zero means DefaultResyncWindow.
+	ResyncWindow int
+}
+
+const (
+	DefaultMaxDifferences = 100
+	DefaultResyncWindow   = 1000
+)
+
+// compareProgressEvery is how many original actions a debug run compares
+// between progress events
+const compareProgressEvery = 10000
+
+func DefaultCompareOptions() CompareOptions {
+	return CompareOptions{
+		Diff:           DefaultDiffOptions(),
+		MaxDifferences: DefaultMaxDifferences,
+		ResyncWindow:   DefaultResyncWindow,
+	}
+}
+
+type CompareEventType string
+
+const (
+	// COMPARE_RUN starts the comparison of a debug run
+	COMPARE_RUN CompareEventType = "run"
+	// COMPARE_DIFFERENCE reports one difference of the current debug run
+	COMPARE_DIFFERENCE CompareEventType = "difference"
+	// COMPARE_PROGRESS tells how far the current debug run got
+	COMPARE_PROGRESS CompareEventType = "progress"
+	// COMPARE_RUN_DONE sums up a debug run, without its differences
+	COMPARE_RUN_DONE CompareEventType = "run_done"
+	// COMPARE_DONE ends the compare with every summary
+	COMPARE_DONE CompareEventType = "done"
+)
+
+// CompareEvent is one line of a streamed compare
+type CompareEvent struct {
+	Type       CompareEventType    `json:"type"`
+	ReplayID   int64               `json:"replay_id,omitempty"`
+	Name       string              `json:"name,omitempty"`
+	Difference *ActionDiff         `json:"difference,omitempty"`
+	Original   int                 `json:"original_actions,omitempty"`
+	Debug      int                 `json:"debug_actions,omitempty"`
+	Run        *DebugRunComparison `json:"run,omitempty"`
+	Result     *ComparisonResult   `json:"result,omitempty"`
+}
+
+// compareReplay compares every debug run of a replay to the replay and
+// returns the result with at most opts.MaxDifferences differences per run
+func compareReplay(actionLogger *ActionLogger, original Replay, opts CompareOptions) (ComparisonResult, error) {
+	return streamCompareReplay(actionLogger, original, opts, nil)
+}
+
+// streamCompareReplay compares every debug run of a replay to the replay,
+// reading both in lockstep so neither is held in memory, and stores a
+// comparison report per run whose outcome changed since it was last compared.
+// emit, when set, receives the differences and progress as they come.
+func streamCompareReplay(actionLogger *ActionLogger, original Replay, opts CompareOptions, emit func(event CompareEvent) error) (ComparisonResult, error) {
+	if opts.MaxDifferences <= 0 {
+		opts.MaxDifferences = DefaultMaxDifferences
+	}
+	if opts.ResyncWindow <= 0 {
+		opts.ResyncWindow = DefaultResyncWindow
+	}
+	if emit == nil {
+		emit = func(event CompareEvent) error { return nil }
+	}
+	result := ComparisonResult{
+		OriginalReplayID: original.ID,
+		OriginalName:     original.Name,
+		DebugRuns:        make([]DebugRunComparison, 0),
+	}
+
+	childReplays, err := actionLogger.GetChildReplays(original.ID)
+	if err != nil {
+		return result, fmt.Errorf("fetching child replays: %w", err)
+	}
+
+	counted := false
+	for _, child := range childReplays {
+		// A filtered rerun is compared against the same selection of the original
+		childFilter, err := ParseReplayFilterJSON(child.Filter)
+		if err != nil {
+			return result, fmt.Errorf("reading filter of replay %d: %w", child.ID, err)
+		}
+		if err = emit(CompareEvent{Type: COMPARE_RUN, ReplayID: child.ID, Name: child.Name}); err != nil {
+			return result, err
+		}
+
+		originalCount := 0
+		selects := childFilter.selector()
+		originals := actionLogger.streamActions(original.ID, func(row ActionRow) bool {
+			if row.ActionType == string(AUDIT) {
+				return false
+			}
+			originalCount++
+			return selects(row)
+		})
+		debugs := actionLogger.streamActions(child.ID, func(row ActionRow) bool { return true })
+		totals := func() (int, int, error) {
+			return countCompared(actionLogger, original.ID, child.ID, childFilter)
+		}
+		run, err := compareRun(originals, debugs, opts, totals, func(diff ActionDiff) error {
+			return emit(CompareEvent{Type: COMPARE_DIFFERENCE, ReplayID: child.ID, Difference: &diff})
+		}, func(originalIndex, debugIndex int) error {
+			return emit(CompareEvent{Type: COMPARE_PROGRESS, ReplayID: child.ID, Original: originalIndex, Debug: debugIndex})
+		})
+		originals.close()
+		debugs.close()
+		if err == nil {
+			err = originals.err
+		}
+		if err == nil {
+			err = debugs.err
+		}
+		if err != nil {
+			return result, fmt.Errorf("comparing debug run %d: %w", child.ID, err)
+		}
+
+		if !counted {
+			result.ActionCount, counted = originalCount, true
+		}
+		run.ReplayID, run.Name, run.Filter = child.ID, child.Name, child.Filter
+		run.ReportID, err = actionLogger.InsertComparisonReport(ComparisonReport{
+			OriginalReplayID:       original.ID,
+			DebugReplayID:          child.ID,
+			OriginalHandlerVersion: original.HandlerVersion,
+			DebugHandlerVersion:    child.HandlerVersion,
+			Filter:                 child.Filter,
+			Identical:              run.Identical,
+			FirstDivergence:        run.FirstDivergence,
+			OriginalActions:        originalCount,
+			DebugActions:           run.ActionCount,
+			Inserted:               run.Inserted,
+			Deleted:                run.Deleted,
+			Changed:                run.Changed,
+		})
+		if err != nil {
+			return result, fmt.Errorf("saving the report of debug run %d: %w", child.ID, err)
+		}
+		summary := run
+		summary.Differences = nil
+		if err = emit(CompareEvent{Type: COMPARE_RUN_DONE, ReplayID: child.ID, Run: &summary}); err != nil {
+			return result, err
+		}
+		result.DebugRuns = append(result.DebugRuns, run)
+	}
+
+	if !counted {
+		err = actionLogger.EachMessage(original.ID, func(row ActionRow) error {
+			if row.ActionType != string(AUDIT) {
+				result.ActionCount++
+			}
+			return nil
+		})
+		if err != nil {
+			return result, fmt.Errorf("fetching original actions: %w", err)
+		}
+	}
+
+	done := result
+	done.DebugRuns = make([]DebugRunComparison, len(result.DebugRuns))
+	for i, run := range result.DebugRuns {
+		run.Differences = nil
+		done.DebugRuns[i] = run
+	}
+	return result, emit(CompareEvent{Type: COMPARE_DONE, Result: &done})
+}
+
+// compareRun walks an original and a debug sequence in lockstep. Actions with
+// the same identity are compared field by field. Where the identities differ,
+// it looks up to opts.ResyncWindow actions ahead in both for the nearest
+// point where they line up again, and reports what it skipped as deleted from
+// the original and inserted into the debug run. Without such a point, the gap
+// is longer than the window and must lie in the sequence with more actions
+// left, so one action of that sequence is skipped, until the point comes into
+// the window. totals counts both sequences, when a gap first needs it.
+func compareRun(original, debug rowSource, opts CompareOptions, totals func() (int, int, error), difference func(diff ActionDiff) error, progress func(originalIndex, debugIndex int) error) (DebugRunComparison, error) {
+	if opts.Diff.GroupByMessage {
+		original = newMessageGrouper(original, opts.ResyncWindow)
+		debug = newMessageGrouper(debug, opts.ResyncWindow)
+	}
+	orig, dbg := &lookahead{source: original}, &lookahead{source: debug}
+	run := DebugRunComparison{Differences: make([]ActionDiff, 0)}
+	origIndex, debugIndex, nextProgress := 0, 0, compareProgressEvery
+	origTotal, debugTotal, counted := 0, 0, false
+
+	report := func(diff ActionDiff) error {
+		switch diff.Kind {
+		case DIFF_CHANGED:
+			run.Changed++
+		case DIFF_DELETED:
+			run.Deleted++
+		case DIFF_INSERTED:
+			run.Inserted++
+		}
+		if run.FirstDivergence == nil {
+			// an inserted action diverges where the original stands
+			at := diff.OriginalIndex
+			if at < 0 {
+				at = origIndex
+			}
+			run.FirstDivergence = &at
+		}
+		if len(run.Differences) >= opts.MaxDifferences {
+			run.Truncated = true
+			return nil
+		}
+		run.Differences = append(run.Differences, diff)
+		return difference(diff)
+	}
+	deleted := func() error {
+		row := orig.pop()
+		origIndex++
+		return report(ActionDiff{Kind: DIFF_DELETED, OriginalIndex: origIndex - 1, DebugIndex: -1, Original: &row})
+	}
+	inserted := func() error {
+		row := dbg.pop()
+		debugIndex++
+		run.ActionCount++
+		return report(ActionDiff{Kind: DIFF_INSERTED, OriginalIndex: -1, DebugIndex: debugIndex - 1, Debug: &row})
+	}
+
+	for {
+		if origIndex >= nextProgress {
+			if err := progress(origIndex, debugIndex); err != nil {
+				return run, err
+			}
+			nextProgress += compareProgressEvery
+		}
+
+		o, hasOrig := orig.peek(0)
+		d, hasDebug := dbg.peek(0)
+		var err error
+		switch {
+		case !hasOrig && !hasDebug:
+			run.Identical = run.Inserted == 0 && run.Deleted == 0 && run.Changed == 0
+			return run, nil
+		case !hasOrig:
+			err = inserted()
+		case !hasDebug:
+			err = deleted()
+		case opts.Diff.identity(o) == opts.Diff.identity(d):
+			orig.pop()
+			dbg.pop()
+			if fields := DiffAction(o, d, opts.Diff); len(fields) > 0 {
+				err = report(ActionDiff{Kind: DIFF_CHANGED, OriginalIndex: origIndex, DebugIndex: debugIndex, Original: &o, Debug: &d, Fields: fields})
+			}
+			origIndex++
+			debugIndex++
+			run.ActionCount++
+		default:
+			skipOrig, skipDebug, found := resync(orig, dbg, opts)
+			if !found {
+				if !counted {
+					if origTotal, debugTotal, err = totals(); err != nil {
+						return run, err
+					}
+					counted = true
+				}
+				skipOrig, skipDebug = 1, 0
+				if debugTotal-debugIndex > origTotal-origIndex {
+					skipOrig, skipDebug = 0, 1
+				}
+			}
+			for i := 0; i < skipOrig && err == nil; i++ {
+				err = deleted()
+			}
+			for i := 0; i < skipDebug && err == nil; i++ {
+				err = inserted()
+			}
+		}
+		if err != nil {
+			return run, err
+		}
+	}
+}
+
+// countCompared counts the actions of an original a debug run is compared to,
+// and those of the debug run
+func countCompared(actionLogger *ActionLogger, originalID int64, debugID int64, filter ReplayFilter) (int, int, error) {
+	origTotal := 0
+	selects := filter.selector()
+	err := actionLogger.EachMessage(originalID, func(row ActionRow) error {
+		if row.ActionType != string(AUDIT) && selects(row) {
+			origTotal++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	debugTotal, err := actionLogger.CountMessages(debugID)
+	return origTotal, debugTotal, err
+}
+
+// resync finds the nearest actions, within the window, of the original and
+// the debug run that have the same identity, and returns how many actions
+// come before them in each
+func resync(orig, dbg *lookahead, opts CompareOptions) (int, int, bool) {
+	debugAt := make(map[string]int)
+	for j := 0; j <= opts.ResyncWindow; j++ {
+		row, ok := dbg.peek(j)
+		if !ok {
+			break
+		}
+		key := opts.Diff.identity(row)
+		if _, seen := debugAt[key]; !seen {
+			debugAt[key] = j
+		}
+	}
+
+	best, bestOrig, bestDebug := -1, 0, 0
+	for i := 0; i <= opts.ResyncWindow && (best < 0 || i < best); i++ {
+		row, ok := orig.peek(i)
+		if !ok {
+			break
+		}
+		if j, found := debugAt[opts.Diff.identity(row)]; found && (best < 0 || i+j < best) {
+			best, bestOrig, bestDebug = i+j, i, j
+		}
+	}
+	return bestOrig, bestDebug, best >= 0
+}
+
+// rowSource hands out actions one by one until it returns false
+type rowSource interface {
+	next() (ActionRow, bool)
+}
+
+// lookahead buffers the actions of a source that were peeked at and not
+// popped yet
+type lookahead struct {
+	source rowSource
+	buf    []ActionRow
+	done   bool
+}
+
+func (l *lookahead) peek(i int) (ActionRow, bool) {
+	for len(l.buf) <= i && !l.done {
+		row, ok := l.source.next()
+		if !ok {
+			l.done = true
+			break
+		}
+		l.buf = append(l.buf, row)
+	}
+	if i < len(l.buf) {
+		return l.buf[i], true
+	}
+	return ActionRow{}, false
+}
+
+func (l *lookahead) pop() ActionRow {
+	row := l.buf[0]
+	l.buf = l.buf[1:]
+	return row
+}
+
+// messageGrouper reorders a source so all actions of a message follow its
+// first one, like groupByMessage. A message is held back until window more
+// actions came after its first one; an action of it arriving later starts a
+// new group.
+type messageGrouper struct {
+	source   rowSource
+	window   int
+	groups   [][]ActionRow
+	open     map[string]int
+	first    int
+	buffered int
+	out      []ActionRow
+	done     bool
+}
+
+func newMessageGrouper(source rowSource, window int) *messageGrouper {
+	return &messageGrouper{source: source, window: window, open: make(map[string]int)}
+}
+
+func (g *messageGrouper) next() (ActionRow, bool) {
+	for len(g.out) == 0 {
+		if len(g.groups) == 0 && g.done {
+			return ActionRow{}, false
+		}
+		if !g.done {
+			row, ok := g.source.next()
+			if !ok {
+				g.done = true
+				continue
+			}
+			if at, found := g.open[row.MessageID]; found {
+				g.groups[at-g.first] = append(g.groups[at-g.first], row)
+			} else {
+				g.open[row.MessageID] = len(g.groups) + g.first
+				g.groups = append(g.groups, []ActionRow{row})
+			}
+			g.buffered++
+			if g.buffered <= g.window {
+				continue
+			}
+		}
+		// release the oldest group
+		g.out = g.groups[0]
+		g.groups[0] = nil
+		g.groups = g.groups[1:]
+		g.first++
+		g.buffered -= len(g.out)
+		delete(g.open, g.out[0].MessageID)
+	}
+	row := g.out[0]
+	g.out = g.out[1:]
+	return row, true
+}
+
+// errStreamClosed stops a stream its reader closed
+var errStreamClosed = errors.New("action stream closed")
+
+// actionStream reads the actions of a replay on a goroutine, so two replays
+// can be walked in lockstep. err is set once next returned false.
+type actionStream struct {
+	rows chan ActionRow
+	stop chan struct{}
+	err  error
+}
+
+// streamActions streams the actions of a replay that keep selects
+func (fx *ActionLogger) streamActions(replayID int64, keep func(row ActionRow) bool) *actionStream {
+	stream := &actionStream{rows: make(chan ActionRow, 1024), stop: make(chan struct{})}
+	go func() {
+		defer close(stream.rows)
+		err := fx.EachMessage(replayID, func(row ActionRow) error {
+			if !keep(row) {
+				return nil
+			}
+			select {
+			case stream.rows <- row:
+				return nil
+			case <-stream.stop:
+				return errStreamClosed
+			}
+		})
+		if err != errStreamClosed {
+			stream.err = err
+		}
+	}()
+	return stream
+}
+
+func (s *actionStream) next() (ActionRow, bool) {
+	row, ok := <-s.rows
+	return row, ok
+}
+
+// close stops the stream and waits for its goroutine
+func (s *actionStream) close() {
+	close(s.stop)
+	for range s.rows {
+	}
+}
@@ -0,0 +1,112 @@
+package tunnel_system
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	benchActions = flag.Int("bench.actions", 1000000, "action rows of the replay BenchmarkCompare compares and of its rerun")
+	benchChanged = flag.Int("bench.changed", 10, "rerun exits whose payload differs")
+	benchNoise   = flag.Int("bench.noise", 1000000, "rows of an unrelated replay in the same table")
+)
+
+// BenchmarkCompare times GET /compare/{id} on a generated replay and its
+// rerun, with and without the indexes on action and replay_input.
+//
+//	go test ./tunnel_system -run '^$' -bench Compare -benchtime 3x
+func BenchmarkCompare(b *testing.B) {
+	for _, indexes := range []bool{true, false} {
+		b.Run(fmt.Sprintf("indexes=%v", indexes), func(b *testing.B) {
+			actionLogger := openSQLiteActionLogger(filepath.Join(b.TempDir(), "bench.db"))
+			defer actionLogger.Close()
+			if !indexes {
+				for _, index := range []string{"action_replay", "action_message", "replay_input_parent"} {
+					if _, err := actionLogger.db.Exec("DROP INDEX IF EXISTS " + index + ";"); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			original := seedCompareBenchmark(b, actionLogger)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				comparison, err := compareReplay(actionLogger, original, DefaultCompareOptions())
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(comparison.DebugRuns) != 1 || comparison.DebugRuns[0].Changed != *benchChanged {
+					b.Fatalf("compare found %+v, want %d changed actions", comparison.DebugRuns, *benchChanged)
+				}
+			}
+			b.ReportMetric(float64(2**benchActions*b.N)/b.Elapsed().Seconds(), "actions/s")
+		})
+	}
+}
+
+// seedCompareBenchmark writes an original replay and its rerun message by
+// message, an entry and an exit row each, with every so many rerun exits
+// changed, and the noise rows after them. It returns the original.
+func seedCompareBenchmark(b *testing.B, actionLogger *ActionLogger) Replay {
+	originalID, err := actionLogger.InsertReplay("benchmark original", "", 1, nil, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	rerunID, err := actionLogger.InsertReplay("benchmark rerun", "", 1, &originalID, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	noiseID, err := actionLogger.InsertReplay("benchmark noise", "", 1, nil, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	inBatches := func(rows int, insert func(i int)) {
+		if err := actionLogger.beginBatch(); err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < rows; i++ {
+			insert(i)
+			if i%simulationBatchSize == simulationBatchSize-1 {
+				if err := actionLogger.commitBatch(); err != nil {
+					b.Fatal(err)
+				}
+				if err := actionLogger.beginBatch(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		if err := actionLogger.commitBatch(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	messages := *benchActions / 2
+	changeEvery := 0
+	if *benchChanged > 0 {
+		changeEvery = messages / *benchChanged
+	}
+	inBatches(messages, func(i int) {
+		messageID := fmt.Sprintf("M%d", i+1)
+		in := fmt.Sprintf(`{"order":%d,"qty":1}`, i)
+		out := fmt.Sprintf(`{"order":%d,"filled":1}`, i)
+		actionLogger.InsertAction(originalID, messageID, "ORDER", "M0", string(INPUT), string(IN), in, string(INPUT), 0)
+		actionLogger.InsertAction(originalID, messageID, "ORDER", "M0", string(INPUT), string(IN), out, string(INPUT), 0)
+		if changeEvery > 0 && i%changeEvery == changeEvery-1 {
+			out = fmt.Sprintf(`{"order":%d,"filled":0}`, i)
+		}
+		actionLogger.InsertAction(rerunID, messageID, "ORDER", "M0", string(INPUT), string(IN), in, string(INPUT), 0)
+		actionLogger.InsertAction(rerunID, messageID, "ORDER", "M0", string(INPUT), string(IN), out, string(INPUT), 0)
+	})
+	inBatches(*benchNoise, func(i int) {
+		actionLogger.InsertAction(noiseID, fmt.Sprintf("N%d", i+1), string(TICK), "M0", string(INPUT), string(IN), "0", string(INPUT), 0)
+	})
+
+	original, err := actionLogger.GetReplay(originalID)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return *original
+}
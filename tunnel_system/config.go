@@ -1,18 +1,149 @@
 package tunnel_system
 
+import (
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
 // Config for TunnelSystem with optional built-in generators
 type Config struct {
 	EnableHTTP      bool
 	HTTPPort        string
 	EnableWebSocket bool
 	WebSocketPort   string
+	EnableGRPC      bool
+	GRPCPort        string
+
+	// Logger receives all engine logs; when nil a text logger on stderr is used
+	Logger *slog.Logger
+	// LogLevel is the minimum level of the default logger
+	LogLevel slog.Level
+	// LogTicks logs every engine TICK at debug level instead of dropping it
+	LogTicks bool
+
+	// Postgres, when set, keeps the action log in a PostgreSQL database
+	// instead of the local fund78db file
+	Postgres *PostgresConfig
+	// Journal, when set, keeps the action rows in an append-only journal
+	// instead of the action table of the database. Replays recorded in the
+	// table before are still read from it.
+	Journal *JournalConfig
+	// HandlerVersion names the build of the handlers in every replay this
+	// process starts, so comparisons tell which versions they put side by
+	// side. Empty means the VCS revision the binary was built from.
+	HandlerVersion string
+
+	// Retention, when set, archives and deletes old replays and compacts the
+	// TICKs of finished runs while the engine runs
+	Retention *RetentionPolicy
+
+	// Sinks deliver the visitors leaving the main entrance to the outside
+	// world, through an outbox written with their exit action. Debug reruns
+	// and simulations never reach them.
+	Sinks []SinkRoute
+
+	// IdempotencyWindow is how long an idempotency key sent with an input
+	// keeps later inputs with the same key out. Zero means
+	// DefaultIdempotencyWindow.
+	IdempotencyWindow time.Duration
+
+	// Recovery is what a start does with a normal run that never shut down.
+	// The zero value resumes it.
+	Recovery RecoveryMode
+	// SnapshotEvery is how many visitors pass between snapshots of the main
+	// run's state. Zero means DefaultSnapshotEvery.
+	SnapshotEvery int
+
+	// Simulation runs the scheduled generators on a virtual clock and returns
+	// once the simulated duration has been processed
+	Simulation *SimulationConfig
+}
+
+// SimulationConfig describes a virtual time run. Start defaults to now; use a
+// fixed Start for runs that are reproducible down to the timestamps.
+type SimulationConfig struct {
+	Start    time.Time
+	Duration time.Duration
 }
 
+// DefaultIdempotencyWindow covers client retries long after the first attempt
+const DefaultIdempotencyWindow = 24 * time.Hour
+
 func DefaultConfig() Config {
 	return Config{
 		EnableHTTP:      true,
 		HTTPPort:        ":8081",
 		EnableWebSocket: true,
 		WebSocketPort:   ":8082",
+		EnableGRPC:      false,
+		GRPCPort:        ":8083",
+		LogLevel:        slog.LevelInfo,
+		LogTicks:        false,
+
+		IdempotencyWindow: DefaultIdempotencyWindow,
+		Recovery:          RECOVERY_RESUME,
+		SnapshotEvery:     DefaultSnapshotEvery,
+	}
+}
+
+func (c Config) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: c.LogLevel}))
+}
+
+// actionLogger opens the action log with the configured backend
+func (c Config) actionLogger(logger *slog.Logger) *ActionLogger {
+	var actionLogger *ActionLogger
+	if c.Postgres != nil {
+		var err error
+		if actionLogger, err = NewPostgresActionLogger(*c.Postgres); err != nil {
+			panic("opening the postgres action log failed because: " + err.Error())
+		}
+	} else {
+		actionLogger = NewActionLogger()
+	}
+	if c.Journal != nil {
+		if err := actionLogger.UseJournal(*c.Journal, logger); err != nil {
+			panic("opening the action journal failed because: " + err.Error())
+		}
+	}
+	if c.HandlerVersion != "" {
+		actionLogger.handlerVersion = c.HandlerVersion
+	}
+	return actionLogger
+}
+
+// OpenActionLogger opens the configured action log for tools working on it
+// outside of a running engine. Close it when done.
+func OpenActionLogger(config Config) *ActionLogger {
+	return config.actionLogger(config.logger())
+}
+
+// buildHandlerVersion is the VCS revision the binary was built from, marked
+// when the tree had uncommitted changes, or "devel" when unknown
+func buildHandlerVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	revision, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if modified {
+		revision += "+dirty"
 	}
+	return revision
 }
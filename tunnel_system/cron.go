@@ -0,0 +1,365 @@
+package tunnel_system
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed five field cron expression: minute, hour, day of
+// month, month and day of week, evaluated in a time zone
+type CronSchedule struct {
+	Expr     string
+	Location *time.Location
+
+	minute     [60]bool
+	hour       [24]bool
+	dayOfMonth [32]bool
+	month      [13]bool
+	dayOfWeek  [7]bool
+	// anyDayOfMonth and anyDayOfWeek record a * in the day fields. Like
+	// cron, when both are restricted a day matching either of them fires.
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var monthNames = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+var dayNames = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+// ParseCron parses a cron expression such as "30 9 * * MON-FRI" or a macro
+// such as "@daily". A nil location means UTC.
+func ParseCron(expr string, location *time.Location) (*CronSchedule, error) {
+	if location == nil {
+		location = time.UTC
+	}
+	schedule := &CronSchedule{Expr: expr, Location: location}
+
+	spec := strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q needs 5 fields, got %d", expr, len(fields))
+	}
+
+	var err error
+	if err = parseCronField(fields[0], 0, 59, nil, schedule.minute[:]); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if err = parseCronField(fields[1], 0, 23, nil, schedule.hour[:]); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if err = parseCronField(fields[2], 1, 31, nil, schedule.dayOfMonth[:]); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if err = parseCronField(fields[3], 1, 12, monthNames, schedule.month[:]); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	// 7 is accepted for Sunday as well
+	var dayOfWeek [8]bool
+	if err = parseCronField(fields[4], 0, 7, dayNames, dayOfWeek[:]); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	copy(schedule.dayOfWeek[:], dayOfWeek[:7])
+	schedule.dayOfWeek[0] = schedule.dayOfWeek[0] || dayOfWeek[7]
+
+	schedule.anyDayOfMonth = strings.HasPrefix(fields[2], "*")
+	schedule.anyDayOfWeek = strings.HasPrefix(fields[4], "*")
+	return schedule, nil
+}
+
+// parseCronField sets the values a field allows: *, lists, ranges and steps,
+// with names counting from min
+func parseCronField(field string, min int, max int, names []string, allowed []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			n, err := strconv.Atoi(part[slash+1:])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+			part = part[:slash]
+		}
+
+		low, high := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = cronValue(bounds[0], min, names); err != nil {
+				return err
+			}
+			if high, err = cronValue(bounds[1], min, names); err != nil {
+				return err
+			}
+		default:
+			value, err := cronValue(part, min, names)
+			if err != nil {
+				return err
+			}
+			low = value
+			// "5/15" runs from 5 to the end of the range
+			if step == 1 {
+				high = value
+			}
+		}
+		if low < min || high > max || low > high {
+			return fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for value := low; value <= high; value += step {
+			allowed[value] = true
+		}
+	}
+	return nil
+}
+
+func cronValue(text string, min int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(text, name) {
+			return min + i, nil
+		}
+	}
+	value, err := strconv.Atoi(text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", text)
+	}
+	return value, nil
+}
+
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dayOfMonth[t.Day()]
+	dowMatch := s.dayOfWeek[t.Weekday()]
+	if s.anyDayOfMonth || s.anyDayOfWeek {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns the first fire time strictly after the given time, or the
+// zero time if the expression never fires (such as 30 February)
+func (s *CronSchedule) Next(after time.Time) time.Time {
+	t := after.In(s.Location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if !s.month[t.Month()] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.Location)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.Location)
+			continue
+		}
+		if !s.hour[t.Hour()] {
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.Location)
+			// A daylight saving change can map the next hour back onto this one
+			if !next.After(t) {
+				next = t.Truncate(time.Hour).Add(time.Hour)
+			}
+			t = next
+			continue
+		}
+		if !s.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+type CatchUpMode string
+
+const (
+	// CATCHUP_SKIP drops the fire times missed while the engine was down
+	CATCHUP_SKIP CatchUpMode = "skip"
+	// CATCHUP_LAST fires once for the most recent missed fire time
+	CATCHUP_LAST CatchUpMode = "last"
+	// CATCHUP_ALL fires every missed fire time, up to MaxCatchUp of them
+	CATCHUP_ALL CatchUpMode = "all"
+)
+
+// CronPayload is the payload of a cron visitor. Scheduled is the fire time
+// the schedule asked for, before jitter and however late it was delivered.
+type CronPayload struct {
+	Scheduled time.Time `json:"scheduled"`
+	CatchUp   bool      `json:"catch_up,omitempty"`
+	Data      string    `json:"data,omitempty"`
+}
+
+// CronGenerator emits a visitor for topic at every fire time of a cron
+// schedule. The last fire time is checkpointed under Name, so after downtime
+// the missed fire times are handled according to CatchUp.
+type CronGenerator struct {
+	Name     string
+	Schedule *CronSchedule
+	Topic    string
+	Data     string
+	// Jitter delays every fire by up to this much. The delay is derived from
+	// the name and fire time, so it is the same on every run.
+	Jitter     time.Duration
+	CatchUp    CatchUpMode
+	MaxCatchUp int
+
+	// scheduled is the fire time the virtual scheduler is about to deliver
+	scheduled time.Time
+
+	generatorControl
+}
+
+func NewCronGenerator(name string, expr string, location *time.Location, topic string) (*CronGenerator, error) {
+	schedule, err := ParseCron(expr, location)
+	if err != nil {
+		return nil, err
+	}
+	return &CronGenerator{
+		Name:       name,
+		Schedule:   schedule,
+		Topic:      topic,
+		CatchUp:    CATCHUP_SKIP,
+		MaxCatchUp: 100,
+	}, nil
+}
+
+func (g *CronGenerator) Start(ts *TunnelSystem) {
+	actionLogger := ts.mainEntrance.actionLogger
+	logger := ts.logger.With("component", "cron", "generator", g.Name)
+
+	now := ts.clock.Now()
+	last := now
+	if g.Name != "" {
+		checkpoint, found, err := actionLogger.GetCheckpoint(g.checkpointName())
+		if err != nil {
+			logger.Error("reading cron checkpoint failed", "error", err)
+		} else if found {
+			if last, err = time.Parse(time.RFC3339Nano, checkpoint); err != nil {
+				logger.Error("invalid cron checkpoint, skipping catch-up", "checkpoint", checkpoint, "error", err)
+				last = now
+			}
+		}
+	}
+
+	// A fire while paused is dropped, but still checkpointed so it is not
+	// caught up on after a restart
+	emit := func(scheduled time.Time, catchUp bool) {
+		if !g.isPaused() {
+			v := NewInputAction(ActionName(g.Topic), g.payload(scheduled, catchUp))
+			ts.mainEntrance.Enter(v)
+			g.countEmit()
+			engineMetrics.generatorEmits.Inc("cron", g.Topic)
+		}
+		if g.Name != "" {
+			if err := actionLogger.SaveCheckpoint(g.checkpointName(), scheduled.UTC().Format(time.RFC3339Nano)); err != nil {
+				logger.Error("saving cron checkpoint failed", "error", err)
+			}
+		}
+	}
+
+	missed := g.missed(last, now)
+	go func() {
+		for _, scheduled := range missed {
+			emit(scheduled, true)
+		}
+		if len(missed) > 0 {
+			logger.Info("caught up on missed cron fires", "fires", len(missed), "mode", g.CatchUp)
+		}
+
+		scheduled := now
+		for {
+			scheduled = g.Schedule.Next(scheduled)
+			if scheduled.IsZero() {
+				logger.Warn("cron schedule never fires again", "expr", g.Schedule.Expr)
+				return
+			}
+			fireAt := scheduled.Add(g.jitter(scheduled))
+			for time.Now().Before(fireAt) {
+				if !g.wait(time.Until(fireAt)) {
+					logger.Info("cron generator stopped")
+					return
+				}
+			}
+			emit(scheduled, false)
+		}
+	}()
+	logger.Info("started cron generator", "expr", g.Schedule.Expr, "location", g.Schedule.Location.String(), "topic", g.Topic)
+}
+
+// missed lists the fire times between the last checkpoint and now that the
+// catch-up mode wants delivered
+func (g *CronGenerator) missed(last time.Time, now time.Time) []time.Time {
+	if g.CatchUp == CATCHUP_SKIP || g.CatchUp == "" {
+		return nil
+	}
+	missed := make([]time.Time, 0)
+	for scheduled := g.Schedule.Next(last); !scheduled.IsZero() && !scheduled.After(now); scheduled = g.Schedule.Next(scheduled) {
+		missed = append(missed, scheduled)
+		if g.CatchUp == CATCHUP_ALL && g.MaxCatchUp > 0 && len(missed) > g.MaxCatchUp {
+			missed = missed[1:]
+		}
+	}
+	if g.CatchUp == CATCHUP_LAST && len(missed) > 1 {
+		missed = missed[len(missed)-1:]
+	}
+	return missed
+}
+
+func (g *CronGenerator) payload(scheduled time.Time, catchUp bool) string {
+	payload, err := json.Marshal(CronPayload{
+		Scheduled: scheduled.In(g.Schedule.Location),
+		CatchUp:   catchUp,
+		Data:      g.Data,
+	})
+	if err != nil {
+		panic("encoding cron payload failed because: " + err.Error())
+	}
+	return string(payload)
+}
+
+func (g *CronGenerator) jitter(scheduled time.Time) time.Duration {
+	if g.Jitter <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s/%d", g.Name, scheduled.UnixNano())
+	return time.Duration(h.Sum64() % uint64(g.Jitter))
+}
+
+func (g *CronGenerator) checkpointName() string {
+	return "cron:" + g.Name
+}
+
+func (g *CronGenerator) firstFire(start time.Time) time.Time {
+	g.scheduled = g.Schedule.Next(start.Add(-time.Nanosecond))
+	if g.scheduled.IsZero() {
+		return time.Time{}
+	}
+	return g.scheduled.Add(g.jitter(g.scheduled))
+}
+
+func (g *CronGenerator) nextFire(last time.Time) time.Time {
+	g.scheduled = g.Schedule.Next(g.scheduled)
+	if g.scheduled.IsZero() {
+		return time.Time{}
+	}
+	return g.scheduled.Add(g.jitter(g.scheduled))
+}
+
+func (g *CronGenerator) inputAt(at time.Time) VisitorInput {
+	return VisitorInput{Topic: g.Topic, Payload: g.payload(g.scheduled, false)}
+}
@@ -0,0 +1,398 @@
+package tunnel_system
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Breakpoint pauses a debug rerun before a matching visitor is handled.
+// Every non-empty field must match; a breakpoint without a replay ID applies
+// to every debug rerun.
+type Breakpoint struct {
+	ID        int               `json:"id"`
+	ReplayID  int64             `json:"replay_id,omitempty"`
+	MessageID string            `json:"message_id,omitempty"`
+	Topic     string            `json:"topic,omitempty"`
+	Payload   *PayloadPredicate `json:"payload,omitempty"`
+}
+
+func (b Breakpoint) matches(v *Visitor) bool {
+	if b.ReplayID != 0 && b.ReplayID != v.ReplayId {
+		return false
+	}
+	if b.MessageID != "" && b.MessageID != v.MessageId {
+		return false
+	}
+	if b.Topic != "" && b.Topic != string(v.ActionName) {
+		return false
+	}
+	if b.Payload != nil && !b.Payload.Match(v.Payload) {
+		return false
+	}
+	return true
+}
+
+// Debugger gates the debug reruns on the side entrance so each can be
+// paused, stepped one visitor at a time or run until a breakpoint is hit.
+// Every debug rerun has a session of its own: pausing one leaves the other
+// reruns running.
+type Debugger struct {
+	mu               sync.Mutex
+	cond             *sync.Cond
+	sessions         map[int64]*debugSession
+	breakpoints      []Breakpoint
+	nextBreakpointID int
+}
+
+// debugSession is where the debugger stands in one debug rerun
+type debugSession struct {
+	paused   bool
+	steps    int
+	hit      *Breakpoint
+	current  *Visitor
+	last     *Visitor
+	position int
+}
+
+// DebuggerStatus is a snapshot of a debug session returned by the HTTP API
+type DebuggerStatus struct {
+	ReplayID    int64        `json:"replay_id"`
+	Paused      bool         `json:"paused"`
+	Position    int          `json:"position"`
+	Current     *Visitor     `json:"current,omitempty"`
+	Last        *Visitor     `json:"last,omitempty"`
+	Hit         *Breakpoint  `json:"hit,omitempty"`
+	Breakpoints []Breakpoint `json:"breakpoints"`
+	State       *State       `json:"state,omitempty"`
+}
+
+func NewDebugger() *Debugger {
+	d := &Debugger{sessions: make(map[int64]*debugSession), nextBreakpointID: 1}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+// start opens a session for a debug rerun, paused before its first visitor
+func (d *Debugger) start(replayID int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sessions[replayID] = &debugSession{paused: true}
+}
+
+// end closes the session of a debug rerun that got through its visitors
+func (d *Debugger) end(replayID int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.sessions, replayID)
+}
+
+// debugging reports whether a replay runs under a debug session
+func (d *Debugger) debugging(replayID int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.sessions[replayID]
+	return ok
+}
+
+// await blocks a debug rerun until v is allowed to be handled
+func (d *Debugger) await(v *Visitor) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	session, ok := d.sessions[v.ReplayId]
+	if !ok {
+		return
+	}
+
+	session.current = v
+	for i := range d.breakpoints {
+		if d.breakpoints[i].matches(v) {
+			bp := d.breakpoints[i]
+			session.hit = &bp
+			if !session.paused {
+				session.paused = true
+				session.steps = 0
+			}
+			break
+		}
+	}
+
+	for session.paused && session.steps == 0 {
+		d.cond.Wait()
+	}
+	if session.paused {
+		session.steps--
+	}
+}
+
+// handled records that v made it through the side entrance
+func (d *Debugger) handled(v *Visitor) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if session, ok := d.sessions[v.ReplayId]; ok {
+		session.current = nil
+		session.last = v
+		session.position++
+	}
+}
+
+// control applies fn to the session of a debug rerun and wakes the reruns
+// waiting for their sessions to change
+func (d *Debugger) control(replayID int64, fn func(session *debugSession)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	session, ok := d.sessions[replayID]
+	if !ok {
+		return fmt.Errorf("replay %d is not a running debug rerun", replayID)
+	}
+	fn(session)
+	d.cond.Broadcast()
+	return nil
+}
+
+func (d *Debugger) Pause(replayID int64) error {
+	return d.control(replayID, func(session *debugSession) {
+		session.paused = true
+		session.steps = 0
+	})
+}
+
+// Resume runs a debug rerun until the next breakpoint
+func (d *Debugger) Resume(replayID int64) error {
+	return d.control(replayID, func(session *debugSession) {
+		session.paused = false
+		session.steps = 0
+		session.hit = nil
+	})
+}
+
+// Step lets count visitors of a debug rerun through while staying paused
+func (d *Debugger) Step(replayID int64, count int) error {
+	return d.control(replayID, func(session *debugSession) {
+		if session.paused {
+			session.steps += count
+			session.hit = nil
+		}
+	})
+}
+
+func (d *Debugger) AddBreakpoint(bp Breakpoint) Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	bp.ID = d.nextBreakpointID
+	d.nextBreakpointID++
+	d.breakpoints = append(d.breakpoints, bp)
+	return bp
+}
+
+func (d *Debugger) RemoveBreakpoint(id int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, bp := range d.breakpoints {
+		if bp.ID == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Debugger) Breakpoints() []Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append(make([]Breakpoint, 0, len(d.breakpoints)), d.breakpoints...)
+}
+
+// Status returns the session of a debug rerun, with the breakpoints that
+// apply to it
+func (d *Debugger) Status(replayID int64) (DebuggerStatus, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	session, ok := d.sessions[replayID]
+	if !ok {
+		return DebuggerStatus{}, false
+	}
+	return d.status(replayID, session), true
+}
+
+// Sessions returns every running debug session, oldest rerun first
+func (d *Debugger) Sessions() []DebuggerStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	statuses := make([]DebuggerStatus, 0, len(d.sessions))
+	for replayID, session := range d.sessions {
+		statuses = append(statuses, d.status(replayID, session))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ReplayID < statuses[j].ReplayID })
+	return statuses
+}
+
+func (d *Debugger) status(replayID int64, session *debugSession) DebuggerStatus {
+	breakpoints := make([]Breakpoint, 0, len(d.breakpoints))
+	for _, bp := range d.breakpoints {
+		if bp.ReplayID == 0 || bp.ReplayID == replayID {
+			breakpoints = append(breakpoints, bp)
+		}
+	}
+	return DebuggerStatus{
+		ReplayID:    replayID,
+		Paused:      session.paused,
+		Position:    session.position,
+		Current:     session.current,
+		Last:        session.last,
+		Hit:         session.hit,
+		Breakpoints: breakpoints,
+	}
+}
+
+func (s *server) registerDebuggerRoutes() {
+	http.HandleFunc("/debug", s.handleDebugStatus)
+	http.HandleFunc("/debug/pause", s.handleDebugPause)
+	http.HandleFunc("/debug/resume", s.handleDebugResume)
+	http.HandleFunc("/debug/step", s.handleDebugStep)
+	http.HandleFunc("/debug/state", s.handleDebugState)
+	http.HandleFunc("/debug/breakpoints", s.handleDebugBreakpoints)
+	http.HandleFunc("/debug/breakpoints/", s.handleDebugBreakpoint)
+}
+
+// handleDebugStatus returns the session of a debug rerun, or every session
+// when no replay is given
+func (s *server) handleDebugStatus(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("replay") == "" {
+		writeJSON(w, s.tunnelSystem.debugger.Sessions())
+		return
+	}
+	replayID, err := s.debugReplay(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.writeDebugStatus(w, replayID)
+}
+
+func (s *server) handleDebugPause(w http.ResponseWriter, r *http.Request) {
+	s.controlDebugger(w, r, s.tunnelSystem.debugger.Pause)
+}
+
+func (s *server) handleDebugResume(w http.ResponseWriter, r *http.Request) {
+	s.controlDebugger(w, r, s.tunnelSystem.debugger.Resume)
+}
+
+func (s *server) handleDebugStep(w http.ResponseWriter, r *http.Request) {
+	count := 1
+	if value := r.URL.Query().Get("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid count. Use /debug/step?count={n}", http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+	s.controlDebugger(w, r, func(replayID int64) error {
+		return s.tunnelSystem.debugger.Step(replayID, count)
+	})
+}
+
+func (s *server) controlDebugger(w http.ResponseWriter, r *http.Request, apply func(replayID int64) error) {
+	replayID, err := s.debugReplay(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = apply(replayID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.writeDebugStatus(w, replayID)
+}
+
+// debugReplay is the debug rerun a debugger request is about: the one its
+// replay parameter names, or the only one running
+func (s *server) debugReplay(r *http.Request) (int64, error) {
+	if value := r.URL.Query().Get("replay"); value != "" {
+		replayID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid replay ID %q", value)
+		}
+		return replayID, nil
+	}
+	sessions := s.tunnelSystem.debugger.Sessions()
+	if len(sessions) != 1 {
+		return 0, fmt.Errorf("%d debug reruns are running, choose one with ?replay={id}", len(sessions))
+	}
+	return sessions[0].ReplayID, nil
+}
+
+// handleDebugState returns the application state of a debug replay with its
+// session, if it is still running
+func (s *server) handleDebugState(w http.ResponseWriter, r *http.Request) {
+	replayID, err := s.debugReplay(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status, ok := s.tunnelSystem.debugger.Status(replayID)
+	if !ok {
+		status = DebuggerStatus{ReplayID: replayID, Breakpoints: make([]Breakpoint, 0)}
+	}
+	status.State = s.tunnelSystem.sideEntrance.State(replayID)
+	writeJSON(w, status)
+}
+
+func (s *server) handleDebugBreakpoints(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.tunnelSystem.debugger.Breakpoints())
+	case http.MethodPost:
+		var bp Breakpoint
+		if err := json.NewDecoder(r.Body).Decode(&bp); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if bp.MessageID == "" && bp.Topic == "" && bp.Payload == nil {
+			http.Error(w, "Breakpoint needs a message_id, topic or payload predicate", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, s.tunnelSystem.debugger.AddBreakpoint(bp))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) handleDebugBreakpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var id int
+	_, err := fmt.Sscanf(r.URL.Path, "/debug/breakpoints/%d", &id)
+	if err != nil {
+		http.Error(w, "Invalid breakpoint ID. Use /debug/breakpoints/{id}", http.StatusBadRequest)
+		return
+	}
+	if !s.tunnelSystem.debugger.RemoveBreakpoint(id) {
+		http.Error(w, fmt.Sprintf("Breakpoint %d not found", id), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s.tunnelSystem.debugger.Breakpoints())
+}
+
+func (s *server) writeDebugStatus(w http.ResponseWriter, replayID int64) {
+	status, ok := s.tunnelSystem.debugger.Status(replayID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Replay %d is not a running debug rerun", replayID), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, status)
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,167 @@
+package tunnel_system
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// dialect adapts the SQL of the action logger, written for SQLite, to the
+// database it runs on
+type dialect struct {
+	name string
+	// rebind rewrites a statement for the database
+	rebind func(sqlText string) string
+	// returningID is appended to an insert to return the new row's ID, for
+	// databases without LastInsertId
+	returningID string
+}
+
+var sqliteDialect = dialect{
+	name:   "sqlite3",
+	rebind: func(sqlText string) string { return sqlText },
+}
+
+var postgresDialect = dialect{
+	name:        "postgres",
+	rebind:      rebindPostgres,
+	returningID: " RETURNING id",
+}
+
+// rebindPostgres numbers the placeholders and replaces the SQLite functions
+// and clauses the action logger uses
+func rebindPostgres(sqlText string) string {
+	sqlText = strings.ReplaceAll(sqlText, "strftime('%s','now')", "CAST(EXTRACT(EPOCH FROM now()) AS BIGINT)")
+	if strings.HasPrefix(sqlText, "INSERT OR IGNORE INTO ") {
+		sqlText = "INSERT INTO " + strings.TrimSuffix(strings.TrimPrefix(sqlText, "INSERT OR IGNORE INTO "), ";") + " ON CONFLICT DO NOTHING;"
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range sqlText {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (fx *ActionLogger) rebind(sqlText string) string {
+	return fx.dialect.rebind(sqlText)
+}
+
+// stmt returns the prepared statement for sqlText, preparing it on first use
+func (fx *ActionLogger) stmt(sqlText string) (*sql.Stmt, error) {
+	fx.stmtsMu.Lock()
+	defer fx.stmtsMu.Unlock()
+	if stmt, ok := fx.stmts[sqlText]; ok {
+		return stmt, nil
+	}
+	stmt, err := fx.db.Prepare(fx.rebind(sqlText))
+	if err != nil {
+		return nil, err
+	}
+	if fx.stmts == nil {
+		fx.stmts = make(map[string]*sql.Stmt)
+	}
+	fx.stmts[sqlText] = stmt
+	return stmt, nil
+}
+
+func (fx *ActionLogger) query(sqlText string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := fx.stmt(sqlText)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Query(args...)
+}
+
+func (fx *ActionLogger) queryRow(sqlText string, args ...interface{}) *sql.Row {
+	stmt, err := fx.stmt(sqlText)
+	if err != nil {
+		// the unprepared statement fails the same way, in the Row
+		return fx.db.QueryRow(fx.rebind(sqlText), args...)
+	}
+	return stmt.QueryRow(args...)
+}
+
+func (fx *ActionLogger) txExec(tx *sql.Tx, sqlText string, args ...interface{}) (sql.Result, error) {
+	stmt, err := fx.stmt(sqlText)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Stmt(stmt).Exec(args...)
+}
+
+func (fx *ActionLogger) txQuery(tx *sql.Tx, sqlText string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := fx.stmt(sqlText)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Stmt(stmt).Query(args...)
+}
+
+func (fx *ActionLogger) txQueryRow(tx *sql.Tx, sqlText string, args ...interface{}) *sql.Row {
+	stmt, err := fx.stmt(sqlText)
+	if err != nil {
+		return tx.QueryRow(fx.rebind(sqlText), args...)
+	}
+	return tx.Stmt(stmt).QueryRow(args...)
+}
+
+// insertID runs an insert outside any batch and returns the new row's ID
+func (fx *ActionLogger) insertID(sqlText string, args ...interface{}) (int64, error) {
+	if fx.dialect.returningID == "" {
+		stmt, err := fx.stmt(sqlText)
+		if err != nil {
+			return 0, err
+		}
+		result, err := stmt.Exec(args...)
+		if err != nil {
+			return 0, err
+		}
+		return result.LastInsertId()
+	}
+	var id int64
+	sqlText = strings.TrimSuffix(sqlText, ";") + fx.dialect.returningID + ";"
+	err := fx.queryRow(sqlText, args...).Scan(&id)
+	return id, err
+}
+
+// deleteInChunk keeps the number of placeholders of a statement below the
+// limits of both databases
+const deleteInChunk = 500
+
+// deleteIn runs sqlTextFormat, a statement with one "IN (%s)", for ids in
+// chunks in tx and returns the number of rows it deleted
+func (fx *ActionLogger) deleteIn(tx *sql.Tx, sqlTextFormat string, ids []int64) (int64, error) {
+	var deleted int64
+	for len(ids) > 0 {
+		chunk := ids
+		if len(chunk) > deleteInChunk {
+			chunk = chunk[:deleteInChunk]
+		}
+		ids = ids[len(chunk):]
+
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+		sqlText := fmt.Sprintf(sqlTextFormat, strings.TrimSuffix(strings.Repeat("?, ", len(chunk)), ", "))
+		// the statements vary with the number of IDs, so they are not cached
+		result, err := tx.Exec(fx.rebind(sqlText), args...)
+		if err != nil {
+			return deleted, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
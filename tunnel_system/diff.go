@@ -0,0 +1,394 @@
+package tunnel_system
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type DiffKind string
+
+const (
+	DIFF_INSERTED DiffKind = "inserted"
+	DIFF_DELETED  DiffKind = "deleted"
+	DIFF_CHANGED  DiffKind = "changed"
+)
+
+// DiffOptions controls which fields take part in a comparison.
+// IgnoreFields holds action fields (message_id, topic, caused_by, message_type,
+// direction, action_type, virtual_time, created_at) or payload paths such as "payload.timestamp".
+// Ignoring a path also ignores everything below it.
+type DiffOptions struct {
+	IgnoreFields []string
+	// GroupByMessage compares the actions of each message together, in order of
+	// first appearance, so entries racing ahead of exits in the queue do not
+	// count as differences
+	GroupByMessage bool
+}
+
+// FieldDiff is a single field that differs between two aligned actions
+type FieldDiff struct {
+	Path     string `json:"path"`
+	Original string `json:"original"`
+	Debug    string `json:"debug"`
+}
+
+// ActionDiff describes one inserted, deleted or changed action.
+// Indexes are positions in the compared sequences (after grouping by message),
+// -1 when absent; the rows themselves carry their action log IDs.
+type ActionDiff struct {
+	Kind          DiffKind    `json:"kind"`
+	OriginalIndex int         `json:"original_index"`
+	DebugIndex    int         `json:"debug_index"`
+	Original      *ActionRow  `json:"original,omitempty"`
+	Debug         *ActionRow  `json:"debug,omitempty"`
+	Fields        []FieldDiff `json:"fields,omitempty"`
+}
+
+// DiffResult is the structured outcome of comparing two action sequences
+type DiffResult struct {
+	Identical bool         `json:"identical"`
+	Inserted  int          `json:"inserted"`
+	Deleted   int          `json:"deleted"`
+	Changed   int          `json:"changed"`
+	Diffs     []ActionDiff `json:"diffs,omitempty"`
+}
+
+func DefaultDiffOptions() DiffOptions {
+	return DiffOptions{
+		IgnoreFields: []string{"created_at"},
+	}
+}
+
+// ParseIgnoreFields splits a comma separated list of ignore rules
+func ParseIgnoreFields(value string) []string {
+	fields := make([]string, 0)
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+func (o DiffOptions) ignores(path string) bool {
+	for _, rule := range o.IgnoreFields {
+		if path == rule || strings.HasPrefix(path, rule+".") || strings.HasPrefix(path, rule+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+// DiffActions aligns the two sequences on their identity (message ID, topic,
+// direction and type, minus any ignored field) and reports the actions that
+// were inserted into, deleted from or changed in the debug sequence.
+func DiffActions(original, debug []ActionRow, opts DiffOptions) DiffResult {
+	if opts.GroupByMessage {
+		original = groupByMessage(original)
+		debug = groupByMessage(debug)
+	}
+
+	origKeys := make([]string, len(original))
+	for i, row := range original {
+		origKeys[i] = opts.identity(row)
+	}
+	debugKeys := make([]string, len(debug))
+	for i, row := range debug {
+		debugKeys[i] = opts.identity(row)
+	}
+
+	result := DiffResult{Diffs: make([]ActionDiff, 0)}
+	for _, op := range alignSequences(origKeys, debugKeys) {
+		switch {
+		case op.origIndex >= 0 && op.debugIndex >= 0:
+			fields := DiffAction(original[op.origIndex], debug[op.debugIndex], opts)
+			if len(fields) == 0 {
+				continue
+			}
+			result.Changed++
+			result.Diffs = append(result.Diffs, ActionDiff{
+				Kind:          DIFF_CHANGED,
+				OriginalIndex: op.origIndex,
+				DebugIndex:    op.debugIndex,
+				Original:      &original[op.origIndex],
+				Debug:         &debug[op.debugIndex],
+				Fields:        fields,
+			})
+		case op.origIndex >= 0:
+			result.Deleted++
+			result.Diffs = append(result.Diffs, ActionDiff{
+				Kind:          DIFF_DELETED,
+				OriginalIndex: op.origIndex,
+				DebugIndex:    -1,
+				Original:      &original[op.origIndex],
+			})
+		default:
+			result.Inserted++
+			result.Diffs = append(result.Diffs, ActionDiff{
+				Kind:          DIFF_INSERTED,
+				OriginalIndex: -1,
+				DebugIndex:    op.debugIndex,
+				Debug:         &debug[op.debugIndex],
+			})
+		}
+	}
+
+	result.Identical = len(result.Diffs) == 0
+	return result
+}
+
+// groupByMessage reorders actions so all actions of a message follow its first one
+func groupByMessage(rows []ActionRow) []ActionRow {
+	order := make([]string, 0)
+	groups := make(map[string][]ActionRow)
+	for _, row := range rows {
+		if _, ok := groups[row.MessageID]; !ok {
+			order = append(order, row.MessageID)
+		}
+		groups[row.MessageID] = append(groups[row.MessageID], row)
+	}
+
+	grouped := make([]ActionRow, 0, len(rows))
+	for _, id := range order {
+		grouped = append(grouped, groups[id]...)
+	}
+	return grouped
+}
+
+// DiffAction compares two actions field by field, descending into JSON payloads
+func DiffAction(orig, dbg ActionRow, opts DiffOptions) []FieldDiff {
+	differences := make([]FieldDiff, 0)
+
+	fields := []struct {
+		path        string
+		orig, debug string
+	}{
+		{"message_id", orig.MessageID, dbg.MessageID},
+		{"topic", orig.Topic, dbg.Topic},
+		{"caused_by", orig.CausedBy, dbg.CausedBy},
+		{"message_type", orig.MessageType, dbg.MessageType},
+		{"direction", orig.Direction, dbg.Direction},
+		{"action_type", orig.ActionType, dbg.ActionType},
+		{"virtual_time", strconv.FormatInt(orig.VirtualTime, 10), strconv.FormatInt(dbg.VirtualTime, 10)},
+		{"created_at", strconv.FormatInt(orig.CreatedAt, 10), strconv.FormatInt(dbg.CreatedAt, 10)},
+	}
+	for _, f := range fields {
+		if f.orig != f.debug && !opts.ignores(f.path) {
+			differences = append(differences, FieldDiff{Path: f.path, Original: f.orig, Debug: f.debug})
+		}
+	}
+
+	if opts.ignores("payload") || orig.Payload == dbg.Payload {
+		return differences
+	}
+
+	var origValue, debugValue interface{}
+	if json.Unmarshal([]byte(orig.Payload), &origValue) != nil || json.Unmarshal([]byte(dbg.Payload), &debugValue) != nil {
+		return append(differences, FieldDiff{Path: "payload", Original: orig.Payload, Debug: dbg.Payload})
+	}
+	return diffJSON("payload", origValue, debugValue, opts, differences)
+}
+
+func (o DiffOptions) identity(row ActionRow) string {
+	parts := make([]string, 0, 4)
+	for _, f := range []struct{ path, value string }{
+		{"message_id", row.MessageID},
+		{"topic", row.Topic},
+		{"direction", row.Direction},
+		{"message_type", row.MessageType},
+	} {
+		if !o.ignores(f.path) {
+			parts = append(parts, f.value)
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
+
+func diffJSON(path string, orig, dbg interface{}, opts DiffOptions, differences []FieldDiff) []FieldDiff {
+	if opts.ignores(path) {
+		return differences
+	}
+
+	switch o := orig.(type) {
+	case map[string]interface{}:
+		d, ok := dbg.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(o)+len(d))
+		for k := range o {
+			keys = append(keys, k)
+		}
+		for k := range d {
+			if _, found := o[k]; !found {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ov, inOrig := o[k]
+			dv, inDebug := d[k]
+			childPath := path + "." + k
+			switch {
+			case !inOrig:
+				if !opts.ignores(childPath) {
+					differences = append(differences, FieldDiff{Path: childPath, Debug: jsonText(dv)})
+				}
+			case !inDebug:
+				if !opts.ignores(childPath) {
+					differences = append(differences, FieldDiff{Path: childPath, Original: jsonText(ov)})
+				}
+			default:
+				differences = diffJSON(childPath, ov, dv, opts, differences)
+			}
+		}
+		return differences
+	case []interface{}:
+		d, ok := dbg.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(o) || i < len(d); i++ {
+			childPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(o):
+				if !opts.ignores(childPath) {
+					differences = append(differences, FieldDiff{Path: childPath, Debug: jsonText(d[i])})
+				}
+			case i >= len(d):
+				if !opts.ignores(childPath) {
+					differences = append(differences, FieldDiff{Path: childPath, Original: jsonText(o[i])})
+				}
+			default:
+				differences = diffJSON(childPath, o[i], d[i], opts, differences)
+			}
+		}
+		return differences
+	}
+
+	origText, debugText := jsonText(orig), jsonText(dbg)
+	if origText != debugText {
+		differences = append(differences, FieldDiff{Path: path, Original: origText, Debug: debugText})
+	}
+	return differences
+}
+
+func jsonText(value interface{}) string {
+	val, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(val)
+}
+
+// alignOp pairs an original index with a debug index; -1 marks a gap
+type alignOp struct {
+	origIndex  int
+	debugIndex int
+}
+
+// alignSequences computes a shortest edit script between a and b using
+// Myers' algorithm, so a single missing action does not shift every later one.
+// It takes the linear space variant: the script is split at a middle snake
+// and both halves are aligned on their own, so memory stays O(N+M) however
+// far the sequences diverge.
+func alignSequences(a, b []string) []alignOp {
+	ops := make([]alignOp, 0, len(a)+len(b))
+	return alignRange(a, b, 0, len(a), 0, len(b), ops)
+}
+
+// alignRange appends the edit script between a[aLo:aHi] and b[bLo:bHi]
+func alignRange(a, b []string, aLo, aHi, bLo, bHi int, ops []alignOp) []alignOp {
+	for aLo < aHi && bLo < bHi && a[aLo] == b[bLo] {
+		ops = append(ops, alignOp{origIndex: aLo, debugIndex: bLo})
+		aLo++
+		bLo++
+	}
+	common := 0
+	for aLo < aHi && bLo < bHi && a[aHi-1] == b[bHi-1] {
+		aHi--
+		bHi--
+		common++
+	}
+
+	switch {
+	case aLo == aHi:
+		for j := bLo; j < bHi; j++ {
+			ops = append(ops, alignOp{origIndex: -1, debugIndex: j})
+		}
+	case bLo == bHi:
+		for i := aLo; i < aHi; i++ {
+			ops = append(ops, alignOp{origIndex: i, debugIndex: -1})
+		}
+	default:
+		x, y, u, v := middleSnake(a[aLo:aHi], b[bLo:bHi])
+		ops = alignRange(a, b, aLo, aLo+x, bLo, bLo+y, ops)
+		for i := 0; i < u-x; i++ {
+			ops = append(ops, alignOp{origIndex: aLo + x + i, debugIndex: bLo + y + i})
+		}
+		ops = alignRange(a, b, aLo+u, aHi, bLo+v, bHi, ops)
+	}
+
+	for i := 0; i < common; i++ {
+		ops = append(ops, alignOp{origIndex: aHi + i, debugIndex: bHi + i})
+	}
+	return ops
+}
+
+// middleSnake finds the diagonal run in the middle of a shortest edit script
+// between a and b, searching from both ends at once. It returns where the run
+// starts, x in a and y in b, and where it ends, u and v.
+func middleSnake(a, b []string) (x, y, u, v int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	max := (n + m + 1) / 2
+	offset := max + 1
+	forward := make([]int, 2*max+3)
+	backward := make([]int, 2*max+3)
+
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && a[u] == b[v] {
+				u++
+				v++
+			}
+			forward[offset+k] = u
+			// the backward search is a step behind, on its diagonal delta-k
+			if delta%2 != 0 && delta-k >= -(d-1) && delta-k <= d-1 && u+backward[offset+delta-k] >= n {
+				return x, y, u, v
+			}
+		}
+
+		// backward distances count from the ends of a and b
+		for k := -d; k <= d; k += 2 {
+			var bx int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				bx = backward[offset+k+1]
+			} else {
+				bx = backward[offset+k-1] + 1
+			}
+			by := bx - k
+			bu, bv := bx, by
+			for bu < n && bv < m && a[n-1-bu] == b[m-1-bv] {
+				bu++
+				bv++
+			}
+			backward[offset+k] = bu
+			if delta%2 == 0 && delta-k >= -d && delta-k <= d && bu+forward[offset+delta-k] >= n {
+				return n - bu, m - bv, n - bx, m - by
+			}
+		}
+	}
+	panic("no middle snake between sequences that differ")
+}
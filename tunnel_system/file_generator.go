@@ -0,0 +1,223 @@
+package tunnel_system
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileLineError is what the error file records about a malformed line
+type fileLineError struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+	Line   string `json:"line"`
+	Error  string `json:"error"`
+}
+
+// NewFileInputGenerator tails a JSONL file, or watches a directory for .jsonl
+// files, entering every line as a VisitorInput. The byte offset reached in
+// each file is checkpointed with every line, in the transaction that logs the
+// line's action, so a restart picks up where the last run stopped. Malformed
+// lines are appended to errorPath, which defaults to path + ".errors".
+func NewFileInputGenerator(name string, path string, errorPath string, pollInterval time.Duration) *ConnectionGenerator {
+	if errorPath == "" {
+		errorPath = filepath.Clean(path) + ".errors"
+	}
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+
+	var gen *ConnectionGenerator
+	gen = NewConnectionInputGenerator(func(t *Tunnel) {
+		tail := &fileTail{
+			name:      name,
+			errorPath: errorPath,
+			tunnel:    t,
+			control:   gen.control(),
+			logger:    t.logger.With("component", "file", "generator", name),
+		}
+		tail.logger.Info("watching for JSONL input", "path", path, "errors", errorPath, "poll", pollInterval)
+
+		for gen.wait(pollInterval) {
+			if gen.isPaused() {
+				continue
+			}
+			files, err := jsonlFiles(path, errorPath)
+			if err != nil {
+				tail.logger.Warn("listing input files failed", "error", err)
+				continue
+			}
+			for _, file := range files {
+				if err = tail.read(file); err != nil {
+					tail.logger.Error("reading input file failed", "file", file, "error", err)
+				}
+			}
+		}
+	})
+	gen.Name = name
+	return gen
+}
+
+// jsonlFiles lists the files to read: path itself, or the .jsonl files of a
+// directory in name order
+func jsonlFiles(path string, errorPath string) ([]string, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		file := filepath.Join(path, entry.Name())
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".jsonl") || file == filepath.Clean(errorPath) {
+			continue
+		}
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+type fileTail struct {
+	name      string
+	errorPath string
+	tunnel    *Tunnel
+	control   *generatorControl
+	logger    *slog.Logger
+}
+
+func (f *fileTail) checkpointName(file string) string {
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	return "file:" + f.name + ":" + file
+}
+
+// read enters the complete lines added to a file since its checkpoint. A
+// last line without a newline is still being written and waits for the
+// next poll.
+func (f *fileTail) read(file string) error {
+	actionLogger := f.tunnel.actionLogger
+	checkpoint := f.checkpointName(file)
+
+	var offset int64
+	value, found, err := actionLogger.GetCheckpoint(checkpoint)
+	if err != nil {
+		return err
+	}
+	if found {
+		if offset, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("invalid checkpoint %q: %w", value, err)
+		}
+	}
+
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < offset {
+		f.logger.Warn("input file shrank, reading it from the start", "file", file, "size", info.Size(), "checkpoint", offset)
+		offset = 0
+	}
+	if info.Size() == offset {
+		return nil
+	}
+	if _, err = in.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(in)
+	for !f.control.isPaused() {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		next := strconv.FormatInt(offset+int64(len(line)), 10)
+		entered, err := f.enter(file, offset, bytes.TrimSpace(line), checkpoint, next)
+		if err != nil {
+			return err
+		}
+		if !entered {
+			if err = actionLogger.SaveCheckpoint(checkpoint, next); err != nil {
+				return err
+			}
+		}
+		offset += int64(len(line))
+	}
+	return nil
+}
+
+// enter enters a line, moving the checkpoint to next along with it, and
+// reports whether it did. Blank and rejected lines leave the checkpoint to
+// the caller, unless the rejected line could not be kept in the error file.
+func (f *fileTail) enter(file string, offset int64, line []byte, checkpoint string, next string) (bool, error) {
+	if len(line) == 0 {
+		return false, nil
+	}
+
+	var input VisitorInput
+	if err := json.Unmarshal(line, &input); err != nil {
+		return false, f.reject(file, offset, line, "invalid JSON: "+err.Error())
+	}
+	if input.Topic == "" {
+		return false, f.reject(file, offset, line, "topic is required")
+	}
+	if !knownTopic(ActionName(input.Topic)) {
+		return false, f.reject(file, offset, line, "no handler for topic "+input.Topic)
+	}
+
+	v := NewInputAction(ActionName(input.Topic), input.Payload)
+	f.tunnel.enterWithCheckpoint(v, checkpoint, next)
+	f.control.countEmit()
+	engineMetrics.generatorEmits.Inc("file", input.Topic)
+	return true, nil
+}
+
+// reject appends a malformed line to the error file. When that fails the
+// line is read again on the next poll instead of being lost.
+func (f *fileTail) reject(file string, offset int64, line []byte, reason string) error {
+	f.logger.Warn("rejected input line", "file", file, "offset", offset, "error", reason)
+
+	record, err := json.Marshal(fileLineError{File: file, Offset: offset, Line: string(line), Error: reason})
+	if err != nil {
+		return fmt.Errorf("encoding rejected line: %w", err)
+	}
+	out, err := os.OpenFile(f.errorPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening error file: %w", err)
+	}
+	if _, err = out.Write(append(record, '\n')); err != nil {
+		out.Close()
+		return fmt.Errorf("writing error file: %w", err)
+	}
+	return out.Close()
+}
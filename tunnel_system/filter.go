@@ -0,0 +1,191 @@
+package tunnel_system
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ReplayFilter selects the range and subset of a replay's actions to rerun.
+// Sequence numbers are 1-based positions as listed by /replay/{id}; the start
+// and stop bounds are inclusive.
+type ReplayFilter struct {
+	StartMessageID string             `json:"start_message_id,omitempty"`
+	StopMessageID  string             `json:"stop_message_id,omitempty"`
+	StartSeq       int                `json:"start_seq,omitempty"`
+	StopSeq        int                `json:"stop_seq,omitempty"`
+	MessageIDs     []string           `json:"message_ids,omitempty"`
+	IncludeTopics  []string           `json:"include_topics,omitempty"`
+	ExcludeTopics  []string           `json:"exclude_topics,omitempty"`
+	Payload        []PayloadPredicate `json:"payload,omitempty"`
+}
+
+// ParseReplayFilter reads a filter from /rerun query parameters:
+// start, stop (message IDs), from, to (sequence numbers), ids (comma separated
+// message IDs), include, exclude (comma separated topics) and any number of
+// where payload predicates.
+func ParseReplayFilter(query url.Values) (ReplayFilter, error) {
+	filter := ReplayFilter{
+		StartMessageID: query.Get("start"),
+		StopMessageID:  query.Get("stop"),
+		MessageIDs:     splitList(query.Get("ids")),
+		IncludeTopics:  splitList(query.Get("include")),
+		ExcludeTopics:  splitList(query.Get("exclude")),
+	}
+
+	for _, bound := range []struct {
+		param  string
+		target *int
+	}{
+		{"from", &filter.StartSeq},
+		{"to", &filter.StopSeq},
+	} {
+		value := query.Get(bound.param)
+		if value == "" {
+			continue
+		}
+		seq, err := strconv.Atoi(value)
+		if err != nil || seq < 1 {
+			return ReplayFilter{}, fmt.Errorf("invalid %s sequence %q", bound.param, value)
+		}
+		*bound.target = seq
+	}
+
+	for _, expr := range query["where"] {
+		predicate, err := ParsePayloadPredicate(expr)
+		if err != nil {
+			return ReplayFilter{}, err
+		}
+		filter.Payload = append(filter.Payload, predicate)
+	}
+
+	return filter, nil
+}
+
+// splitList splits a comma separated list of message IDs or topics, trimming
+// the items and skipping blank ones; an empty list is nil
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ParseReplayFilterJSON reads a filter as recorded on a replay; an empty string is no filter
+func ParseReplayFilterJSON(value string) (ReplayFilter, error) {
+	var filter ReplayFilter
+	if value == "" {
+		return filter, nil
+	}
+	err := json.Unmarshal([]byte(value), &filter)
+	return filter, err
+}
+
+func (f ReplayFilter) IsEmpty() bool {
+	return f.StartMessageID == "" && f.StopMessageID == "" && f.StartSeq == 0 && f.StopSeq == 0 &&
+		len(f.MessageIDs) == 0 && len(f.IncludeTopics) == 0 && len(f.ExcludeTopics) == 0 && len(f.Payload) == 0
+}
+
+// JSON is the form recorded on the child replay, empty when nothing is filtered
+func (f ReplayFilter) JSON() string {
+	if f.IsEmpty() {
+		return ""
+	}
+	val, err := json.Marshal(f)
+	if err != nil {
+		return ""
+	}
+	return string(val)
+}
+
+// withoutAudit drops the audit rows of an action log, leaving what the
+// tunnel itself wrote
+func withoutAudit(messages []ActionRow) []ActionRow {
+	kept := make([]ActionRow, 0, len(messages))
+	for _, msg := range messages {
+		if msg.ActionType != string(AUDIT) {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+// Apply returns the actions selected by the filter, keeping their order.
+// A message is selected by where it first appears, and then all of its
+// actions are kept, so an exit is never separated from its entry.
+func (f ReplayFilter) Apply(messages []ActionRow) []ActionRow {
+	if f.IsEmpty() {
+		return messages
+	}
+
+	selects := f.selector()
+	selected := make([]ActionRow, 0)
+	for _, msg := range messages {
+		if selects(msg) {
+			selected = append(selected, msg)
+		}
+	}
+	return selected
+}
+
+// selector applies the filter to actions fed to it one by one, in order. It
+// remembers the ID of every message it has seen, not the actions.
+func (f ReplayFilter) selector() func(msg ActionRow) bool {
+	if f.IsEmpty() {
+		return func(msg ActionRow) bool { return true }
+	}
+
+	selectedIDs := make(map[string]bool)
+	started := f.StartMessageID == ""
+	stopped := false
+	seq := 0
+	return func(msg ActionRow) bool {
+		seq++
+		if selected, seen := selectedIDs[msg.MessageID]; seen {
+			return selected
+		}
+
+		if !started && msg.MessageID == f.StartMessageID {
+			started = true
+		}
+		inRange := started && !stopped && seq >= f.StartSeq && (f.StopSeq == 0 || seq <= f.StopSeq)
+		if f.StopMessageID != "" && msg.MessageID == f.StopMessageID {
+			stopped = true
+		}
+
+		selectedIDs[msg.MessageID] = inRange && f.matches(msg)
+		return selectedIDs[msg.MessageID]
+	}
+}
+
+func (f ReplayFilter) matches(msg ActionRow) bool {
+	if len(f.MessageIDs) > 0 && !containsString(f.MessageIDs, msg.MessageID) {
+		return false
+	}
+	if len(f.IncludeTopics) > 0 && !containsString(f.IncludeTopics, msg.Topic) {
+		return false
+	}
+	if containsString(f.ExcludeTopics, msg.Topic) {
+		return false
+	}
+	for _, predicate := range f.Payload {
+		if !predicate.Match(msg.Payload) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
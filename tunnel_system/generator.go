@@ -3,7 +3,6 @@ package tunnel_system
 import (
 	"encoding/json"
 	"github.com/gorilla/websocket"
-	"log"
 	"net/http"
 	"time"
 )
@@ -15,30 +14,84 @@ type InputGenerator interface {
 
 // IntervalGenerator generates events at fixed time intervals
 type IntervalGenerator struct {
+	Name      string
 	InputFunc func() VisitorInput
 	Interval  time.Duration
+	// Topic is only shown in generator listings
+	Topic string
+
+	generatorControl
 }
 
 // ConnectionGenerator generates events from external connections
 type ConnectionGenerator struct {
+	Name      string
 	StartFunc func(*Tunnel)
+
+	generatorControl
 }
 
 func (g *IntervalGenerator) Start(ts *TunnelSystem) {
 	go func() {
+		last := time.Now()
+		g.emit(ts)
 		for {
-			input := g.InputFunc()
-			v := NewInputAction(ActionName(input.Topic), input.Payload)
-			ts.mainEntrance.Enter(v)
-			time.Sleep(g.Interval)
+			if !g.wait(time.Until(last.Add(g.interval()))) {
+				ts.logger.Info("interval generator stopped", "generator", g.Name)
+				return
+			}
+			if time.Since(last) < g.interval() {
+				continue
+			}
+			last = time.Now()
+			g.emit(ts)
 		}
 	}()
-	log.Printf("Started interval generator (interval: %v)", g.Interval)
+	ts.logger.Info("started interval generator", "generator", g.Name, "interval", g.interval())
+}
+
+func (g *IntervalGenerator) emit(ts *TunnelSystem) {
+	if g.isPaused() {
+		return
+	}
+	input := g.InputFunc()
+	v := NewInputAction(ActionName(input.Topic), input.Payload)
+	ts.mainEntrance.Enter(v)
+	g.countEmit()
+	engineMetrics.generatorEmits.Inc("interval", input.Topic)
+}
+
+func (g *IntervalGenerator) interval() time.Duration {
+	g.controlMu.Lock()
+	defer g.controlMu.Unlock()
+	return g.Interval
+}
+
+func (g *IntervalGenerator) setInterval(interval time.Duration) {
+	g.controlMu.Lock()
+	g.Interval = interval
+	g.controlMu.Unlock()
+	g.notify()
+}
+
+func (g *IntervalGenerator) firstFire(start time.Time) time.Time {
+	return start
+}
+
+func (g *IntervalGenerator) nextFire(last time.Time) time.Time {
+	if g.Interval <= 0 {
+		return time.Time{}
+	}
+	return last.Add(g.Interval)
+}
+
+func (g *IntervalGenerator) inputAt(at time.Time) VisitorInput {
+	return g.InputFunc()
 }
 
 func (g *ConnectionGenerator) Start(ts *TunnelSystem) {
 	go func() {
-		log.Printf("Started connection generator")
+		ts.logger.Info("started connection generator")
 		g.StartFunc(ts.mainEntrance)
 	}()
 }
@@ -57,21 +110,26 @@ func NewConnectionInputGenerator(startFunc func(*Tunnel)) *ConnectionGenerator {
 }
 
 func startInputGenerators(ts *TunnelSystem, generators []InputGenerator) {
-	for _, gen := range generators {
-		gen.Start(ts)
+	for i, gen := range generators {
+		name := generatorName(gen, i+1)
+		if err := ts.startGenerator(name, gen); err != nil {
+			ts.logger.Error("generator not started", "generator", name, "error", err)
+		}
 	}
 }
 
 // createHTTPGenerator creates a built-in HTTP server generator
 func createHTTPGenerator(port string) *ConnectionGenerator {
-	return NewConnectionInputGenerator(func(t *Tunnel) {
+	var gen *ConnectionGenerator
+	gen = NewConnectionInputGenerator(func(t *Tunnel) {
+		logger := t.logger.With("component", "http")
 		mux := http.NewServeMux()
 
 		mux.HandleFunc("/visitor", func(w http.ResponseWriter, r *http.Request) {
 			// Set CORS headers
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 			w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key")
 
 			// Handle preflight OPTIONS request
 			if r.Method == http.MethodOptions {
@@ -84,6 +142,11 @@ func createHTTPGenerator(port string) *ConnectionGenerator {
 				return
 			}
 
+			if gen.isPaused() {
+				http.Error(w, "Generator paused", http.StatusServiceUnavailable)
+				return
+			}
+
 			var input VisitorInput
 			if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 				http.Error(w, "Invalid JSON", http.StatusBadRequest)
@@ -95,26 +158,47 @@ func createHTTPGenerator(port string) *ConnectionGenerator {
 				return
 			}
 
+			if input.IdempotencyKey == "" {
+				input.IdempotencyKey = r.Header.Get("Idempotency-Key")
+			}
+
 			v := NewInputAction(ActionName(input.Topic), input.Payload)
-			t.Enter(v)
+			messageID, duplicate := t.EnterOnce(v, input.IdempotencyKey)
+			if !duplicate {
+				gen.countEmit()
+				engineMetrics.generatorEmits.Inc("http", input.Topic)
+			}
 
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+			json.NewEncoder(w).Encode(enteredReply{Status: "ok", MessageID: messageID, Duplicate: duplicate})
 
-			log.Printf("HTTP: Received %s with payload: %s", input.Topic, input.Payload)
+			logger.Debug("received visitor", "message_id", messageID, "topic", input.Topic, "payload", input.Payload, "duplicate", duplicate)
 		})
 
-		log.Printf("HTTP server listening on %s/visitor", port)
+		logger.Info("HTTP server listening", "address", port+"/visitor")
 		if err := http.ListenAndServe(port, mux); err != nil {
-			log.Printf("HTTP server error: %v", err)
+			logger.Error("HTTP server error", "error", err)
 		}
 	})
+	gen.Name = "http"
+	return gen
+}
+
+// enteredReply tells a client which message ID its input has, the original
+// one when the input was a duplicate
+type enteredReply struct {
+	Status         string `json:"status"`
+	MessageID      string `json:"message_id"`
+	Duplicate      bool   `json:"duplicate,omitempty"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
 }
 
 // createWebSocketGenerator creates a built-in WebSocket server generator
 func createWebSocketGenerator(port string) *ConnectionGenerator {
-	return NewConnectionInputGenerator(func(t *Tunnel) {
+	var gen *ConnectionGenerator
+	gen = NewConnectionInputGenerator(func(t *Tunnel) {
+		logger := t.logger.With("component", "websocket")
 		upgrader := websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true // Allow all origins
@@ -126,41 +210,62 @@ func createWebSocketGenerator(port string) *ConnectionGenerator {
 		mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 			conn, err := upgrader.Upgrade(w, r, nil)
 			if err != nil {
-				log.Printf("WebSocket upgrade failed: %v", err)
+				logger.Warn("upgrade failed", "error", err)
 				return
 			}
 			defer conn.Close()
 
-			log.Printf("WebSocket client connected")
+			logger.Info("client connected", "remote", r.RemoteAddr)
 
 			for {
 				_, message, err := conn.ReadMessage()
 				if err != nil {
-					log.Printf("WebSocket read error: %v", err)
+					logger.Info("read error", "error", err)
 					break
 				}
 
 				var input VisitorInput
 				if err := json.Unmarshal(message, &input); err != nil {
-					log.Printf("WebSocket invalid JSON: %v", err)
+					logger.Warn("invalid JSON", "error", err)
 					continue
 				}
 
 				if input.Topic == "" {
-					log.Printf("WebSocket: Topic is required")
+					logger.Warn("topic is required")
+					continue
+				}
+
+				if gen.isPaused() {
+					logger.Warn("generator paused, dropping visitor", "topic", input.Topic)
 					continue
 				}
 
 				v := NewInputAction(ActionName(input.Topic), input.Payload)
-				t.Enter(v)
+				messageID, duplicate := t.EnterOnce(v, input.IdempotencyKey)
+				if !duplicate {
+					gen.countEmit()
+					engineMetrics.generatorEmits.Inc("websocket", input.Topic)
+				}
+
+				// only clients sending keys read replies, so nobody else has
+				// unread messages piling up
+				if input.IdempotencyKey != "" {
+					reply := enteredReply{Status: "ok", MessageID: messageID, Duplicate: duplicate, IdempotencyKey: input.IdempotencyKey}
+					if err := conn.WriteJSON(reply); err != nil {
+						logger.Info("write error", "error", err)
+						break
+					}
+				}
 
-				log.Printf("WebSocket: Received %s with payload: %s", input.Topic, input.Payload)
+				logger.Debug("received visitor", "message_id", messageID, "topic", input.Topic, "payload", input.Payload, "duplicate", duplicate)
 			}
 		})
 
-		log.Printf("WebSocket server listening on %s/ws", port)
+		logger.Info("WebSocket server listening", "address", port+"/ws")
 		if err := http.ListenAndServe(port, mux); err != nil {
-			log.Printf("WebSocket server error: %v", err)
+			logger.Error("WebSocket server error", "error", err)
 		}
 	})
+	gen.Name = "websocket"
+	return gen
 }
@@ -0,0 +1,497 @@
+package tunnel_system
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type GeneratorState string
+
+const (
+	GENERATOR_RUNNING GeneratorState = "running"
+	GENERATOR_PAUSED  GeneratorState = "paused"
+	GENERATOR_STOPPED GeneratorState = "stopped"
+)
+
+// GENERATOR_CONTROL is the topic of the audit rows generator operations write
+const GENERATOR_CONTROL ActionName = "GENERATOR_CONTROL"
+
+// generatorControl is the switch a generator checks before it emits, so the
+// registry can pause, stop and retune it while it runs
+type generatorControl struct {
+	controlMu sync.Mutex
+	paused    bool
+	stopped   bool
+	emitted   int64
+	wake      chan struct{}
+}
+
+func (c *generatorControl) control() *generatorControl {
+	return c
+}
+
+// controllable is implemented by generators that embed a generatorControl
+type controllable interface {
+	control() *generatorControl
+}
+
+func (c *generatorControl) isPaused() bool {
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	return c.paused
+}
+
+func (c *generatorControl) state() GeneratorState {
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	switch {
+	case c.stopped:
+		return GENERATOR_STOPPED
+	case c.paused:
+		return GENERATOR_PAUSED
+	}
+	return GENERATOR_RUNNING
+}
+
+func (c *generatorControl) setPaused(paused bool) {
+	c.controlMu.Lock()
+	c.paused = paused
+	c.controlMu.Unlock()
+	c.notify()
+}
+
+func (c *generatorControl) stop() {
+	c.controlMu.Lock()
+	c.stopped = true
+	c.controlMu.Unlock()
+	c.notify()
+}
+
+func (c *generatorControl) countEmit() {
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	c.emitted++
+}
+
+func (c *generatorControl) emitCount() int64 {
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	return c.emitted
+}
+
+// notify wakes a generator waiting in wait so it sees the change right away
+func (c *generatorControl) notify() {
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	if c.wake != nil {
+		close(c.wake)
+		c.wake = nil
+	}
+}
+
+// wait sleeps for d or until the generator's controls change. It returns
+// false once the generator is stopped.
+func (c *generatorControl) wait(d time.Duration) bool {
+	c.controlMu.Lock()
+	if c.stopped {
+		c.controlMu.Unlock()
+		return false
+	}
+	if c.wake == nil {
+		c.wake = make(chan struct{})
+	}
+	wake := c.wake
+	c.controlMu.Unlock()
+
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-wake:
+		}
+	}
+
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	return !c.stopped
+}
+
+// GeneratorInfo describes a registered generator
+type GeneratorInfo struct {
+	Name      string         `json:"name"`
+	Kind      string         `json:"kind"`
+	State     GeneratorState `json:"state"`
+	Topic     string         `json:"topic,omitempty"`
+	Interval  string         `json:"interval,omitempty"`
+	Schedule  string         `json:"schedule,omitempty"`
+	Emitted   int64          `json:"emitted"`
+	StartedAt time.Time      `json:"started_at"`
+}
+
+type generatorEntry struct {
+	name      string
+	generator InputGenerator
+	startedAt time.Time
+}
+
+func (e *generatorEntry) info() GeneratorInfo {
+	info := GeneratorInfo{
+		Name:      e.name,
+		Kind:      generatorKind(e.generator),
+		State:     GENERATOR_RUNNING,
+		StartedAt: e.startedAt,
+	}
+	if c, ok := e.generator.(controllable); ok {
+		info.State = c.control().state()
+		info.Emitted = c.control().emitCount()
+	}
+	switch g := e.generator.(type) {
+	case *IntervalGenerator:
+		info.Interval = g.interval().String()
+		info.Topic = g.Topic
+	case *CronGenerator:
+		info.Schedule = g.Schedule.Expr + " " + g.Schedule.Location.String()
+		info.Topic = g.Topic
+	case *BrokerGenerator:
+		info.Topic = strings.Join(g.Topics, ",")
+	}
+	return info
+}
+
+// generatorRegistry keeps the generators of a running engine by name
+type generatorRegistry struct {
+	mu      sync.Mutex
+	entries []*generatorEntry
+}
+
+func newGeneratorRegistry() *generatorRegistry {
+	return &generatorRegistry{}
+}
+
+func (r *generatorRegistry) add(name string, generator InputGenerator) (*generatorEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, entry := range r.entries {
+		if entry.name == name {
+			return nil, fmt.Errorf("a generator named %q already exists", name)
+		}
+	}
+	entry := &generatorEntry{name: name, generator: generator, startedAt: time.Now()}
+	r.entries = append(r.entries, entry)
+	return entry, nil
+}
+
+// remove forgets a generator, so its name can be registered again
+func (r *generatorRegistry) remove(entry *generatorEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, e := range r.entries {
+		if e == entry {
+			r.entries = append(r.entries[:i], r.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *generatorRegistry) get(name string) (*generatorEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, entry := range r.entries {
+		if entry.name == name {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// pauseAll keeps every generator from entering visitors, as shutting down does
+func (r *generatorRegistry) pauseAll() {
+	r.mu.Lock()
+	entries := append(make([]*generatorEntry, 0, len(r.entries)), r.entries...)
+	r.mu.Unlock()
+	for _, entry := range entries {
+		if c, ok := entry.generator.(controllable); ok {
+			c.control().setPaused(true)
+		}
+	}
+}
+
+func (r *generatorRegistry) list() []GeneratorInfo {
+	r.mu.Lock()
+	entries := append(make([]*generatorEntry, 0, len(r.entries)), r.entries...)
+	r.mu.Unlock()
+
+	infos := make([]GeneratorInfo, 0, len(entries))
+	for _, entry := range entries {
+		infos = append(infos, entry.info())
+	}
+	return infos
+}
+
+func generatorKind(generator InputGenerator) string {
+	switch generator.(type) {
+	case *IntervalGenerator:
+		return "interval"
+	case *CronGenerator:
+		return "cron"
+	case *ConnectionGenerator:
+		return "connection"
+	case *BrokerGenerator:
+		return "broker"
+	case *SimulationGenerator:
+		return "simulation"
+	}
+	return fmt.Sprintf("%T", generator)
+}
+
+// generatorName is the name a generator registers under: its own, or its
+// kind and position when it has none
+func generatorName(generator InputGenerator, position int) string {
+	name := ""
+	switch g := generator.(type) {
+	case *IntervalGenerator:
+		name = g.Name
+	case *CronGenerator:
+		name = g.Name
+	case *ConnectionGenerator:
+		name = g.Name
+	case *BrokerGenerator:
+		name = g.Name
+	case *SimulationGenerator:
+		name = fmt.Sprintf("simulation-%d", g.Seed)
+	}
+	if name == "" {
+		name = fmt.Sprintf("%s-%d", generatorKind(generator), position)
+	}
+	return name
+}
+
+// startGenerator registers a generator and starts it
+func (t *TunnelSystem) startGenerator(name string, generator InputGenerator) error {
+	if _, err := t.generators.add(name, generator); err != nil {
+		return err
+	}
+	generator.Start(t)
+	return nil
+}
+
+func (t *TunnelSystem) ListGenerators() []GeneratorInfo {
+	return t.generators.list()
+}
+
+// PauseGenerator keeps a generator from entering visitors until it is
+// resumed. The engine tick cannot be paused, as every timer waits for it.
+func (t *TunnelSystem) PauseGenerator(name string) (GeneratorInfo, error) {
+	return t.controlGenerator(name, "pause", nil, func(entry *generatorEntry, c *generatorControl) error {
+		if entry.generator == t.engineTick {
+			return fmt.Errorf("generator %q drives the timers and cannot be paused", name)
+		}
+		c.setPaused(true)
+		return nil
+	})
+}
+
+func (t *TunnelSystem) ResumeGenerator(name string) (GeneratorInfo, error) {
+	return t.controlGenerator(name, "resume", nil, func(entry *generatorEntry, c *generatorControl) error {
+		c.setPaused(false)
+		return nil
+	})
+}
+
+// RemoveGenerator stops a generator for good and frees its name. Connection
+// generators keep their listener open, so they can only be paused, and the
+// engine tick cannot be removed, as every timer waits for it.
+func (t *TunnelSystem) RemoveGenerator(name string) (GeneratorInfo, error) {
+	return t.controlGenerator(name, "remove", nil, func(entry *generatorEntry, c *generatorControl) error {
+		if _, ok := entry.generator.(*ConnectionGenerator); ok {
+			return fmt.Errorf("connection generator %q cannot be removed, pause it instead", name)
+		}
+		if entry.generator == t.engineTick {
+			return fmt.Errorf("generator %q drives the timers and cannot be removed", name)
+		}
+		c.stop()
+		t.generators.remove(entry)
+		return nil
+	})
+}
+
+func (t *TunnelSystem) SetGeneratorInterval(name string, interval time.Duration) (GeneratorInfo, error) {
+	details := map[string]string{"interval": interval.String()}
+	return t.controlGenerator(name, "set_interval", details, func(entry *generatorEntry, c *generatorControl) error {
+		g, ok := entry.generator.(*IntervalGenerator)
+		if !ok {
+			return fmt.Errorf("generator %q does not run on an interval", name)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("interval must be positive, got %s", interval)
+		}
+		g.setInterval(interval)
+		return nil
+	})
+}
+
+// AddIntervalGenerator starts a generator that enters the same visitor at
+// every interval. The topic must have a handler, or the engine would fail on
+// the first visitor.
+func (t *TunnelSystem) AddIntervalGenerator(name string, topic string, payload string, interval time.Duration) (GeneratorInfo, error) {
+	if name == "" || topic == "" {
+		return GeneratorInfo{}, fmt.Errorf("a generator needs a name and a topic")
+	}
+	if !knownTopic(ActionName(topic)) {
+		return GeneratorInfo{}, fmt.Errorf("no handler for topic %q", topic)
+	}
+	if interval <= 0 {
+		return GeneratorInfo{}, fmt.Errorf("interval must be positive, got %s", interval)
+	}
+
+	generator := NewCustomInputGenerator(func() VisitorInput {
+		return VisitorInput{Topic: topic, Payload: payload}
+	}, interval)
+	generator.Name = name
+	generator.Topic = topic
+	if err := t.startGenerator(name, generator); err != nil {
+		return GeneratorInfo{}, err
+	}
+
+	t.audit("add", name, map[string]string{"topic": topic, "payload": payload, "interval": interval.String()})
+	entry, _ := t.generators.get(name)
+	return entry.info(), nil
+}
+
+func (t *TunnelSystem) controlGenerator(name string, operation string, details map[string]string, apply func(*generatorEntry, *generatorControl) error) (GeneratorInfo, error) {
+	entry, ok := t.generators.get(name)
+	if !ok {
+		return GeneratorInfo{}, fmt.Errorf("generator %q not found", name)
+	}
+	c, ok := entry.generator.(controllable)
+	if !ok {
+		return GeneratorInfo{}, fmt.Errorf("generator %q cannot be controlled", name)
+	}
+	if err := apply(entry, c.control()); err != nil {
+		return GeneratorInfo{}, err
+	}
+	t.audit(operation, name, details)
+	return entry.info(), nil
+}
+
+// audit records a generator operation in the main run's action log. Audit
+// rows are not visitors: reruns and comparisons leave them out.
+func (t *TunnelSystem) audit(operation string, generator string, details map[string]string) {
+	record := map[string]string{"operation": operation, "generator": generator}
+	for k, v := range details {
+		record[k] = v
+	}
+	payload, err := json.Marshal(record)
+	if err != nil {
+		panic("encoding audit record failed because: " + err.Error())
+	}
+
+	main := t.mainEntrance
+	main.actionLogger.InsertAction(main.replayId, generateMessageId(), string(GENERATOR_CONTROL), "M0", string(AUDIT), string(IN), string(payload), string(AUDIT), 0)
+	t.logger.Info("generator "+operation, "generator", generator, "details", details)
+}
+
+// knownTopic reports whether the engine can handle visitors of a topic
+func knownTopic(name ActionName) bool {
+	if name == TICK || name == LOGON {
+		return true
+	}
+	_, ok := lookupHandler(name)
+	return ok
+}
+
+func (s *server) registerGeneratorRoutes() {
+	http.HandleFunc("/generators", s.handleGenerators)
+	http.HandleFunc("/generators/", s.handleGenerator)
+}
+
+// generatorRequest is the body of POST /generators
+type generatorRequest struct {
+	Name     string `json:"name"`
+	Topic    string `json:"topic"`
+	Payload  string `json:"payload"`
+	Interval string `json:"interval"`
+}
+
+func (s *server) handleGenerators(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.tunnelSystem.ListGenerators())
+	case http.MethodPost:
+		var req generatorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		interval, err := time.ParseDuration(req.Interval)
+		if err != nil {
+			http.Error(w, "Invalid interval. Use a duration such as 5s", http.StatusBadRequest)
+			return
+		}
+		info, err := s.tunnelSystem.AddIntervalGenerator(req.Name, req.Topic, req.Payload, interval)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, info)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleGenerator serves /generators/{name} and its operations
+func (s *server) handleGenerator(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/generators/"), "/")
+	name := parts[0]
+	operation := ""
+	if len(parts) > 1 {
+		operation = parts[1]
+	}
+	if name == "" || len(parts) > 2 {
+		http.Error(w, "Use /generators/{name}[/pause|/resume|/interval]", http.StatusBadRequest)
+		return
+	}
+
+	var info GeneratorInfo
+	var err error
+	switch {
+	case operation == "" && r.Method == http.MethodGet:
+		entry, ok := s.tunnelSystem.generators.get(name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("generator %q not found", name), http.StatusNotFound)
+			return
+		}
+		info = entry.info()
+	case operation == "" && r.Method == http.MethodDelete:
+		info, err = s.tunnelSystem.RemoveGenerator(name)
+	case operation == "pause" && r.Method == http.MethodPost:
+		info, err = s.tunnelSystem.PauseGenerator(name)
+	case operation == "resume" && r.Method == http.MethodPost:
+		info, err = s.tunnelSystem.ResumeGenerator(name)
+	case operation == "interval" && r.Method == http.MethodPost:
+		interval, parseErr := time.ParseDuration(r.URL.Query().Get("every"))
+		if parseErr != nil {
+			http.Error(w, "Invalid interval. Use /generators/{name}/interval?every=5s", http.StatusBadRequest)
+			return
+		}
+		info, err = s.tunnelSystem.SetGeneratorInterval(name, interval)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		status := http.StatusBadRequest
+		if _, ok := s.tunnelSystem.generators.get(name); !ok {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, info)
+}
@@ -0,0 +1,438 @@
+package tunnel_system
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// The messages of ingress.proto, encoded by hand with protowire so the engine
+// needs no generated code. They are wire compatible with clients generated
+// from the .proto file.
+
+type grpcInput struct {
+	Topic   string
+	Payload string
+}
+
+type grpcAccepted struct {
+	MessageID string
+	Topic     string
+}
+
+type grpcRejected struct {
+	Topic string
+	Error string
+}
+
+type grpcVisitor struct {
+	MessageID       string
+	ActionName      string
+	CausedBy        string
+	Payload         string
+	ActionType      string
+	ActionDirection string
+	ReplayID        int64
+	VirtualTime     int64
+}
+
+// grpcStreamEvent holds exactly one of its fields, like the proto oneof
+type grpcStreamEvent struct {
+	Accepted *grpcAccepted
+	Output   *grpcVisitor
+	Rejected *grpcRejected
+}
+
+// wireMessage is implemented by every message the codec can carry
+type wireMessage interface {
+	marshalWire() []byte
+	unmarshalWire(b []byte) error
+}
+
+// wireCodec replaces the default proto codec, which needs generated messages
+type wireCodec struct{}
+
+func (wireCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("cannot encode %T", v)
+	}
+	return m.marshalWire(), nil
+}
+
+func (wireCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("cannot decode into %T", v)
+	}
+	return m.unmarshalWire(data)
+}
+
+func (wireCodec) Name() string {
+	return "proto"
+}
+
+func appendString(b []byte, num protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func appendInt(b []byte, num protowire.Number, value int64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(value))
+}
+
+func appendMessage(b []byte, num protowire.Number, m wireMessage) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m.marshalWire())
+}
+
+// wireFields are the destinations of the fields a message decodes
+type wireFields struct {
+	strings  map[protowire.Number]*string
+	ints     map[protowire.Number]*int64
+	messages map[protowire.Number]func(b []byte) error
+}
+
+// decode reads an encoded message into its fields, skipping unknown ones
+func (f wireFields) decode(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case typ == protowire.BytesType && f.strings[num] != nil:
+			value, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			*f.strings[num] = value
+			b = b[n:]
+		case typ == protowire.BytesType && f.messages[num] != nil:
+			value, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if err := f.messages[num](value); err != nil {
+				return err
+			}
+			b = b[n:]
+		case typ == protowire.VarintType && f.ints[num] != nil:
+			value, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			*f.ints[num] = int64(value)
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+func (m *grpcInput) marshalWire() []byte {
+	b := appendString(nil, 1, m.Topic)
+	return appendString(b, 2, m.Payload)
+}
+
+func (m *grpcInput) unmarshalWire(b []byte) error {
+	return wireFields{strings: map[protowire.Number]*string{1: &m.Topic, 2: &m.Payload}}.decode(b)
+}
+
+func (m *grpcAccepted) marshalWire() []byte {
+	b := appendString(nil, 1, m.MessageID)
+	return appendString(b, 2, m.Topic)
+}
+
+func (m *grpcAccepted) unmarshalWire(b []byte) error {
+	return wireFields{strings: map[protowire.Number]*string{1: &m.MessageID, 2: &m.Topic}}.decode(b)
+}
+
+func (m *grpcRejected) marshalWire() []byte {
+	b := appendString(nil, 1, m.Topic)
+	return appendString(b, 2, m.Error)
+}
+
+func (m *grpcRejected) unmarshalWire(b []byte) error {
+	return wireFields{strings: map[protowire.Number]*string{1: &m.Topic, 2: &m.Error}}.decode(b)
+}
+
+func (m *grpcVisitor) marshalWire() []byte {
+	b := appendString(nil, 1, m.MessageID)
+	b = appendString(b, 2, m.ActionName)
+	b = appendString(b, 3, m.CausedBy)
+	b = appendString(b, 4, m.Payload)
+	b = appendString(b, 5, m.ActionType)
+	b = appendString(b, 6, m.ActionDirection)
+	b = appendInt(b, 7, m.ReplayID)
+	return appendInt(b, 8, m.VirtualTime)
+}
+
+func (m *grpcVisitor) unmarshalWire(b []byte) error {
+	return wireFields{
+		strings: map[protowire.Number]*string{
+			1: &m.MessageID, 2: &m.ActionName, 3: &m.CausedBy,
+			4: &m.Payload, 5: &m.ActionType, 6: &m.ActionDirection,
+		},
+		ints: map[protowire.Number]*int64{7: &m.ReplayID, 8: &m.VirtualTime},
+	}.decode(b)
+}
+
+func (m *grpcStreamEvent) marshalWire() []byte {
+	switch {
+	case m.Accepted != nil:
+		return appendMessage(nil, 1, m.Accepted)
+	case m.Output != nil:
+		return appendMessage(nil, 2, m.Output)
+	case m.Rejected != nil:
+		return appendMessage(nil, 3, m.Rejected)
+	}
+	return nil
+}
+
+func (m *grpcStreamEvent) unmarshalWire(b []byte) error {
+	return wireFields{messages: map[protowire.Number]func([]byte) error{
+		1: func(b []byte) error { m.Accepted = &grpcAccepted{}; return m.Accepted.unmarshalWire(b) },
+		2: func(b []byte) error { m.Output = &grpcVisitor{}; return m.Output.unmarshalWire(b) },
+		3: func(b []byte) error { m.Rejected = &grpcRejected{}; return m.Rejected.unmarshalWire(b) },
+	}}.decode(b)
+}
+
+func newGRPCVisitor(v *Visitor) *grpcVisitor {
+	return &grpcVisitor{
+		MessageID:       v.MessageId,
+		ActionName:      string(v.ActionName),
+		CausedBy:        v.CausedBy,
+		Payload:         v.Payload,
+		ActionType:      string(v.ActionType),
+		ActionDirection: string(v.ActionDirection),
+		ReplayID:        v.ReplayId,
+		VirtualTime:     v.VirtualTime,
+	}
+}
+
+// ingressServer is the service of ingress.proto
+type ingressServer interface {
+	Submit(ctx context.Context, in *grpcInput) (*grpcAccepted, error)
+	Stream(stream grpc.ServerStream) error
+}
+
+var ingressServiceDesc = grpc.ServiceDesc{
+	ServiceName: "fund78.v1.Ingress",
+	HandlerType: (*ingressServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Submit",
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			in := &grpcInput{}
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return srv.(ingressServer).Submit(ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/fund78.v1.Ingress/Submit"}
+			return interceptor(ctx, in, info, func(ctx context.Context, req any) (any, error) {
+				return srv.(ingressServer).Submit(ctx, req.(*grpcInput))
+			})
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName: "Stream",
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			return srv.(ingressServer).Stream(stream)
+		},
+		ServerStreams: true,
+		ClientStreams: true,
+	}},
+	Metadata: "ingress.proto",
+}
+
+// grpcStreamBuffer is how many outputs a stream may fall behind before it is
+// ended, since the tunnel cannot wait for a slow client
+const grpcStreamBuffer = 1024
+
+// grpcStreamDrain is how long a stream waits for outputs after its client
+// stopped sending
+const grpcStreamDrain = 5 * time.Second
+
+type grpcIngress struct {
+	tunnel *Tunnel
+	gen    *ConnectionGenerator
+	logger *slog.Logger
+}
+
+func (s *grpcIngress) Submit(ctx context.Context, in *grpcInput) (*grpcAccepted, error) {
+	v, err := s.enterAs(NewInputAction(ActionName(in.Topic), in.Payload), in)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcAccepted{MessageID: v.MessageId, Topic: in.Topic}, nil
+}
+
+// Stream enters the inputs of a client and sends back the visitors exiting
+// because of them: the input itself and, following CausedBy, the visitors it
+// led to. Once the client stops sending, the stream stays open until every
+// input has exited or grpcStreamDrain has passed; outputs caused later, such
+// as timers, only reach clients that keep sending open.
+func (s *grpcIngress) Stream(stream grpc.ServerStream) error {
+	var mu sync.Mutex
+	caused := make(map[string]bool)
+	waiting := make(map[string]bool)
+	outputs := make(chan *Visitor, grpcStreamBuffer)
+	overflow := make(chan struct{})
+	var overflowOnce sync.Once
+
+	unsubscribe := s.tunnel.subscribe(func(v *Visitor) {
+		mu.Lock()
+		mine := caused[v.MessageId] || caused[v.CausedBy]
+		if mine {
+			caused[v.MessageId] = true
+		}
+		mu.Unlock()
+		if !mine {
+			return
+		}
+		select {
+		case outputs <- v:
+		default:
+			overflowOnce.Do(func() { close(overflow) })
+		}
+	})
+	defer unsubscribe()
+
+	var sendMu sync.Mutex
+	send := func(event *grpcStreamEvent) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.SendMsg(event)
+	}
+
+	received := make(chan error, 1)
+	go func() {
+		for {
+			in := &grpcInput{}
+			if err := stream.RecvMsg(in); err != nil {
+				received <- err
+				return
+			}
+			// Track the message before entering it, so its exit is not missed
+			v := NewInputAction(ActionName(in.Topic), in.Payload)
+			mu.Lock()
+			caused[v.MessageId] = true
+			waiting[v.MessageId] = true
+			mu.Unlock()
+
+			entered, err := s.enterAs(v, in)
+			if err != nil {
+				mu.Lock()
+				delete(caused, v.MessageId)
+				delete(waiting, v.MessageId)
+				mu.Unlock()
+				err = send(&grpcStreamEvent{Rejected: &grpcRejected{Topic: in.Topic, Error: status.Convert(err).Message()}})
+			} else {
+				err = send(&grpcStreamEvent{Accepted: &grpcAccepted{MessageID: entered.MessageId, Topic: in.Topic}})
+			}
+			if err != nil {
+				received <- err
+				return
+			}
+		}
+	}()
+
+	var drain <-chan time.Time
+	for {
+		select {
+		case v := <-outputs:
+			mu.Lock()
+			delete(waiting, v.MessageId)
+			done := drain != nil && len(waiting) == 0
+			mu.Unlock()
+			if err := send(&grpcStreamEvent{Output: newGRPCVisitor(v)}); err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+		case err := <-received:
+			if err != io.EOF {
+				return err
+			}
+			mu.Lock()
+			done := len(waiting) == 0
+			mu.Unlock()
+			if done {
+				return nil
+			}
+			drain = time.After(grpcStreamDrain)
+		case <-drain:
+			return nil
+		case <-overflow:
+			return status.Error(codes.ResourceExhausted, "stream fell too far behind the tunnel")
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// enterAs enters an input under a message ID chosen by the caller
+func (s *grpcIngress) enterAs(v *Visitor, in *grpcInput) (*Visitor, error) {
+	if s.gen.isPaused() {
+		return nil, status.Error(codes.Unavailable, "generator paused")
+	}
+	if in.Topic == "" {
+		return nil, status.Error(codes.InvalidArgument, "topic is required")
+	}
+	if !knownTopic(ActionName(in.Topic)) {
+		return nil, status.Errorf(codes.InvalidArgument, "no handler for topic %s", in.Topic)
+	}
+	s.tunnel.Enter(v)
+	s.gen.countEmit()
+	engineMetrics.generatorEmits.Inc("grpc", in.Topic)
+	s.logger.Debug("received visitor", "message_id", v.MessageId, "topic", in.Topic, "payload", in.Payload)
+	return v, nil
+}
+
+// createGRPCGenerator creates a built-in gRPC server generator
+func createGRPCGenerator(port string) *ConnectionGenerator {
+	var gen *ConnectionGenerator
+	gen = NewConnectionInputGenerator(func(t *Tunnel) {
+		logger := t.logger.With("component", "grpc")
+
+		listener, err := net.Listen("tcp", port)
+		if err != nil {
+			logger.Error("gRPC listen failed", "error", err)
+			return
+		}
+		server := grpc.NewServer(grpc.ForceServerCodec(wireCodec{}))
+		server.RegisterService(&ingressServiceDesc, &grpcIngress{tunnel: t, gen: gen, logger: logger})
+
+		logger.Info("gRPC server listening", "address", port, "service", ingressServiceDesc.ServiceName)
+		if err := server.Serve(listener); err != nil {
+			logger.Error("gRPC server error", "error", err)
+		}
+	})
+	gen.Name = "grpc"
+	return gen
+}
@@ -0,0 +1,271 @@
+package tunnel_system
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ingressDescriptor is ingress.proto, built by hand since the repo has no
+// generated code
+func ingressDescriptor(t *testing.T) protoreflect.FileDescriptor {
+	t.Helper()
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+			JsonName: proto.String(name),
+		}
+	}
+	str := descriptorpb.FieldDescriptorProto_TYPE_STRING
+	event := func(name string, number int32, message string) *descriptorpb.FieldDescriptorProto {
+		f := field(name, number, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE)
+		f.TypeName = proto.String(".fund78.v1." + message)
+		f.OneofIndex = proto.Int32(0)
+		return f
+	}
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("ingress.proto"),
+		Package: proto.String("fund78.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("VisitorInput"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("topic", 1, str), field("payload", 2, str),
+			}},
+			{Name: proto.String("Accepted"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("message_id", 1, str), field("topic", 2, str),
+			}},
+			{Name: proto.String("Rejected"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("topic", 1, str), field("error", 2, str),
+			}},
+			{Name: proto.String("Visitor"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("message_id", 1, str), field("action_name", 2, str), field("caused_by", 3, str),
+				field("payload", 4, str), field("action_type", 5, str), field("action_direction", 6, str),
+				field("replay_id", 7, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+				field("virtual_time", 8, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+			}},
+			{
+				Name: proto.String("StreamEvent"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					event("accepted", 1, "Accepted"), event("output", 2, "Visitor"), event("rejected", 3, "Rejected"),
+				},
+				OneofDecl: []*descriptorpb.OneofDescriptorProto{{Name: proto.String("event")}},
+			},
+		},
+	}
+	fd, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+// newDynamic builds a message of ingress.proto, setting fields by name
+func newDynamic(fd protoreflect.FileDescriptor, message string, fields map[string]any) *dynamicpb.Message {
+	m := dynamicpb.NewMessage(fd.Messages().ByName(protoreflect.Name(message)))
+	for name, value := range fields {
+		f := m.Descriptor().Fields().ByName(protoreflect.Name(name))
+		if sub, ok := value.(*dynamicpb.Message); ok {
+			m.Set(f, protoreflect.ValueOfMessage(sub))
+			continue
+		}
+		m.Set(f, protoreflect.ValueOf(value))
+	}
+	return m
+}
+
+func TestWireCodecMatchesProto(t *testing.T) {
+	fd := ingressDescriptor(t)
+	visitor := map[string]any{
+		"message_id": "MABC12", "action_name": "LOGON", "caused_by": "MXYZ98",
+		"payload": "bob", "action_type": "INPUT", "action_direction": "IN",
+		"replay_id": int64(42), "virtual_time": int64(-1),
+	}
+	cases := []struct {
+		name    string
+		ours    wireMessage
+		decoded wireMessage
+		theirs  *dynamicpb.Message
+	}{
+		{"input", &grpcInput{Topic: "LOGON", Payload: "bob"}, &grpcInput{},
+			newDynamic(fd, "VisitorInput", map[string]any{"topic": "LOGON", "payload": "bob"})},
+		{"accepted", &grpcAccepted{MessageID: "MABC12", Topic: "LOGON"}, &grpcAccepted{},
+			newDynamic(fd, "Accepted", map[string]any{"message_id": "MABC12", "topic": "LOGON"})},
+		{"visitor", &grpcVisitor{MessageID: "MABC12", ActionName: "LOGON", CausedBy: "MXYZ98", Payload: "bob", ActionType: "INPUT", ActionDirection: "IN", ReplayID: 42, VirtualTime: -1},
+			&grpcVisitor{}, newDynamic(fd, "Visitor", visitor)},
+		{"rejected event", &grpcStreamEvent{Rejected: &grpcRejected{Topic: "NOPE", Error: "no handler"}}, &grpcStreamEvent{},
+			newDynamic(fd, "StreamEvent", map[string]any{"rejected": newDynamic(fd, "Rejected", map[string]any{"topic": "NOPE", "error": "no handler"})})},
+		{"output event", &grpcStreamEvent{Output: &grpcVisitor{MessageID: "MABC12", ActionName: "LOGON", CausedBy: "MXYZ98", Payload: "bob", ActionType: "INPUT", ActionDirection: "IN", ReplayID: 42, VirtualTime: -1}},
+			&grpcStreamEvent{}, newDynamic(fd, "StreamEvent", map[string]any{"output": newDynamic(fd, "Visitor", visitor)})},
+		{"empty input", &grpcInput{}, &grpcInput{}, newDynamic(fd, "VisitorInput", nil)},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// what we encode, proto decodes to the same message
+			got := dynamicpb.NewMessage(c.theirs.Descriptor())
+			if err := proto.Unmarshal(c.ours.marshalWire(), got); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(got, c.theirs) {
+				t.Errorf("proto decoded %v, want %v", got, c.theirs)
+			}
+
+			// and what proto encodes, we decode to the message we started from
+			encoded, err := proto.Marshal(c.theirs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = c.decoded.unmarshalWire(encoded); err != nil {
+				t.Fatal(err)
+			}
+			if string(c.decoded.marshalWire()) != string(c.ours.marshalWire()) {
+				t.Errorf("decoded %+v, want %+v", c.decoded, c.ours)
+			}
+		})
+	}
+}
+
+func TestWireCodecSkipsUnknownFields(t *testing.T) {
+	b := protowire.AppendTag(nil, 9, protowire.VarintType)
+	b = protowire.AppendVarint(b, 7)
+	b = append(b, (&grpcInput{Topic: "LOGON", Payload: "bob"}).marshalWire()...)
+	b = protowire.AppendTag(b, 10, protowire.BytesType)
+	b = protowire.AppendString(b, "from a newer client")
+
+	in := &grpcInput{}
+	if err := in.unmarshalWire(b); err != nil {
+		t.Fatal(err)
+	}
+	if in.Topic != "LOGON" || in.Payload != "bob" {
+		t.Errorf("decoded %+v, want LOGON and bob", in)
+	}
+
+	if err := in.unmarshalWire(b[:len(b)-3]); err == nil {
+		t.Error("decoding a truncated message succeeded")
+	}
+}
+
+// dialIngress serves the ingress of a running tunnel over an in-memory
+// listener and returns a client connection to it
+func dialIngress(t *testing.T) (*grpc.ClientConn, *Tunnel) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	actionLogger := openSQLiteActionLogger(filepath.Join(t.TempDir(), "grpc.db"))
+	t.Cleanup(func() { actionLogger.Close() })
+	tunnel := NewNormalTunnel(actionLogger, logger, false)
+	ts := &TunnelSystem{mainEntrance: tunnel, logger: logger}
+	go ts.pass(tunnel)
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.ForceServerCodec(wireCodec{}))
+	server.RegisterService(&ingressServiceDesc, &grpcIngress{tunnel: tunnel, gen: NewConnectionInputGenerator(nil), logger: logger})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(wireCodec{})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, tunnel
+}
+
+func TestGRPCSubmit(t *testing.T) {
+	conn, tunnel := dialIngress(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	accepted := &grpcAccepted{}
+	if err := conn.Invoke(ctx, "/fund78.v1.Ingress/Submit", &grpcInput{Topic: string(LOGON), Payload: "bob"}, accepted); err != nil {
+		t.Fatal(err)
+	}
+	if accepted.MessageID == "" || accepted.Topic != string(LOGON) {
+		t.Errorf("accepted %+v, want a message ID and LOGON", accepted)
+	}
+
+	tunnel.waitHandled(1)
+	rows, err := tunnel.actionLogger.GetMessagesByReplayID(tunnel.replayId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 || rows[0].MessageID != accepted.MessageID || rows[0].Payload != "bob" {
+		t.Errorf("logged %+v, want the accepted visitor first", rows)
+	}
+
+	err = conn.Invoke(ctx, "/fund78.v1.Ingress/Submit", &grpcInput{Topic: "NO_SUCH_TOPIC"}, &grpcAccepted{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("submitting an unknown topic returned %v, want InvalidArgument", err)
+	}
+}
+
+func TestGRPCStream(t *testing.T) {
+	conn, _ := dialIngress(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := conn.NewStream(ctx, &ingressServiceDesc.Streams[0], "/fund78.v1.Ingress/Stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range []*grpcInput{{Topic: string(LOGON), Payload: "bob"}, {Topic: "NO_SUCH_TOPIC"}} {
+		if err = stream.SendMsg(in); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+
+	var accepted, output, rejected []string
+	for {
+		event := &grpcStreamEvent{}
+		err = stream.RecvMsg(event)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case event.Accepted != nil:
+			accepted = append(accepted, event.Accepted.MessageID)
+		case event.Output != nil:
+			output = append(output, event.Output.MessageID)
+		case event.Rejected != nil:
+			rejected = append(rejected, event.Rejected.Topic)
+		}
+	}
+
+	if len(accepted) != 1 {
+		t.Fatalf("accepted %v, want one input", accepted)
+	}
+	// the stream ends once the accepted input has exited
+	if len(output) != 1 || output[0] != accepted[0] {
+		t.Errorf("streamed outputs %v, want [%s]", output, accepted[0])
+	}
+	if len(rejected) != 1 || rejected[0] != "NO_SUCH_TOPIC" {
+		t.Errorf("rejected %v, want [NO_SUCH_TOPIC]", rejected)
+	}
+}
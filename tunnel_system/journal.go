@@ -0,0 +1,590 @@
+package tunnel_system
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy is when the journal forces appended records to disk
+type FsyncPolicy string
+
+const (
+	// FSYNC_ALWAYS syncs after every record: nothing acknowledged is lost
+	FSYNC_ALWAYS FsyncPolicy = "always"
+	// FSYNC_INTERVAL syncs every FsyncInterval: a crash loses at most that much
+	FSYNC_INTERVAL FsyncPolicy = "interval"
+	// FSYNC_NEVER leaves syncing to the operating system
+	FSYNC_NEVER FsyncPolicy = "never"
+)
+
+// JournalConfig describes an append-only action journal. The zero values of
+// the optional fields mean 64 MiB segments synced every 100ms.
+type JournalConfig struct {
+	Dir           string
+	SegmentSize   int64
+	Fsync         FsyncPolicy
+	FsyncInterval time.Duration
+}
+
+const (
+	defaultSegmentSize   = 64 << 20
+	defaultFsyncInterval = 100 * time.Millisecond
+)
+
+// Journal keeps action rows in segment files of JSON lines, each preceded by
+// the CRC-32 of its JSON: "1a2b3c4d {...}". A segment is named after the ID
+// of its first record and, once the next one starts, gets an index file
+// listing where every replay's records are in it, so opening the journal
+// reads only the last segment.
+//
+// A record cut short by a crash can only be the last one; opening the journal
+// drops it. A record failing its CRC anywhere else is corruption and fails
+// the read that meets it.
+//
+// One process at a time opens a journal; the CLIs working on it refuse to
+// while the engine runs.
+type Journal struct {
+	config JournalConfig
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	segments []journalSegment
+	active   *os.File
+	size     int64
+	nextID   int64
+	dirty    bool
+	// index locates the records of every replay in all segments;
+	// activeIndex those in the active segment, written out when it is sealed
+	index       map[int64][]journalLocation
+	activeIndex map[int64][]journalLocation
+	// forgotten are the replays deleted from the journal, whose records stay
+	// in segments shared with replays that are kept
+	forgotten map[int64]bool
+	// lock keeps other processes out of the directory while it is open
+	lock *os.File
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type journalSegment struct {
+	firstID int64
+	path    string
+}
+
+type journalLocation struct {
+	Segment int64 `json:"s"`
+	Offset  int64 `json:"o"`
+	Length  int64 `json:"l"`
+}
+
+func OpenJournal(config JournalConfig, logger *slog.Logger) (*Journal, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("journal directory is required")
+	}
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = defaultSegmentSize
+	}
+	if config.Fsync == "" {
+		config.Fsync = FSYNC_INTERVAL
+	}
+	switch config.Fsync {
+	case FSYNC_ALWAYS, FSYNC_INTERVAL, FSYNC_NEVER:
+	default:
+		return nil, fmt.Errorf("unknown fsync policy %q", config.Fsync)
+	}
+	if config.FsyncInterval <= 0 {
+		config.FsyncInterval = defaultFsyncInterval
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := lockJournal(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		lock:        lock,
+		config:      config,
+		logger:      logger.With("component", "journal"),
+		nextID:      1,
+		index:       make(map[int64][]journalLocation),
+		activeIndex: make(map[int64][]journalLocation),
+		forgotten:   make(map[int64]bool),
+	}
+	if err := j.load(); err != nil {
+		j.unlock()
+		return nil, err
+	}
+	if config.Fsync == FSYNC_INTERVAL {
+		j.stop, j.done = make(chan struct{}), make(chan struct{})
+		go j.syncLoop()
+	}
+	j.logger.Info("opened action journal", "dir", config.Dir, "segments", len(j.segments), "next_id", j.nextID, "fsync", config.Fsync)
+	return j, nil
+}
+
+// load reads the index of the sealed segments and scans the last one
+func (j *Journal) load() error {
+	paths, err := filepath.Glob(filepath.Join(j.config.Dir, "*.jsonl"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		firstID, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), ".jsonl"), 10, 64)
+		if err != nil {
+			continue
+		}
+		j.segments = append(j.segments, journalSegment{firstID: firstID, path: path})
+	}
+	sort.Slice(j.segments, func(a, b int) bool { return j.segments[a].firstID < j.segments[b].firstID })
+	if err = j.loadForgotten(); err != nil {
+		return err
+	}
+
+	if len(j.segments) == 0 {
+		return j.startSegment()
+	}
+
+	for _, segment := range j.segments[:len(j.segments)-1] {
+		if err = j.loadSealed(segment); err != nil {
+			return err
+		}
+	}
+
+	last := j.segments[len(j.segments)-1]
+	j.nextID = last.firstID
+	valid, err := j.scan(last, func(row ActionRow, at journalLocation) {
+		j.activeIndex[row.ReplayID] = append(j.activeIndex[row.ReplayID], at)
+		j.nextID = row.ID + 1
+	})
+	if err != nil {
+		return err
+	}
+	if j.active, err = os.OpenFile(last.path, os.O_RDWR, 0644); err != nil {
+		return err
+	}
+	info, err := j.active.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > valid {
+		j.logger.Warn("dropping a torn record at the end of the journal", "segment", last.path, "offset", valid, "bytes", info.Size()-valid)
+		if err = j.active.Truncate(valid); err != nil {
+			return err
+		}
+	}
+	if _, err = j.active.Seek(valid, io.SeekStart); err != nil {
+		return err
+	}
+	j.size = valid
+	for replayID, locations := range j.activeIndex {
+		j.index[replayID] = append(j.index[replayID], locations...)
+	}
+	for replayID := range j.forgotten {
+		delete(j.index, replayID)
+		delete(j.activeIndex, replayID)
+	}
+	return nil
+}
+
+func (j *Journal) forgottenPath() string {
+	return filepath.Join(j.config.Dir, "forgotten.json")
+}
+
+func (j *Journal) loadForgotten() error {
+	data, err := os.ReadFile(j.forgottenPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var replayIDs []int64
+	if err = json.Unmarshal(data, &replayIDs); err != nil {
+		return fmt.Errorf("journal %s: %w", j.forgottenPath(), err)
+	}
+	for _, replayID := range replayIDs {
+		j.forgotten[replayID] = true
+	}
+	return nil
+}
+
+// loadSealed adds the index of a sealed segment, rebuilding a missing one
+func (j *Journal) loadSealed(segment journalSegment) error {
+	var locations map[int64][]journalLocation
+	data, err := os.ReadFile(indexPath(segment.path))
+	if err == nil {
+		err = json.Unmarshal(data, &locations)
+	}
+	if err != nil {
+		locations = make(map[int64][]journalLocation)
+		valid, scanErr := j.scan(segment, func(row ActionRow, at journalLocation) {
+			locations[row.ReplayID] = append(locations[row.ReplayID], at)
+		})
+		if scanErr != nil {
+			return scanErr
+		}
+		if info, statErr := os.Stat(segment.path); statErr == nil && info.Size() > valid {
+			return fmt.Errorf("journal segment %s is corrupt at offset %d", segment.path, valid)
+		}
+		if err = writeIndex(segment.path, locations); err != nil {
+			return err
+		}
+	}
+	for replayID, at := range locations {
+		j.index[replayID] = append(j.index[replayID], at...)
+	}
+	return nil
+}
+
+// scan calls fn with every intact record of a segment and returns the offset
+// after the last of them. Only the last record may be torn; a bad record
+// followed by others is corruption.
+func (j *Journal) scan(segment journalSegment, fn func(row ActionRow, at journalLocation)) (int64, error) {
+	in, err := os.Open(segment.path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	reader := bufio.NewReader(in)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		row, err := decodeRecord(line)
+		if err != nil {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				return offset, nil
+			}
+			return offset, fmt.Errorf("journal segment %s is corrupt at offset %d: %w", segment.path, offset, err)
+		}
+		fn(row, journalLocation{Segment: segment.firstID, Offset: offset, Length: int64(len(line))})
+		offset += int64(len(line))
+	}
+}
+
+func indexPath(segmentPath string) string {
+	return strings.TrimSuffix(segmentPath, ".jsonl") + ".idx"
+}
+
+func writeIndex(segmentPath string, locations map[int64][]journalLocation) error {
+	data, err := json.Marshal(locations)
+	if err != nil {
+		return err
+	}
+	tmp := indexPath(segmentPath) + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, indexPath(segmentPath))
+}
+
+func encodeRecord(row ActionRow) ([]byte, error) {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, 0, len(data)+10)
+	record = append(record, fmt.Sprintf("%08x ", crc32.ChecksumIEEE(data))...)
+	record = append(record, data...)
+	return append(record, '\n'), nil
+}
+
+func decodeRecord(record []byte) (ActionRow, error) {
+	var row ActionRow
+	record = bytes.TrimSuffix(record, []byte{'\n'})
+	if len(record) < 10 || record[8] != ' ' {
+		return row, fmt.Errorf("malformed journal record")
+	}
+	sum, err := strconv.ParseUint(string(record[:8]), 16, 32)
+	if err != nil {
+		return row, fmt.Errorf("malformed journal record checksum")
+	}
+	data := record[9:]
+	if crc32.ChecksumIEEE(data) != uint32(sum) {
+		return row, fmt.Errorf("journal record fails its CRC")
+	}
+	err = json.Unmarshal(data, &row)
+	return row, err
+}
+
+// startSegment opens a new segment starting at the next record ID
+func (j *Journal) startSegment() error {
+	path := filepath.Join(j.config.Dir, fmt.Sprintf("%020d.jsonl", j.nextID))
+	active, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.active, j.size = active, 0
+	j.segments = append(j.segments, journalSegment{firstID: j.nextID, path: path})
+	j.activeIndex = make(map[int64][]journalLocation)
+	return nil
+}
+
+// rotate seals the active segment and starts the next one
+func (j *Journal) rotate() error {
+	if err := j.active.Sync(); err != nil {
+		return err
+	}
+	if err := j.active.Close(); err != nil {
+		return err
+	}
+	if err := writeIndex(j.segments[len(j.segments)-1].path, j.activeIndex); err != nil {
+		return err
+	}
+	j.dirty = false
+	return j.startSegment()
+}
+
+func (j *Journal) appendAction(tx *sql.Tx, row ActionRow) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	row.ID = j.nextID
+	row.CreatedAt = time.Now().Unix()
+	record, err := encodeRecord(row)
+	if err != nil {
+		return err
+	}
+	if j.size > 0 && j.size+int64(len(record)) > j.config.SegmentSize {
+		if err = j.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err = j.active.Write(record); err != nil {
+		return err
+	}
+
+	at := journalLocation{Segment: j.segments[len(j.segments)-1].firstID, Offset: j.size, Length: int64(len(record))}
+	j.index[row.ReplayID] = append(j.index[row.ReplayID], at)
+	j.activeIndex[row.ReplayID] = append(j.activeIndex[row.ReplayID], at)
+	j.size += int64(len(record))
+	j.nextID++
+
+	if j.config.Fsync == FSYNC_ALWAYS {
+		return j.active.Sync()
+	}
+	j.dirty = true
+	return nil
+}
+
+func (j *Journal) syncLoop() {
+	defer close(j.done)
+	ticker := time.NewTicker(j.config.FsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := j.sync(); err != nil {
+			j.logger.Error("syncing the journal failed", "error", err)
+		}
+	}
+}
+
+// sync forces the records appended since the last sync to disk, for callers
+// that cannot wait for the next interval
+func (j *Journal) sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.dirty {
+		return nil
+	}
+	j.dirty = false
+	return j.active.Sync()
+}
+
+func (j *Journal) eachAction(replayID int64, fn func(row ActionRow) error) error {
+	j.mu.Lock()
+	locations := append([]journalLocation(nil), j.index[replayID]...)
+	j.mu.Unlock()
+	return j.read(locations, fn)
+}
+
+func (j *Journal) countActions(replayID int64) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.index[replayID]), nil
+}
+
+// read calls fn with the records at locations, opening each segment once
+func (j *Journal) read(locations []journalLocation, fn func(row ActionRow) error) error {
+	var file *os.File
+	var open int64 = -1
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	var record []byte
+	for _, at := range locations {
+		if at.Segment != open {
+			if file != nil {
+				file.Close()
+			}
+			var err error
+			if file, err = os.Open(j.segmentPath(at.Segment)); err != nil {
+				return err
+			}
+			open = at.Segment
+		}
+		if int64(cap(record)) < at.Length {
+			record = make([]byte, at.Length)
+		}
+		record = record[:at.Length]
+		if _, err := file.ReadAt(record, at.Offset); err != nil {
+			return fmt.Errorf("reading journal segment %d at %d: %w", at.Segment, at.Offset, err)
+		}
+		row, err := decodeRecord(record)
+		if err != nil {
+			return fmt.Errorf("journal segment %d at %d: %w", at.Segment, at.Offset, err)
+		}
+		if err = fn(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *Journal) segmentPath(firstID int64) string {
+	return filepath.Join(j.config.Dir, fmt.Sprintf("%020d.jsonl", firstID))
+}
+
+// recentActions reads the segments from the newest back until it has limit rows
+func (j *Journal) recentActions(limit int) ([]ActionRow, error) {
+	j.mu.Lock()
+	segments := append([]journalSegment(nil), j.segments...)
+	size := j.size
+	forgotten := make(map[int64]bool, len(j.forgotten))
+	for replayID := range j.forgotten {
+		forgotten[replayID] = true
+	}
+	j.mu.Unlock()
+
+	var recent []ActionRow
+	for i := len(segments) - 1; i >= 0 && len(recent) < limit; i-- {
+		var rows []ActionRow
+		_, err := j.scan(segments[i], func(row ActionRow, at journalLocation) {
+			// records appended after the snapshot of the segment list wait for the next call
+			if (i < len(segments)-1 || at.Offset < size) && !forgotten[row.ReplayID] {
+				rows = append(rows, row)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		recent = append(rows, recent...)
+	}
+	if len(recent) > limit {
+		recent = recent[len(recent)-limit:]
+	}
+	return recent, nil
+}
+
+// deleteReplays forgets the replays and removes the sealed segments that hold
+// no other records. A segment shared with a kept replay stays until that one
+// is deleted as well.
+func (j *Journal) deleteReplays(tx *sql.Tx, replayIDs []int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, replayID := range replayIDs {
+		j.forgotten[replayID] = true
+		delete(j.index, replayID)
+		delete(j.activeIndex, replayID)
+	}
+	forgotten := make([]int64, 0, len(j.forgotten))
+	for replayID := range j.forgotten {
+		forgotten = append(forgotten, replayID)
+	}
+	sort.Slice(forgotten, func(a, b int) bool { return forgotten[a] < forgotten[b] })
+	data, err := json.Marshal(forgotten)
+	if err != nil {
+		return err
+	}
+	tmp := j.forgottenPath() + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, j.forgottenPath()); err != nil {
+		return err
+	}
+
+	live := make(map[int64]bool)
+	for _, locations := range j.index {
+		for _, at := range locations {
+			live[at.Segment] = true
+		}
+	}
+	kept := make([]journalSegment, 0, len(j.segments))
+	for i, segment := range j.segments {
+		if i == len(j.segments)-1 || live[segment.firstID] {
+			kept = append(kept, segment)
+			continue
+		}
+		if err = os.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err = os.Remove(indexPath(segment.path)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		j.logger.Info("removed journal segment", "segment", segment.path)
+	}
+	j.segments = kept
+	return nil
+}
+
+func (j *Journal) deleteActions(tx *sql.Tx, ids []int64) (int64, error) {
+	return 0, fmt.Errorf("the journal cannot delete single actions, only whole replays")
+}
+
+func (j *Journal) deletesActions() bool {
+	return false
+}
+
+func (j *Journal) close() error {
+	if j.stop != nil {
+		close(j.stop)
+		<-j.done
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	defer j.unlock()
+	if err := j.active.Sync(); err != nil {
+		return err
+	}
+	return j.active.Close()
+}
+
+func journalLockPath(dir string) string {
+	return filepath.Join(dir, "journal.lock")
+}
+
+// unlock lets other processes open the journal again
+func (j *Journal) unlock() {
+	unlockJournal(j.config.Dir, j.lock)
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package tunnel_system
+
+import (
+	"fmt"
+	"os"
+)
+
+// lockJournal takes an exclusive lock on the journal directory with a lock
+// file only one process can create. A process that crashed leaves it behind,
+// to be removed by hand.
+func lockJournal(dir string) (*os.File, error) {
+	path := journalLockPath(dir)
+	lock, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("journal %s is in use by another process; stop the engine first, or remove %s if none runs", dir, path)
+	}
+	return lock, err
+}
+
+func unlockJournal(dir string, lock *os.File) {
+	lock.Close()
+	os.Remove(journalLockPath(dir))
+}
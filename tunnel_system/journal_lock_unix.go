@@ -0,0 +1,33 @@
+//go:build unix
+
+package tunnel_system
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockJournal takes an exclusive lock on the journal directory, so a CLI
+// cannot truncate or rewrite a journal a running engine appends to
+func lockJournal(dir string) (*os.File, error) {
+	path := journalLockPath(dir)
+	lock, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("journal %s is in use by another process; stop the engine first", dir)
+		}
+		return nil, fmt.Errorf("locking journal %s: %w", dir, err)
+	}
+	return lock, nil
+}
+
+// unlockJournal releases the lock. The file stays, as removing it would let a
+// process waiting on the old file and one creating a new file both lock.
+func unlockJournal(dir string, lock *os.File) {
+	lock.Close()
+}
@@ -0,0 +1,116 @@
+package tunnel_system
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A running replay is leased to the process running it, so engines sharing an
+// action log recover, abort and adopt only what a stopped process left
+// behind. The process renews its leases every replayLeaseRenewal; a lease not
+// renewed for replayLeaseTTL has expired.
+const (
+	replayLeaseTTL     = time.Minute
+	replayLeaseRenewal = 15 * time.Second
+)
+
+// processStarted tells the leases this process took from those an earlier
+// process with the same pid left
+var processStarted = time.Now()
+
+// replayLease is who holds a running replay and when they last renewed it
+type replayLease struct {
+	replayID    int64
+	owner       string
+	heartbeatAt int64
+}
+
+// processOwner names this process in its leases, as host/pid
+func processOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
+
+// leaseExpired tells whether the owner of a lease is gone: it stopped renewing
+// it, or it ran on this host under a pid that no longer runs or that this
+// process started with since. Leases from before owners were recorded have
+// expired.
+func (fx *ActionLogger) leaseExpired(lease replayLease, now time.Time) bool {
+	if lease.heartbeatAt < now.Add(-replayLeaseTTL).Unix() {
+		return true
+	}
+	host, pid, found := strings.Cut(lease.owner, "/")
+	ownHost, _, _ := strings.Cut(fx.owner, "/")
+	if !found || host != ownHost {
+		return false
+	}
+	if lease.owner == fx.owner {
+		return lease.heartbeatAt < processStarted.Unix()
+	}
+	n, err := strconv.Atoi(pid)
+	return err == nil && !processAlive(n)
+}
+
+// runningLeases returns the leases of the running normal runs, or of the
+// running reruns, newest first
+func (fx *ActionLogger) runningLeases(reruns bool) ([]replayLease, error) {
+	sqlText := "SELECT id, owner, heartbeat_at FROM replay_input WHERE status = ? AND parent_replay_id IS NULL ORDER BY id DESC;"
+	if reruns {
+		sqlText = "SELECT id, owner, heartbeat_at FROM replay_input WHERE status = ? AND parent_replay_id IS NOT NULL ORDER BY id DESC;"
+	}
+	rows, err := fx.query(sqlText, string(REPLAY_RUNNING))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	leases := make([]replayLease, 0)
+	for rows.Next() {
+		var lease replayLease
+		if err = rows.Scan(&lease.replayID, &lease.owner, &lease.heartbeatAt); err != nil {
+			return nil, err
+		}
+		leases = append(leases, lease)
+	}
+	return leases, rows.Err()
+}
+
+// RenewLeases extends the leases of the running replays this process holds
+func (fx *ActionLogger) RenewLeases(now time.Time) error {
+	_, err := fx.exec("UPDATE replay_input SET heartbeat_at = ? WHERE owner = ? AND status = ?;", now.Unix(), fx.owner, string(REPLAY_RUNNING))
+	return err
+}
+
+// ClaimUnfinishedRun takes over the latest normal run whose owner stopped
+// without shutting it down, or returns nil when there is none. Of engines
+// starting together, only one claims a run.
+func (fx *ActionLogger) ClaimUnfinishedRun() (*Replay, error) {
+	now := time.Now()
+	leases, err := fx.runningLeases(false)
+	if err != nil {
+		return nil, err
+	}
+	for _, lease := range leases {
+		if !fx.leaseExpired(lease, now) {
+			continue
+		}
+		result, err := fx.exec("UPDATE replay_input SET owner = ?, heartbeat_at = ? WHERE id = ? AND status = ? AND owner = ? AND heartbeat_at = ?;", fx.owner, now.Unix(), lease.replayID, string(REPLAY_RUNNING), lease.owner, lease.heartbeatAt)
+		if err != nil {
+			return nil, err
+		}
+		claimed, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if claimed == 1 {
+			return fx.GetReplay(lease.replayID)
+		}
+	}
+	return nil, nil
+}
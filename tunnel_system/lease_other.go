@@ -0,0 +1,9 @@
+//go:build !unix
+
+package tunnel_system
+
+// processAlive cannot tell here, so a lease of this host lasts until it
+// expires like any other
+func processAlive(pid int) bool {
+	return true
+}
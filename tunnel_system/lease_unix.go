@@ -0,0 +1,28 @@
+//go:build unix
+
+package tunnel_system
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// processAlive tells whether a process of this host still runs. A zombie
+// left for its parent to reap has stopped running.
+func processAlive(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return true
+	}
+	// the state follows the command, which is in parentheses and may hold any
+	if end := bytes.LastIndexByte(stat, ')'); end >= 0 && end+2 < len(stat) {
+		state := stat[end+2]
+		return state != 'Z' && state != 'X'
+	}
+	return true
+}
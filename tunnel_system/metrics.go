@@ -0,0 +1,260 @@
+package tunnel_system
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// engineMetrics holds every metric the engine exports on /metrics
+var engineMetrics = newEngineMetricSet()
+
+type engineMetricSet struct {
+	registry         *metricsRegistry
+	visitorsEntered  *counterVec
+	visitorsExited   *counterVec
+	queueDepth       *gaugeVec
+	handlerDuration  *histogramVec
+	dbInsertDuration *histogramVec
+	rerunBatchSize   *histogramVec
+	dbBatchSize      *histogramVec
+	generatorEmits   *counterVec
+	sinkDeliveries   *counterVec
+	sinkDuration     *histogramVec
+	duplicateInputs  *counterVec
+}
+
+var (
+	latencyBuckets   = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+	batchSizeBuckets = []float64{1, 10, 50, 100, 500, 1000, 5000, 10000, 100000}
+)
+
+func newEngineMetricSet() *engineMetricSet {
+	r := &metricsRegistry{}
+	return &engineMetricSet{
+		registry:         r,
+		visitorsEntered:  r.counter("fund78_visitors_entered_total", "Visitors entered into a tunnel.", "tunnel", "action_name", "action_type"),
+		visitorsExited:   r.counter("fund78_visitors_exited_total", "Visitors exited from a tunnel.", "tunnel", "action_name", "action_type"),
+		queueDepth:       r.gauge("fund78_tunnel_queue_depth", "Visitors waiting in a tunnel queue.", "tunnel"),
+		handlerDuration:  r.histogram("fund78_handler_duration_seconds", "Time spent handling a visitor.", latencyBuckets, "tunnel", "action_name"),
+		dbInsertDuration: r.histogram("fund78_db_insert_duration_seconds", "Time spent inserting a row into the action log.", latencyBuckets, "table"),
+		rerunBatchSize:   r.histogram("fund78_rerun_batch_size", "Actions re-queued by a single rerun.", batchSizeBuckets),
+		dbBatchSize:      r.histogram("fund78_db_batch_size", "Writes committed together in one action log batch.", batchSizeBuckets),
+		generatorEmits:   r.counter("fund78_generator_emits_total", "Inputs emitted by input generators.", "generator", "topic"),
+		sinkDeliveries:   r.counter("fund78_sink_deliveries_total", "Delivery attempts of sinks by outcome.", "sink", "outcome"),
+		sinkDuration:     r.histogram("fund78_sink_delivery_duration_seconds", "Time spent in a single sink delivery attempt.", latencyBuckets, "sink"),
+		duplicateInputs:  r.counter("fund78_duplicate_inputs_total", "Inputs dropped because their idempotency key was already used.", "tunnel", "action_name"),
+	}
+}
+
+func (m *engineMetricSet) WritePrometheus(w io.Writer) {
+	m.registry.write(w)
+}
+
+// metricsRegistry renders its metrics in the Prometheus text exposition format
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func (r *metricsRegistry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *metricsRegistry) write(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func (r *metricsRegistry) counter(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]*series)}
+	r.register(c)
+	return c
+}
+
+func (r *metricsRegistry) gauge(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{name: name, help: help, labels: labels, values: make(map[string]*series)}
+	r.register(g)
+	return g
+}
+
+func (r *metricsRegistry) histogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramSeries)}
+	r.register(h)
+	return h
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*series
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) Add(delta float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.values[seriesKey(labelValues)]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		c.values[seriesKey(labelValues)] = s
+	}
+	s.value += delta
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeSeries(w, c.name, c.help, "counter", c.labels, c.values)
+}
+
+type gaugeVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*series
+}
+
+func (g *gaugeVec) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.values[seriesKey(labelValues)]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		g.values[seriesKey(labelValues)] = s
+	}
+	s.value = value
+}
+
+func (g *gaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	writeSeries(w, g.name, g.help, "gauge", g.labels, g.values)
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramSeries
+}
+
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.values[seriesKey(labelValues)]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[seriesKey(labelValues)] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// ObserveSince records the seconds elapsed since start
+func (h *histogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range sortedKeys(h.values) {
+		s := h.values[key]
+		for i, bound := range h.buckets {
+			labels := formatLabels(bucketLabels, append(append([]string(nil), s.labelValues...), formatFloat(bound)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, s.counts[i])
+		}
+		labels := formatLabels(bucketLabels, append(append([]string(nil), s.labelValues...), "+Inf"))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labelValues), s.count)
+	}
+}
+
+func writeSeries(w io.Writer, name, help, kind string, labels []string, values map[string]*series) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	for _, key := range sortedKeys(values) {
+		s := values[key]
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels, s.labelValues), formatFloat(s.value))
+	}
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\x00")
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		parts[i] = name + `="` + labelEscaper.Replace(value) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,531 @@
+package tunnel_system
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+type FailurePredicate string
+
+const (
+	FAIL_DIVERGENCE  FailurePredicate = "divergence"
+	FAIL_DEAD_LETTER FailurePredicate = "dead_letter"
+	FAIL_STATE       FailurePredicate = "state"
+)
+
+// sandboxReplayID is the replay ID visitors carry while handled in a sandbox
+const sandboxReplayID int64 = -1
+
+// MinimizeOptions describes the failure a minimization has to preserve
+type MinimizeOptions struct {
+	Predicate FailurePredicate
+	// Assertion must hold on the application state after every visitor;
+	// FAIL_STATE reproduces when it is violated
+	Assertion *PayloadPredicate
+	// DeadLetterTopic narrows FAIL_DEAD_LETTER to visitors of one topic
+	DeadLetterTopic string
+	// Diff decides what counts as a divergence for FAIL_DIVERGENCE
+	Diff      DiffOptions
+	MaxTrials int
+	Name      string
+}
+
+type MinimizeResult struct {
+	ReplayID      int64            `json:"replay_id"`
+	Predicate     FailurePredicate `json:"predicate"`
+	InputCount    int              `json:"input_count"`
+	MinimalCount  int              `json:"minimal_count"`
+	Trials        int              `json:"trials"`
+	MessageIDs    []string         `json:"message_ids"`
+	ChildReplayID int64            `json:"child_replay_id,omitempty"`
+	ChildName     string           `json:"child_name,omitempty"`
+	// Status is the status of the child replay: running while the engine
+	// still minimizes, aborted when minimizing failed
+	Status ReplayStatus `json:"status,omitempty"`
+}
+
+// ParseMinimizeOptions builds options from the HTTP and CLI parameters
+func ParseMinimizeOptions(predicate string, assertion string, deadLetterTopic string, ignore string, name string) (MinimizeOptions, error) {
+	opts := MinimizeOptions{
+		Predicate:       FailurePredicate(predicate),
+		DeadLetterTopic: deadLetterTopic,
+		Diff:            DefaultDiffOptions(),
+		MaxTrials:       1000,
+		Name:            name,
+	}
+	opts.Diff.IgnoreFields = append(opts.Diff.IgnoreFields, ParseIgnoreFields(ignore)...)
+	// the sandbox handles each visitor before the next one enters, while the
+	// original run may have logged entries ahead of earlier exits
+	opts.Diff.GroupByMessage = true
+
+	switch opts.Predicate {
+	case FAIL_DIVERGENCE, FAIL_DEAD_LETTER:
+	case FAIL_STATE:
+		if assertion == "" {
+			return opts, fmt.Errorf("the state predicate needs an assertion such as logged_on.bob<2")
+		}
+		p, err := ParsePayloadPredicate(assertion)
+		if err != nil {
+			return opts, err
+		}
+		opts.Assertion = &p
+	default:
+		return opts, fmt.Errorf("unknown predicate %q, use divergence, dead_letter or state", predicate)
+	}
+	return opts, nil
+}
+
+// minimize reruns subsets of a replay's inputs through the side entrance
+// until it finds a minimal sequence that still reproduces the failure (delta
+// debugging). Every trial is a replay of its own under the minimized replay
+// childID, deleted once it is judged.
+func minimize(side *Tunnel, running bool, replayID int64, childID int64, opts MinimizeOptions) (MinimizeResult, []*Visitor, error) {
+	result := MinimizeResult{ReplayID: replayID, Predicate: opts.Predicate}
+
+	original, err := side.actionLogger.GetMessagesByReplayID(replayID)
+	if err != nil {
+		return result, nil, err
+	}
+	original = withoutAudit(original)
+	inputs := onePerMessage(NewVisitorsFromActionRows(original, childID))
+	result.InputCount = len(inputs)
+
+	trials := sideTrials{side: side, parentReplayID: childID, running: running}
+	var trialErr error
+	fails := func(subset []*Visitor) bool {
+		result.Trials++
+		run, err := trials.run(subset, opts.check())
+		if err != nil {
+			trialErr = err
+			return false
+		}
+		return opts.reproduces(original, subset, run)
+	}
+	if len(inputs) == 0 || !fails(inputs) {
+		if trialErr != nil {
+			return result, nil, trialErr
+		}
+		return result, nil, fmt.Errorf("replay %d does not reproduce the %s failure", replayID, opts.Predicate)
+	}
+
+	maxTrials := opts.MaxTrials
+	if maxTrials <= 0 {
+		maxTrials = 1000
+	}
+	minimal := ddmin(inputs, fails, func() bool { return trialErr != nil || result.Trials >= maxTrials })
+	if trialErr != nil {
+		return result, nil, trialErr
+	}
+
+	result.MinimalCount = len(minimal)
+	result.MessageIDs = make([]string, len(minimal))
+	for i, v := range minimal {
+		result.MessageIDs[i] = v.MessageId
+	}
+	return result, minimal, nil
+}
+
+// MinimizeReplay minimizes a replay outside of a running engine, on a fresh
+// side entrance, and saves the result as a child replay
+func MinimizeReplay(config Config, replayID int64, opts MinimizeOptions) (MinimizeResult, error) {
+	actionLogger := config.actionLogger(config.logger())
+	defer actionLogger.Close()
+	side := NewDebugTunnel(actionLogger, config.logger(), config.LogTicks)
+
+	result := MinimizeResult{ReplayID: replayID, Predicate: opts.Predicate, ChildName: opts.name(replayID)}
+	childID, err := actionLogger.InsertRerun(result.ChildName, replayID, "")
+	if err != nil {
+		return result, err
+	}
+	result, minimal, err := minimize(side, false, replayID, childID, opts)
+	if err != nil {
+		if deleteErr := actionLogger.deleteTree(replayTree{members: []Replay{{ID: childID}}}); deleteErr != nil {
+			err = fmt.Errorf("%w, and deleting replay %d failed: %v", err, childID, deleteErr)
+		}
+		return result, err
+	}
+
+	result.ChildReplayID, result.ChildName = childID, opts.name(replayID)
+	if err = saveMinimized(side, false, childID, result, minimal); err != nil {
+		return result, err
+	}
+	result.Status = REPLAY_FINISHED
+	return result, nil
+}
+
+func (o MinimizeOptions) name(replayID int64) string {
+	if o.Name != "" {
+		return o.Name
+	}
+	return fmt.Sprintf("Minimized %s of replay %d", o.Predicate, replayID)
+}
+
+// saveMinimized records what a minimization found on its child replay and
+// enters the minimal inputs through the side entrance. A running engine
+// handles them on its own; otherwise they are handled here one at a time.
+func saveMinimized(side *Tunnel, running bool, childID int64, result MinimizeResult, minimal []*Visitor) error {
+	actionLogger := side.actionLogger
+	if err := actionLogger.setReplayFilter(childID, ReplayFilter{MessageIDs: result.MessageIDs}.JSON()); err != nil {
+		return err
+	}
+	notes := fmt.Sprintf("Minimized %d inputs to %d in %d trials", result.InputCount, result.MinimalCount, result.Trials)
+	if err := actionLogger.SetReplayNotes(childID, notes); err != nil {
+		return err
+	}
+
+	visitors := make([]*Visitor, len(minimal))
+	for i, v := range minimal {
+		visitors[i] = NewVisitorFromActionRow(v.MessageId, string(v.ActionName), v.CausedBy, string(v.ActionType), string(v.ActionDirection), v.Payload, childID)
+		visitors[i].VirtualTime = v.VirtualTime
+	}
+
+	if running {
+		side.rerun(childID, visitors)
+		return nil
+	}
+	for _, v := range visitors {
+		if err := side.passThrough(v); err != nil {
+			return err
+		}
+	}
+	return actionLogger.SetReplayStatus(childID, REPLAY_FINISHED)
+}
+
+// check is the state check of a trial, nil unless the failure is a state
+// assertion
+func (o MinimizeOptions) check() func(*State) error {
+	if o.Assertion == nil {
+		return nil
+	}
+	return func(state *State) error {
+		doc, err := json.Marshal(state)
+		if err == nil && violates(*o.Assertion, string(doc)) {
+			return fmt.Errorf("assertion %s violated", o.Assertion)
+		}
+		return nil
+	}
+}
+
+func (o MinimizeOptions) reproduces(original []ActionRow, subset []*Visitor, run sandboxRun) bool {
+	switch o.Predicate {
+	case FAIL_DEAD_LETTER:
+		for _, v := range run.deadLetters {
+			if o.DeadLetterTopic == "" || string(v.ActionName) == o.DeadLetterTopic {
+				return true
+			}
+		}
+		return false
+	case FAIL_STATE:
+		return run.checkFailure != nil
+	default:
+		ids := make([]string, len(subset))
+		for i, v := range subset {
+			ids[i] = v.MessageId
+		}
+		expected := ReplayFilter{MessageIDs: ids}.Apply(original)
+		return !DiffActions(expected, run.rows, o.Diff).Identical
+	}
+}
+
+// sideTrials reruns the subsets a minimization tries through a side
+// entrance, logging them like any rerun, dead letters included
+type sideTrials struct {
+	side           *Tunnel
+	parentReplayID int64
+	// running tells the engine's loop drives the side entrance, so a trial
+	// waits for it instead of handling its visitors itself
+	running bool
+}
+
+// run handles a subset as a trial replay one visitor at a time, so check
+// sees the state after each of them, and reads back what the trial logged
+func (s sideTrials) run(subset []*Visitor, check func(*State) error) (run sandboxRun, err error) {
+	actionLogger := s.side.actionLogger
+	ids := make([]string, len(subset))
+	for i, v := range subset {
+		ids[i] = v.MessageId
+	}
+	trialID, err := actionLogger.InsertRerun(fmt.Sprintf("Minimization trial of replay %d", s.parentReplayID), s.parentReplayID, ReplayFilter{MessageIDs: ids}.JSON())
+	if err != nil {
+		return run, err
+	}
+	defer func() {
+		s.side.states.drop(trialID)
+		if statusErr := actionLogger.SetReplayStatus(trialID, REPLAY_FINISHED); err == nil {
+			err = statusErr
+		}
+		if err == nil {
+			err = actionLogger.deleteTree(replayTree{members: []Replay{{ID: trialID}}})
+		}
+	}()
+
+	for _, input := range subset {
+		v := NewVisitorFromActionRow(input.MessageId, string(input.ActionName), input.CausedBy, string(input.ActionType), string(input.ActionDirection), input.Payload, trialID)
+		v.VirtualTime = input.VirtualTime
+		if s.running {
+			s.side.Enter(v)
+			s.side.waitHandled(s.side.entered.Load())
+		} else if err = s.side.passThrough(v); err != nil {
+			return run, err
+		}
+		run.handled++
+
+		if check != nil {
+			if failure := check(s.side.State(trialID)); failure != nil {
+				run.checkFailure = failure
+				break
+			}
+		}
+	}
+
+	if run.rows, err = actionLogger.GetMessagesByReplayID(trialID); err != nil {
+		return run, err
+	}
+	for _, row := range run.rows {
+		if row.ActionType == string(DEAD_LETTER) {
+			run.deadLetters = append(run.deadLetters, NewVisitorFromActionRow(row.MessageID, row.Topic, row.CausedBy, row.MessageType, row.Direction, row.Payload, trialID))
+		}
+	}
+	return run, nil
+}
+
+type sandboxRun struct {
+	rows         []ActionRow
+	deadLetters  []*Visitor
+	checkFailure error
+	// handled counts the visitors handled before the run ended
+	handled int
+}
+
+func newSandboxTunnel() *Tunnel {
+	return &Tunnel{
+		name:   "sandbox",
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		states: newStateStore(),
+		timers: newMemoryTimers(),
+	}
+}
+
+// runSandbox handles visitors with the real handlers, recording the action
+// rows Enter and Exit would have written. The optional check runs on the
+// application state after each visitor and ends the run when it fails.
+func runSandbox(inputs []*Visitor, check func(*State) error) sandboxRun {
+	tunnel := newSandboxTunnel()
+	run := sandboxRun{rows: make([]ActionRow, 0, len(inputs)*2)}
+	tunnel.recordRow = func(row ActionRow) {
+		run.rows = append(run.rows, row)
+	}
+
+	for _, input := range inputs {
+		v := *input
+		v.ReplayId = sandboxReplayID
+		run.rows = append(run.rows, actionRowOf(&v, string(v.ActionType)))
+		run.handled++
+
+		out, failure := tunnel.handleSafely(&v)
+		if failure != "" {
+			dead := actionRowOf(&v, string(DEAD_LETTER))
+			dead.Payload = failure
+			run.rows = append(run.rows, dead)
+			run.deadLetters = append(run.deadLetters, &v)
+		} else if out != nil {
+			run.rows = append(run.rows, actionRowOf(out, string(out.ActionType)))
+		}
+
+		if check != nil {
+			if err := check(tunnel.State(sandboxReplayID)); err != nil {
+				run.checkFailure = err
+				return run
+			}
+		}
+	}
+	return run
+}
+
+// violates reports a failed state assertion. A value that does not exist yet
+// cannot violate an assertion, unless the assertion is that it exists.
+func violates(assertion PayloadPredicate, state string) bool {
+	if assertion.Match(state) {
+		return false
+	}
+	if assertion.Op == OP_EXISTS || assertion.Path == "" {
+		return true
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(state), &doc); err != nil {
+		return false
+	}
+	_, found := lookupJSONPath(doc, assertion.Path)
+	return found
+}
+
+// onePerMessage keeps the first visitor of every message, the one that
+// entered, so the exits logged under the same message ID are not inputs
+func onePerMessage(visitors []*Visitor) []*Visitor {
+	seen := make(map[string]bool, len(visitors))
+	inputs := make([]*Visitor, 0, len(visitors))
+	for _, v := range visitors {
+		if !seen[v.MessageId] {
+			seen[v.MessageId] = true
+			inputs = append(inputs, v)
+		}
+	}
+	return inputs
+}
+
+func (t *Tunnel) handleSafely(v *Visitor) (out *Visitor, failure string) {
+	defer func() {
+		if r := recover(); r != nil {
+			out, failure = nil, fmt.Sprint(r)
+		}
+	}()
+	return t.handle(v), ""
+}
+
+func actionRowOf(v *Visitor, actionType string) ActionRow {
+	return ActionRow{
+		ReplayID:    v.ReplayId,
+		MessageID:   v.MessageId,
+		Topic:       string(v.ActionName),
+		CausedBy:    v.CausedBy,
+		MessageType: string(v.ActionType),
+		Direction:   string(v.ActionDirection),
+		Payload:     v.Payload,
+		ActionType:  actionType,
+		VirtualTime: v.VirtualTime,
+	}
+}
+
+// ddmin is Zeller's delta debugging minimization: it tries ever smaller chunks
+// and their complements, keeping any subset that still fails
+func ddmin(inputs []*Visitor, fails func([]*Visitor) bool, exhausted func() bool) []*Visitor {
+	current := inputs
+	n := 2
+	for len(current) >= 2 && !exhausted() {
+		chunks := splitVisitors(current, n)
+		reduced := false
+
+		for _, chunk := range chunks {
+			if exhausted() {
+				return current
+			}
+			if fails(chunk) {
+				current = chunk
+				n = 2
+				reduced = true
+				break
+			}
+		}
+
+		if !reduced && n > 2 {
+			for i := range chunks {
+				if exhausted() {
+					return current
+				}
+				complement := make([]*Visitor, 0, len(current))
+				for j, chunk := range chunks {
+					if j != i {
+						complement = append(complement, chunk...)
+					}
+				}
+				if fails(complement) {
+					current = complement
+					n = n - 1
+					if n < 2 {
+						n = 2
+					}
+					reduced = true
+					break
+				}
+			}
+		}
+
+		if !reduced {
+			if n >= len(current) {
+				break
+			}
+			n = n * 2
+			if n > len(current) {
+				n = len(current)
+			}
+		}
+	}
+	return current
+}
+
+func splitVisitors(visitors []*Visitor, n int) [][]*Visitor {
+	chunks := make([][]*Visitor, 0, n)
+	start := 0
+	for i := 0; i < n; i++ {
+		end := start + (len(visitors)-start)/(n-i)
+		if end > start {
+			chunks = append(chunks, visitors[start:end])
+		}
+		start = end
+	}
+	return chunks
+}
+
+func (s *server) handleMinimizeReplay(w http.ResponseWriter, r *http.Request) {
+	var replayID int64
+	_, err := fmt.Sscanf(r.URL.Path, "/minimize/%d", &replayID)
+	if err != nil {
+		http.Error(w, "Invalid replay ID. Use /minimize/{id}?predicate=divergence|dead_letter|state", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	opts, err := ParseMinimizeOptions(query.Get("predicate"), query.Get("assert"), query.Get("topic"), query.Get("ignore"), query.Get("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if value := query.Get("max_trials"); value != "" {
+		if opts.MaxTrials, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "Invalid max_trials", http.StatusBadRequest)
+			return
+		}
+	}
+
+	side := s.tunnelSystem.sideEntrance
+	result := MinimizeResult{ReplayID: replayID, Predicate: opts.Predicate, ChildName: opts.name(replayID), Status: REPLAY_RUNNING}
+	if result.ChildReplayID, err = side.actionLogger.InsertRerun(result.ChildName, replayID, ""); err != nil {
+		http.Error(w, fmt.Sprintf("Error creating minimized replay: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// trials can take long, so the child replay reports how it went
+	go s.minimizeInBackground(replayID, result.ChildReplayID, opts)
+
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, result)
+}
+
+// minimizeInBackground minimizes a replay on the running side entrance. The
+// child replay is finished once the minimal inputs are handled, or aborted
+// with the reason in its notes.
+func (s *server) minimizeInBackground(replayID int64, childID int64, opts MinimizeOptions) {
+	side := s.tunnelSystem.sideEntrance
+	logger := s.tunnelSystem.logger.With("component", "server", "replay_id", replayID, "debug_replay_id", childID)
+
+	result, minimal, err := minimize(side, true, replayID, childID, opts)
+	if err == nil {
+		result.ChildReplayID, result.ChildName = childID, opts.name(replayID)
+		err = saveMinimized(side, true, childID, result, minimal)
+	}
+	if err != nil {
+		logger.Error("minimizing replay failed", "trials", result.Trials, "error", err)
+		if err = side.actionLogger.SetReplayNotes(childID, "Minimizing failed: "+err.Error()); err == nil {
+			err = side.actionLogger.SetReplayStatus(childID, REPLAY_ABORTED)
+		}
+		if err != nil {
+			logger.Error("marking the minimized replay aborted failed", "error", err)
+		}
+		return
+	}
+	logger.Info("replay minimized", "inputs", result.InputCount, "minimal", result.MinimalCount, "trials", result.Trials)
+}
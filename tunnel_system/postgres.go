@@ -0,0 +1,233 @@
+package tunnel_system
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// PostgresConfig points the action log at a PostgreSQL database shared by a
+// team instead of the local fund78db file. Zero pool settings keep the
+// defaults of database/sql, except for MaxOpenConns, which defaults to 10.
+type PostgresConfig struct {
+	DSN             string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// postgresMigrations build the schema of the SQLite action log in PostgreSQL,
+// one version per entry. Append new versions; never edit applied ones.
+var postgresMigrations = []string{
+	`
+CREATE TABLE IF NOT EXISTS replay_input (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    file_id TEXT NOT NULL,
+    version INTEGER NOT NULL,
+    parent_replay_id BIGINT REFERENCES replay_input(id),
+    filter TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'finished',
+    resumed_from BIGINT,
+    created_at BIGINT NOT NULL DEFAULT CAST(EXTRACT(EPOCH FROM now()) AS BIGINT)
+);
+CREATE TABLE IF NOT EXISTS action (
+    id BIGSERIAL PRIMARY KEY,
+    replay_id BIGINT NOT NULL,
+    message_id TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    caused_by TEXT NOT NULL,
+    message_type TEXT NOT NULL,
+    direction TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    action_type TEXT NOT NULL,
+    virtual_time BIGINT NOT NULL DEFAULT 0,
+    created_at BIGINT NOT NULL DEFAULT CAST(EXTRACT(EPOCH FROM now()) AS BIGINT)
+);
+CREATE TABLE IF NOT EXISTS timer (
+    id BIGSERIAL PRIMARY KEY,
+    replay_id BIGINT NOT NULL,
+    message_id TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    caused_by TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    fire_at BIGINT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    created_at BIGINT NOT NULL DEFAULT CAST(EXTRACT(EPOCH FROM now()) AS BIGINT)
+);
+CREATE INDEX IF NOT EXISTS timer_pending ON timer (replay_id, status, fire_at);
+CREATE TABLE IF NOT EXISTS generator_checkpoint (
+    name TEXT PRIMARY KEY,
+    value TEXT NOT NULL,
+    updated_at BIGINT NOT NULL DEFAULT CAST(EXTRACT(EPOCH FROM now()) AS BIGINT)
+);
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    replay_id BIGINT NOT NULL,
+    message_id TEXT NOT NULL,
+    sink TEXT NOT NULL,
+    visitor TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at BIGINT NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at BIGINT NOT NULL DEFAULT CAST(EXTRACT(EPOCH FROM now()) AS BIGINT),
+    delivered_at BIGINT,
+    UNIQUE (message_id, sink)
+);
+CREATE INDEX IF NOT EXISTS outbox_pending ON outbox (sink, status, id);
+CREATE TABLE IF NOT EXISTS idempotency_key (
+    key TEXT PRIMARY KEY,
+    replay_id BIGINT NOT NULL,
+    message_id TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    created_at BIGINT NOT NULL DEFAULT CAST(EXTRACT(EPOCH FROM now()) AS BIGINT)
+);
+CREATE INDEX IF NOT EXISTS idempotency_key_created ON idempotency_key (created_at);
+CREATE TABLE IF NOT EXISTS state_snapshot (
+    replay_id BIGINT PRIMARY KEY,
+    message_id TEXT NOT NULL,
+    state TEXT NOT NULL,
+    created_at BIGINT NOT NULL DEFAULT CAST(EXTRACT(EPOCH FROM now()) AS BIGINT)
+);
+`,
+	`
+ALTER TABLE replay_input ADD COLUMN IF NOT EXISTS pinned BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE replay_input ADD COLUMN IF NOT EXISTS compacted BOOLEAN NOT NULL DEFAULT FALSE;
+`,
+	`
+CREATE INDEX IF NOT EXISTS replay_input_parent ON replay_input (parent_replay_id);
+CREATE INDEX IF NOT EXISTS action_replay ON action (replay_id, id);
+CREATE INDEX IF NOT EXISTS action_message ON action (message_id);
+`,
+	`
+ALTER TABLE replay_input ADD COLUMN IF NOT EXISTS handler_version TEXT NOT NULL DEFAULT '';
+CREATE TABLE IF NOT EXISTS comparison_report (
+    id BIGSERIAL PRIMARY KEY,
+    original_replay_id BIGINT NOT NULL,
+    debug_replay_id BIGINT NOT NULL,
+    original_handler_version TEXT NOT NULL,
+    debug_handler_version TEXT NOT NULL,
+    filter TEXT NOT NULL DEFAULT '',
+    identical BOOLEAN NOT NULL,
+    first_divergence INTEGER,
+    original_actions INTEGER NOT NULL,
+    debug_actions INTEGER NOT NULL,
+    inserted INTEGER NOT NULL,
+    deleted INTEGER NOT NULL,
+    changed INTEGER NOT NULL,
+    created_at BIGINT NOT NULL DEFAULT CAST(EXTRACT(EPOCH FROM now()) AS BIGINT)
+);
+CREATE INDEX IF NOT EXISTS comparison_report_original ON comparison_report (original_replay_id, id);
+CREATE INDEX IF NOT EXISTS comparison_report_debug ON comparison_report (debug_replay_id, id);
+`,
+	`
+ALTER TABLE replay_input ADD COLUMN IF NOT EXISTS notes TEXT NOT NULL DEFAULT '';
+CREATE TABLE IF NOT EXISTS replay_tag (
+    replay_id BIGINT NOT NULL,
+    tag TEXT NOT NULL,
+    PRIMARY KEY (replay_id, tag)
+);
+CREATE INDEX IF NOT EXISTS replay_tag_tag ON replay_tag (tag);
+`,
+	`
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS delivery_key TEXT;
+UPDATE outbox SET delivery_key = message_id WHERE delivery_key IS NULL;
+ALTER TABLE outbox ALTER COLUMN delivery_key SET NOT NULL;
+ALTER TABLE outbox DROP CONSTRAINT IF EXISTS outbox_message_id_sink_key;
+CREATE UNIQUE INDEX IF NOT EXISTS outbox_delivery_key ON outbox (sink, delivery_key);
+`,
+	`
+ALTER TABLE state_snapshot ADD COLUMN IF NOT EXISTS handled_id BIGINT NOT NULL DEFAULT 0;
+CREATE TABLE IF NOT EXISTS handled_visitor (
+    id BIGSERIAL PRIMARY KEY,
+    replay_id BIGINT NOT NULL,
+    message_id TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS handled_visitor_replay ON handled_visitor (replay_id, id);
+`,
+	`
+ALTER TABLE replay_input ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT '';
+ALTER TABLE replay_input ADD COLUMN IF NOT EXISTS heartbeat_at BIGINT NOT NULL DEFAULT 0;
+`,
+}
+
+// postgresMigrationLock keeps teammates starting at the same time from
+// migrating the shared database twice
+const postgresMigrationLock = 7807801
+
+// NewPostgresActionLogger opens the action log in PostgreSQL and brings its
+// schema up to date
+func NewPostgresActionLogger(config PostgresConfig) (*ActionLogger, error) {
+	if config.DSN == "" {
+		return nil, fmt.Errorf("postgres DSN is required")
+	}
+	db, err := sql.Open("postgres", config.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxOpenConns <= 0 {
+		config.MaxOpenConns = 10
+	}
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	if config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	if config.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	}
+
+	if err = migratePostgres(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating the postgres action log failed: %w", err)
+	}
+
+	fx := &ActionLogger{db: db, dialect: postgresDialect, handlerVersion: buildHandlerVersion(), owner: processOwner()}
+	fx.actions = sqliteActions{fx: fx}
+	return fx, nil
+}
+
+// migratePostgres applies the migrations the database has not seen yet, each
+// in its own transaction
+func migratePostgres(db *sql.DB) error {
+	for {
+		applied, err := migratePostgresOnce(db)
+		if err != nil || !applied {
+			return err
+		}
+	}
+}
+
+// migratePostgresOnce applies the next migration the database has not seen,
+// if there is one, and reports whether it did
+func migratePostgresOnce(db *sql.DB) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("SELECT pg_advisory_xact_lock($1);", postgresMigrationLock); err != nil {
+		return false, err
+	}
+	if _, err = tx.Exec("CREATE TABLE IF NOT EXISTS schema_migration (version INTEGER PRIMARY KEY, applied_at BIGINT NOT NULL DEFAULT CAST(EXTRACT(EPOCH FROM now()) AS BIGINT));"); err != nil {
+		return false, err
+	}
+	var applied int
+	if err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migration;").Scan(&applied); err != nil {
+		return false, err
+	}
+	version := applied + 1
+	if version > len(postgresMigrations) {
+		return false, nil
+	}
+	if _, err = tx.Exec(postgresMigrations[version-1]); err != nil {
+		return false, fmt.Errorf("version %d: %w", version, err)
+	}
+	if _, err = tx.Exec("INSERT INTO schema_migration (version) VALUES ($1);", version); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,131 @@
+package tunnel_system
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+)
+
+// postgresDSN returns a database the test may write to: the one named by
+// FUND78_POSTGRES_DSN, or an embedded server that lives as long as the test.
+// The embedded server downloads its binaries on first use and, like any
+// Postgres, does not run as root; the test is skipped when it cannot start.
+func postgresDSN(t *testing.T) string {
+	t.Helper()
+	if dsn := os.Getenv("FUND78_POSTGRES_DSN"); dsn != "" {
+		return dsn
+	}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint32(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	dir := t.TempDir()
+	server := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+		Port(port).
+		Database("fund78").
+		RuntimePath(dir + "/runtime").
+		DataPath(dir + "/data").
+		StartTimeout(time.Minute).
+		Logger(io.Discard))
+	if err = server.Start(); err != nil {
+		t.Skipf("no Postgres to test against, set FUND78_POSTGRES_DSN: %v", err)
+	}
+	t.Cleanup(func() { server.Stop() })
+	return fmt.Sprintf("host=localhost port=%d user=postgres password=postgres dbname=fund78 sslmode=disable", port)
+}
+
+func TestPostgresMigrations(t *testing.T) {
+	dsn := postgresDSN(t)
+
+	for i := 0; i < 2; i++ {
+		actionLogger, err := NewPostgresActionLogger(PostgresConfig{DSN: dsn})
+		if err != nil {
+			t.Fatalf("opening the action log, time %d: %v", i+1, err)
+		}
+		actionLogger.Close()
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var version int
+	if err = db.QueryRow("SELECT MAX(version) FROM schema_migration;").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(postgresMigrations) {
+		t.Errorf("schema at version %d, want %d", version, len(postgresMigrations))
+	}
+}
+
+func TestPostgresActionLog(t *testing.T) {
+	actionLogger, err := NewPostgresActionLogger(PostgresConfig{DSN: postgresDSN(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer actionLogger.Close()
+
+	replayID, err := actionLogger.InsertRun("postgres test", generateFileName(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actionLogger.InsertAction(replayID, "M1", "TICK", "", string(INPUT), string(IN), "1", string(INPUT), 0)
+	windowStart := time.Now().Add(-time.Hour).Unix()
+	key := fmt.Sprintf("key-%d", replayID)
+	if _, duplicate := actionLogger.InsertActionOnce(key, windowStart, replayID, "M2", "TICK", "", string(INPUT), string(IN), "2", string(INPUT), 0); duplicate {
+		t.Fatal("first use of an idempotency key counted as a duplicate")
+	}
+	original, duplicate := actionLogger.InsertActionOnce(key, windowStart, replayID, "M3", "TICK", "", string(INPUT), string(IN), "3", string(INPUT), 0)
+	if !duplicate || original != "M2" {
+		t.Fatalf("second use of an idempotency key returned %q, %v", original, duplicate)
+	}
+	actionLogger.InsertHandledAction(replayID, "M2", "TICK", "", string(INPUT), string(IN), "2", string(INPUT), 0, "{}", []string{"a", "b"}, true)
+
+	rows, err := actionLogger.GetMessagesByReplayID(replayID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messageIDs []string
+	for _, row := range rows {
+		messageIDs = append(messageIDs, row.MessageID)
+	}
+	if fmt.Sprint(messageIDs) != "[M1 M2 M2]" {
+		t.Errorf("replay holds %v, want [M1 M2 M2]", messageIDs)
+	}
+
+	if err = actionLogger.SaveSnapshot(replayID, "M2", "{}"); err != nil {
+		t.Fatal(err)
+	}
+	handled, inSnapshot, err := actionLogger.handledVisitors(replayID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(handled) != "[M2]" || inSnapshot != 1 {
+		t.Errorf("handled %v with %d in the snapshot, want [M2] with 1", handled, inSnapshot)
+	}
+
+	pending, err := actionLogger.GetOutbox(OUTBOX_PENDING, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := 0
+	for _, entry := range pending {
+		if entry.ReplayID == replayID {
+			queued++
+		}
+	}
+	if queued != 2 {
+		t.Errorf("%d outbox entries pending, want 2", queued)
+	}
+}
@@ -0,0 +1,154 @@
+package tunnel_system
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type PredicateOp string
+
+const (
+	OP_EQ       PredicateOp = "eq"
+	OP_NE       PredicateOp = "ne"
+	OP_CONTAINS PredicateOp = "contains"
+	OP_EXISTS   PredicateOp = "exists"
+	OP_GT       PredicateOp = "gt"
+	OP_LT       PredicateOp = "lt"
+)
+
+// PayloadPredicate tests a visitor payload. An empty Path tests the raw payload,
+// otherwise the payload is parsed as JSON and Path selects a value such as
+// "user.name" or "items[0].qty".
+type PayloadPredicate struct {
+	Path  string      `json:"path,omitempty"`
+	Op    PredicateOp `json:"op"`
+	Value string      `json:"value,omitempty"`
+}
+
+// ParsePayloadPredicate reads the compact form used in query strings:
+// "path=value", "path!=value", "path~value", "path>value", "path<value"
+// or "path?" for existence. A leading "=" compares the raw payload.
+func ParsePayloadPredicate(expr string) (PayloadPredicate, error) {
+	// The first operator in the expression wins so values may contain operator characters
+	for i := 0; i < len(expr); i++ {
+		for _, op := range []struct {
+			token string
+			op    PredicateOp
+		}{
+			{"!=", OP_NE},
+			{"~", OP_CONTAINS},
+			{">", OP_GT},
+			{"<", OP_LT},
+			{"=", OP_EQ},
+		} {
+			if strings.HasPrefix(expr[i:], op.token) {
+				return PayloadPredicate{Path: expr[:i], Op: op.op, Value: expr[i+len(op.token):]}, nil
+			}
+		}
+	}
+	if strings.HasSuffix(expr, "?") {
+		return PayloadPredicate{Path: strings.TrimSuffix(expr, "?"), Op: OP_EXISTS}, nil
+	}
+	return PayloadPredicate{}, fmt.Errorf("invalid payload predicate %q", expr)
+}
+
+func (p PayloadPredicate) String() string {
+	switch p.Op {
+	case OP_EXISTS:
+		return p.Path + "?"
+	case OP_NE:
+		return p.Path + "!=" + p.Value
+	case OP_CONTAINS:
+		return p.Path + "~" + p.Value
+	case OP_GT:
+		return p.Path + ">" + p.Value
+	case OP_LT:
+		return p.Path + "<" + p.Value
+	default:
+		return p.Path + "=" + p.Value
+	}
+}
+
+func (p PayloadPredicate) Match(payload string) bool {
+	subject, found := payload, true
+	if p.Path != "" {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(payload), &doc); err != nil {
+			return false
+		}
+		subject, found = lookupJSONPath(doc, p.Path)
+	}
+
+	switch p.Op {
+	case OP_EXISTS:
+		return found
+	case OP_NE:
+		return !found || subject != p.Value
+	case OP_CONTAINS:
+		return found && strings.Contains(subject, p.Value)
+	case OP_GT, OP_LT:
+		if !found {
+			return false
+		}
+		left, err := strconv.ParseFloat(subject, 64)
+		if err != nil {
+			return false
+		}
+		right, err := strconv.ParseFloat(p.Value, 64)
+		if err != nil {
+			return false
+		}
+		if p.Op == OP_GT {
+			return left > right
+		}
+		return left < right
+	default:
+		return found && subject == p.Value
+	}
+}
+
+// lookupJSONPath walks a decoded JSON document. Strings are returned unquoted,
+// every other value as its JSON text.
+func lookupJSONPath(doc interface{}, path string) (string, bool) {
+	current := doc
+	for _, part := range strings.Split(path, ".") {
+		name := part
+		indexes := make([]int, 0)
+		for strings.HasSuffix(name, "]") {
+			open := strings.LastIndex(name, "[")
+			if open < 0 {
+				return "", false
+			}
+			index, err := strconv.Atoi(name[open+1 : len(name)-1])
+			if err != nil {
+				return "", false
+			}
+			indexes = append([]int{index}, indexes...)
+			name = name[:open]
+		}
+
+		if name != "" {
+			obj, ok := current.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			if current, ok = obj[name]; !ok {
+				return "", false
+			}
+		}
+		for _, index := range indexes {
+			arr, ok := current.([]interface{})
+			if !ok || index < 0 || index >= len(arr) {
+				return "", false
+			}
+			current = arr[index]
+		}
+	}
+
+	if s, ok := current.(string); ok {
+		return s, true
+	}
+	return jsonText(current), true
+}
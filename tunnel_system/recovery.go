@@ -0,0 +1,208 @@
+package tunnel_system
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RecoveryMode is what a start does with a normal run that never shut down
+type RecoveryMode string
+
+const (
+	// RECOVERY_RESUME continues a crashed run under its own replay ID
+	RECOVERY_RESUME RecoveryMode = "resume"
+	// RECOVERY_CONTINUE continues a crashed run in a new run that links back
+	// to it through resumed_from
+	RECOVERY_CONTINUE RecoveryMode = "continue"
+	// RECOVERY_OFF starts every process with a fresh run, as if nothing crashed
+	RECOVERY_OFF RecoveryMode = "off"
+)
+
+// DefaultSnapshotEvery is how many visitors pass between state snapshots
+const DefaultSnapshotEvery = 1000
+
+// shutdownDrainTimeout is how long a shutdown waits for accepted visitors
+const shutdownDrainTimeout = 5 * time.Second
+
+// openMainEntrance opens the main entrance on a new run, or on the crashed
+// run it recovers, which it returns as well. A run another engine sharing the
+// action log still holds the lease on is not crashed.
+func openMainEntrance(config Config, actionLogger *ActionLogger, logger *slog.Logger) (*Tunnel, *Replay) {
+	if config.Simulation != nil || config.Recovery == RECOVERY_OFF {
+		return NewNormalTunnel(actionLogger, logger, config.LogTicks), nil
+	}
+
+	crashed, err := actionLogger.ClaimUnfinishedRun()
+	if err != nil {
+		logger.Error("looking for an unfinished run failed, starting a new one", "error", err)
+		return NewNormalTunnel(actionLogger, logger, config.LogTicks), nil
+	}
+	if crashed == nil {
+		return NewNormalTunnel(actionLogger, logger, config.LogTicks), nil
+	}
+
+	if config.Recovery != RECOVERY_CONTINUE {
+		return newMainTunnel(actionLogger, logger, config.LogTicks, crashed.ID), crashed
+	}
+	replayID, err := actionLogger.InsertRun(fmt.Sprintf("Continuation of run %d", crashed.ID), generateFileName(), &crashed.ID)
+	if err == nil {
+		err = actionLogger.SetReplayStatus(crashed.ID, REPLAY_RECOVERED)
+	}
+	if err != nil {
+		panic("opening the continuation of run " + strconv.FormatInt(crashed.ID, 10) + " failed because: " + err.Error())
+	}
+	return newMainTunnel(actionLogger, logger, config.LogTicks, replayID), crashed
+}
+
+// recover rebuilds the state of a crashed run and returns the visitors it
+// logged on Enter that never got through, in the order they are due.
+//
+// The state starts from the run's last snapshot. Every visitor marked handled
+// after it is handled again, in the order of the markers, on a tunnel that
+// logs nothing and leaves timers to the action log. A timer without a marker
+// was fired by a tick that got through, so it was being handled when the
+// process died and goes first.
+func (t *TunnelSystem) recover(crashed *Replay) ([]*Visitor, error) {
+	actionLogger := t.mainEntrance.actionLogger
+	rows, err := actionLogger.GetMessagesByReplayID(crashed.ID)
+	if err != nil {
+		return nil, err
+	}
+	handled, inSnapshot, err := actionLogger.handledVisitors(crashed.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the first row of a visitor is the one it entered with
+	entered := make(map[string]ActionRow)
+	var ins []ActionRow
+	for _, row := range rows {
+		if row.MessageType == string(AUDIT) || row.ActionType == string(DEAD_LETTER) {
+			continue
+		}
+		if _, seen := entered[row.MessageID]; !seen {
+			entered[row.MessageID] = row
+			ins = append(ins, row)
+		}
+	}
+
+	state := NewState()
+	snapshotID, snapshot, found, err := actionLogger.GetSnapshot(crashed.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		inSnapshot = 0
+	} else if err = json.Unmarshal([]byte(snapshot), state); err != nil {
+		t.logger.Warn("state snapshot unusable, rebuilding from the start of the run", "replay_id", crashed.ID, "message_id", snapshotID, "error", err)
+		state, inSnapshot = NewState(), 0
+	}
+
+	done := make(map[string]bool)
+	var replayed []ActionRow
+	for i, messageID := range handled {
+		if done[messageID] {
+			continue
+		}
+		done[messageID] = true
+		if row, ok := entered[messageID]; ok && i >= inSnapshot {
+			replayed = append(replayed, row)
+		}
+	}
+
+	var unfinished, waiting []ActionRow
+	for _, row := range ins {
+		switch {
+		case done[row.MessageID]:
+		case row.MessageType == string(TIMER):
+			unfinished = append(unfinished, row)
+		default:
+			waiting = append(waiting, row)
+		}
+	}
+	unfinished = append(unfinished, waiting...)
+
+	sandbox := newSandboxTunnel()
+	sandbox.timers = discardTimers{}
+	sandbox.states.set(sandboxReplayID, state)
+	for _, row := range replayed {
+		v := visitorOfRow(row, sandboxReplayID)
+		sandbox.handleSafely(v)
+	}
+	t.mainEntrance.states.set(t.mainEntrance.replayId, sandbox.State(sandboxReplayID))
+
+	visitors := make([]*Visitor, 0, len(unfinished))
+	for _, row := range unfinished {
+		visitors = append(visitors, visitorOfRow(row, t.mainEntrance.replayId))
+	}
+	t.logger.Info("recovered unfinished run",
+		"replay_id", crashed.ID,
+		"resumed_as", t.mainEntrance.replayId,
+		"snapshot", snapshotID,
+		"replayed", len(replayed),
+		"unfinished", len(visitors),
+	)
+	return visitors, nil
+}
+
+func visitorOfRow(row ActionRow, replayID int64) *Visitor {
+	v := NewVisitorFromActionRow(row.MessageID, row.Topic, row.CausedBy, row.MessageType, row.Direction, row.Payload, replayID)
+	v.IsDebug = false
+	v.VirtualTime = row.VirtualTime
+	return v
+}
+
+// reenter queues the unfinished visitors of a recovered run. A resumed run
+// already logged them; a continuation logs them as its first inputs.
+func (t *TunnelSystem) reenter(visitors []*Visitor, crashed *Replay) {
+	main := t.mainEntrance
+	for _, v := range visitors {
+		if crashed.ID != main.replayId {
+			main.Enter(v)
+			continue
+		}
+		main.admit(v)
+		main.logVisitor("visitor re-entered", v)
+		main.enqueue(v)
+	}
+}
+
+// shutdownOnSignal ends the run cleanly on SIGINT or SIGTERM. It pauses the
+// generators, waits for the main entrance to handle what it accepted and
+// marks the run finished before closing the action log. A run that does not
+// drain in time stays running, so the next start recovers what is left of it.
+func (t *TunnelSystem) shutdownOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	t.logger.Info("shutting down", "signal", sig.String())
+
+	t.generators.pauseAll()
+	main := t.mainEntrance
+	deadline := time.Now().Add(shutdownDrainTimeout)
+	for main.inFlight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if left := main.inFlight.Load(); left > 0 {
+		t.logger.Warn("visitors left unhandled, the next start recovers them", "replay_id", main.replayId, "visitors", left)
+		main.actionLogger.Close()
+		os.Exit(1)
+	}
+
+	err := main.actionLogger.SetReplayStatus(main.replayId, REPLAY_FINISHED)
+	if err == nil {
+		err = main.actionLogger.Close()
+	}
+	if err != nil {
+		t.logger.Error("finishing the run failed", "replay_id", main.replayId, "error", err)
+		os.Exit(1)
+	}
+	t.logger.Info("run finished", "replay_id", main.replayId)
+	os.Exit(0)
+}
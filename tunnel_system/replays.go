@@ -0,0 +1,357 @@
+package tunnel_system
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListReplays returns every replay with its tags, newest first, or only the
+// replays carrying tag when it is set
+func (fx *ActionLogger) ListReplays(tag string) ([]Replay, error) {
+	var rows *sql.Rows
+	var err error
+	if tag == "" {
+		rows, err = fx.query("SELECT " + replayColumns + " FROM replay_input ORDER BY created_at DESC, id DESC;")
+	} else {
+		rows, err = fx.query("SELECT "+replayColumns+" FROM replay_input WHERE id IN (SELECT replay_id FROM replay_tag WHERE tag = ?) ORDER BY created_at DESC, id DESC;", tag)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	replays := make([]Replay, 0)
+	for rows.Next() {
+		var replay Replay
+		err = rows.Scan(&replay.ID, &replay.Name, &replay.FileID, &replay.Version, &replay.ParentReplayID, &replay.Filter, &replay.Status, &replay.ResumedFrom, &replay.Pinned, &replay.Compacted, &replay.HandlerVersion, &replay.Notes, &replay.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		replays = append(replays, replay)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	tags, err := fx.allReplayTags()
+	if err != nil {
+		return nil, err
+	}
+	for i := range replays {
+		replays[i].Tags = tags[replays[i].ID]
+	}
+	return replays, nil
+}
+
+func (fx *ActionLogger) replayTags(replayID int64) ([]string, error) {
+	rows, err := fx.query("SELECT tag FROM replay_tag WHERE replay_id = ? ORDER BY tag ASC;", replayID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err = rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+func (fx *ActionLogger) allReplayTags() (map[int64][]string, error) {
+	rows, err := fx.query("SELECT replay_id, tag FROM replay_tag ORDER BY replay_id ASC, tag ASC;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[int64][]string)
+	for rows.Next() {
+		var replayID int64
+		var tag string
+		if err = rows.Scan(&replayID, &tag); err != nil {
+			return nil, err
+		}
+		tags[replayID] = append(tags[replayID], tag)
+	}
+	return tags, rows.Err()
+}
+
+// RenameReplay gives a replay a new name
+func (fx *ActionLogger) RenameReplay(replayID int64, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fmt.Errorf("a replay name cannot be empty")
+	}
+	return fx.updateReplay(replayID, "UPDATE replay_input SET name = ? WHERE id = ?;", name, replayID)
+}
+
+// SetReplayNotes replaces the notes of a replay; empty notes clear them
+func (fx *ActionLogger) SetReplayNotes(replayID int64, notes string) error {
+	return fx.updateReplay(replayID, "UPDATE replay_input SET notes = ? WHERE id = ?;", notes, replayID)
+}
+
+// setReplayFilter records the selection of its parent's actions a rerun holds
+func (fx *ActionLogger) setReplayFilter(replayID int64, filter string) error {
+	return fx.updateReplay(replayID, "UPDATE replay_input SET filter = ? WHERE id = ?;", filter, replayID)
+}
+
+func (fx *ActionLogger) updateReplay(replayID int64, sqlText string, args ...interface{}) error {
+	result, err := fx.exec(sqlText, args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		err = fmt.Errorf("replay %d not found", replayID)
+	}
+	return err
+}
+
+// TagReplay adds tags to a replay and removes others from it in one go; a tag
+// in both is removed. Adding a tag the replay has, or removing one it has
+// not, changes nothing.
+func (fx *ActionLogger) TagReplay(replayID int64, add []string, remove []string) error {
+	add, err := normalizeTags(add)
+	if err != nil {
+		return err
+	}
+	if remove, err = normalizeTags(remove); err != nil {
+		return err
+	}
+	return fx.writeTx(func(tx *sql.Tx) error {
+		var found int
+		if err := fx.txQueryRow(tx, "SELECT COUNT(*) FROM replay_input WHERE id = ?;", replayID).Scan(&found); err != nil {
+			return err
+		}
+		if found == 0 {
+			return fmt.Errorf("replay %d not found", replayID)
+		}
+		for _, tag := range add {
+			if _, err := fx.txExec(tx, "INSERT OR IGNORE INTO replay_tag (replay_id, tag) VALUES (?, ?);", replayID, tag); err != nil {
+				return err
+			}
+		}
+		for _, tag := range remove {
+			if _, err := fx.txExec(tx, "DELETE FROM replay_tag WHERE replay_id = ? AND tag = ?;", replayID, tag); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ParseTags splits a comma separated list of tags, skipping blank entries
+func ParseTags(list string) []string {
+	var tags []string
+	for _, tag := range strings.Split(list, ",") {
+		if strings.TrimSpace(tag) != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// normalizeTags trims the tags and drops duplicates. Tags cannot be empty or
+// hold commas, which separate them on the command line and in queries.
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || strings.Contains(tag, ",") {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// ReplayDeletion tells which replays a cascading delete removed
+type ReplayDeletion struct {
+	// Deleted lists the replay and its descendants, parents first
+	Deleted []int64 `json:"deleted"`
+	// Archive is the bundle written before deleting, if one was asked for
+	Archive string `json:"archive,omitempty"`
+}
+
+// DeleteReplay deletes a replay together with the debug reruns and
+// minimizations under it, after writing them to a bundle in archiveDir unless
+// it is empty. Pinned replays, runs that have not shut down, reruns still
+// executing and replays with undelivered outbox entries are refused, as
+// retention would keep them.
+func (fx *ActionLogger) DeleteReplay(replayID int64, archiveDir string) (*ReplayDeletion, error) {
+	tree, err := fx.replaySubtree(replayID)
+	if err != nil {
+		return nil, err
+	}
+	if tree == nil {
+		return nil, fmt.Errorf("replay %d not found", replayID)
+	}
+	for _, member := range tree.members {
+		if member.Pinned {
+			return nil, fmt.Errorf("replay %d is pinned; unpin it first", member.ID)
+		}
+		if member.Status == REPLAY_RUNNING {
+			return nil, fmt.Errorf("replay %d is still running", member.ID)
+		}
+	}
+	pending, err := fx.countPendingOutbox(tree.ids())
+	if err != nil {
+		return nil, err
+	}
+	if pending > 0 {
+		return nil, fmt.Errorf("replay %d has %d outbox entries not delivered", replayID, pending)
+	}
+
+	deletion := &ReplayDeletion{Deleted: tree.ids()}
+	if archiveDir != "" {
+		if deletion.Archive, err = fx.archiveTree(*tree, archiveDir, time.Now()); err != nil {
+			return nil, fmt.Errorf("archiving replay %d: %w", replayID, err)
+		}
+	}
+	if err = fx.deleteTree(*tree); err != nil {
+		return nil, fmt.Errorf("deleting replay %d: %w", replayID, err)
+	}
+	return deletion, nil
+}
+
+// replaySubtree returns a replay and its descendants as a tree rooted at the
+// replay, or nil when there is no such replay
+func (fx *ActionLogger) replaySubtree(replayID int64) (*replayTree, error) {
+	trees, err := fx.replayTrees()
+	if err != nil {
+		return nil, err
+	}
+	for _, tree := range trees {
+		for i, member := range tree.members {
+			if member.ID != replayID {
+				continue
+			}
+			// members are listed depth first, so the descendants follow
+			// the replay until the walk leaves it
+			subtree := &replayTree{root: member, members: []Replay{member}, pinned: member.Pinned, newest: member.CreatedAt}
+			inside := map[int64]bool{member.ID: true}
+			for _, descendant := range tree.members[i+1:] {
+				if descendant.ParentReplayID == nil || !inside[*descendant.ParentReplayID] {
+					break
+				}
+				inside[descendant.ID] = true
+				subtree.members = append(subtree.members, descendant)
+				subtree.pinned = subtree.pinned || descendant.Pinned
+				if descendant.CreatedAt > subtree.newest {
+					subtree.newest = descendant.CreatedAt
+				}
+			}
+			return subtree, nil
+		}
+	}
+	return nil, nil
+}
+
+// maxReplayNotes caps the notes a request may set
+const maxReplayNotes = 64 << 10
+
+func (s *server) registerReplayRoutes() {
+	http.HandleFunc("/replays", s.handleReplays)
+	http.HandleFunc("/replays/", s.handleReplay)
+}
+
+func (s *server) handleReplays(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	replays, err := s.tunnelSystem.sideEntrance.actionLogger.ListReplays(r.URL.Query().Get("tag"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching replays: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, replays)
+}
+
+// handleReplay serves /replays/{id} and its operations
+func (s *server) handleReplay(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/replays/"), "/")
+	replayID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) > 2 {
+		http.Error(w, "Use /replays/{id}[/rename|/notes|/tags|/pin|/unpin]", http.StatusBadRequest)
+		return
+	}
+	operation := ""
+	if len(parts) > 1 {
+		operation = parts[1]
+	}
+
+	actionLogger := s.tunnelSystem.sideEntrance.actionLogger
+	switch {
+	case operation == "" && r.Method == http.MethodGet:
+	case operation == "" && r.Method == http.MethodDelete:
+		archiveDir := ""
+		if r.URL.Query().Get("archive") == "true" {
+			archiveDir = DefaultArchiveDir
+		}
+		deletion, err := actionLogger.DeleteReplay(replayID, archiveDir)
+		if err != nil {
+			http.Error(w, err.Error(), replayErrorStatus(actionLogger, replayID))
+			return
+		}
+		writeJSON(w, deletion)
+		return
+	case operation == "rename" && r.Method == http.MethodPost:
+		err = actionLogger.RenameReplay(replayID, r.URL.Query().Get("name"))
+	case operation == "notes" && r.Method == http.MethodPost:
+		notes, readErr := io.ReadAll(http.MaxBytesReader(w, r.Body, maxReplayNotes))
+		if readErr != nil {
+			http.Error(w, fmt.Sprintf("Notes are limited to %d bytes", maxReplayNotes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		err = actionLogger.SetReplayNotes(replayID, string(notes))
+	case operation == "tags" && r.Method == http.MethodPost:
+		err = actionLogger.TagReplay(replayID, ParseTags(r.URL.Query().Get("add")), ParseTags(r.URL.Query().Get("remove")))
+	case operation == "pin" && r.Method == http.MethodPost:
+		err = actionLogger.PinReplay(replayID, true)
+	case operation == "unpin" && r.Method == http.MethodPost:
+		err = actionLogger.PinReplay(replayID, false)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), replayErrorStatus(actionLogger, replayID))
+		return
+	}
+
+	replay, err := actionLogger.GetReplay(replayID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching replay: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if replay == nil {
+		http.Error(w, fmt.Sprintf("replay %d not found", replayID), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, replay)
+}
+
+// replayErrorStatus tells a missing replay from a refused change
+func replayErrorStatus(actionLogger *ActionLogger, replayID int64) int {
+	if replay, err := actionLogger.GetReplay(replayID); err == nil && replay == nil {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
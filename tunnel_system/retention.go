@@ -0,0 +1,418 @@
+package tunnel_system
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// RetentionPolicy decides which replays the action log keeps. Replays are kept
+// or deleted by tree: a root replay together with the debug reruns and
+// minimizations under it. A tree with a pinned replay is always kept, and so
+// are the newest run and the run a restart would recover.
+type RetentionPolicy struct {
+	// MaxAge deletes the trees whose newest replay is older, zero for any age
+	MaxAge time.Duration
+	// MaxCount keeps the newest unpinned trees only, zero for any number
+	MaxCount int
+	// CompactTicks collapses every run of consecutive engine TICKs of the
+	// replays of a finished tree into its last TICK. Timers fire on the first
+	// TICK at or after their due time, so reruns fire them at the same TICKs.
+	CompactTicks bool
+	// ArchiveDir receives a bundle of every tree before it is deleted. Empty
+	// means DefaultArchiveDir.
+	ArchiveDir string
+	// Every is how often a running engine applies the policy. Zero means
+	// DefaultRetentionEvery.
+	Every time.Duration
+}
+
+const (
+	DefaultArchiveDir     = "archive"
+	DefaultRetentionEvery = 24 * time.Hour
+)
+
+// RetentionReport tells what applying a retention policy did, or would do on
+// a dry run
+type RetentionReport struct {
+	DryRun bool `json:"dry_run,omitempty"`
+	// Deleted lists the IDs of every replay deleted, trees in a row
+	Deleted []int64 `json:"deleted"`
+	// Archives are the paths of the bundles written before deleting
+	Archives     []string        `json:"archives"`
+	Compacted    []int64         `json:"compacted"`
+	TicksDropped int64           `json:"ticks_dropped"`
+	Skipped      []RetentionSkip `json:"skipped,omitempty"`
+}
+
+// RetentionSkip is a tree the policy would delete but had to keep
+type RetentionSkip struct {
+	ReplayID int64  `json:"replay_id"`
+	Reason   string `json:"reason"`
+}
+
+// replayTree is a root replay and its descendants, parents before children
+type replayTree struct {
+	root    Replay
+	members []Replay
+	pinned  bool
+	newest  int64
+}
+
+// running tells a replay of the tree is a run or rerun still executing
+func (tree replayTree) running() bool {
+	for _, replay := range tree.members {
+		if replay.Status == REPLAY_RUNNING {
+			return true
+		}
+	}
+	return false
+}
+
+// compactable tells a tree has replays left to compact and none still running
+func (tree replayTree) compactable() bool {
+	if tree.running() {
+		return false
+	}
+	for _, replay := range tree.members {
+		if !replay.Compacted {
+			return true
+		}
+	}
+	return false
+}
+
+func (tree replayTree) ids() []int64 {
+	ids := make([]int64, len(tree.members))
+	for i, replay := range tree.members {
+		ids[i] = replay.ID
+	}
+	return ids
+}
+
+// replayTrees groups the replays by tree, newest root first
+func (fx *ActionLogger) replayTrees() ([]replayTree, error) {
+	replays, err := fx.GetAllReplays()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[int64]bool, len(replays))
+	for _, replay := range replays {
+		known[replay.ID] = true
+	}
+	children := make(map[int64][]Replay)
+	var roots []Replay
+	for _, replay := range replays {
+		if replay.ParentReplayID != nil && known[*replay.ParentReplayID] {
+			children[*replay.ParentReplayID] = append(children[*replay.ParentReplayID], replay)
+		} else {
+			roots = append(roots, replay)
+		}
+	}
+	sort.Slice(roots, func(a, b int) bool { return roots[a].ID > roots[b].ID })
+
+	trees := make([]replayTree, 0, len(roots))
+	for _, root := range roots {
+		tree := replayTree{root: root}
+		var walk func(replay Replay)
+		walk = func(replay Replay) {
+			tree.members = append(tree.members, replay)
+			tree.pinned = tree.pinned || replay.Pinned
+			if replay.CreatedAt > tree.newest {
+				tree.newest = replay.CreatedAt
+			}
+			for _, child := range children[replay.ID] {
+				walk(child)
+			}
+		}
+		walk(root)
+		trees = append(trees, tree)
+	}
+	return trees, nil
+}
+
+// EnforceRetention opens the configured action log and applies a retention
+// policy to it once, for the CLI
+func EnforceRetention(config Config, policy RetentionPolicy, dryRun bool) (*RetentionReport, error) {
+	actionLogger := config.actionLogger(config.logger())
+	defer actionLogger.Close()
+	return actionLogger.EnforceRetention(policy, time.Now(), dryRun)
+}
+
+// EnforceRetention applies a retention policy at now. A dry run only reports
+// what it would do.
+func (fx *ActionLogger) EnforceRetention(policy RetentionPolicy, now time.Time, dryRun bool) (*RetentionReport, error) {
+	if policy.ArchiveDir == "" {
+		policy.ArchiveDir = DefaultArchiveDir
+	}
+	trees, err := fx.replayTrees()
+	if err != nil {
+		return nil, err
+	}
+	unfinished, err := fx.GetUnfinishedRun()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RetentionReport{DryRun: dryRun, Deleted: make([]int64, 0), Archives: make([]string, 0), Compacted: make([]int64, 0)}
+	unpinned := 0
+	for i, tree := range trees {
+		protected := i == 0 || (unfinished != nil && tree.root.ID == unfinished.ID)
+		expired := false
+		if !tree.pinned {
+			unpinned++
+			expired = (policy.MaxCount > 0 && unpinned > policy.MaxCount) ||
+				(policy.MaxAge > 0 && tree.newest < now.Add(-policy.MaxAge).Unix())
+		}
+
+		if expired && protected {
+			report.Skipped = append(report.Skipped, RetentionSkip{ReplayID: tree.root.ID, Reason: "newest or unfinished run"})
+		} else if expired && tree.running() {
+			report.Skipped = append(report.Skipped, RetentionSkip{ReplayID: tree.root.ID, Reason: "a rerun is still running"})
+		} else if expired {
+			pending, err := fx.countPendingOutbox(tree.ids())
+			if err != nil {
+				return report, err
+			}
+			if pending > 0 {
+				report.Skipped = append(report.Skipped, RetentionSkip{ReplayID: tree.root.ID, Reason: fmt.Sprintf("%d outbox entries not delivered", pending)})
+			} else {
+				if !dryRun {
+					path, err := fx.archiveTree(tree, policy.ArchiveDir, now)
+					if err != nil {
+						return report, fmt.Errorf("archiving replay %d: %w", tree.root.ID, err)
+					}
+					report.Archives = append(report.Archives, path)
+					if err = fx.deleteTree(tree); err != nil {
+						return report, fmt.Errorf("deleting replay %d: %w", tree.root.ID, err)
+					}
+				}
+				report.Deleted = append(report.Deleted, tree.ids()...)
+				continue
+			}
+		}
+
+		if policy.CompactTicks && tree.compactable() {
+			if !fx.actions.deletesActions() {
+				report.Skipped = append(report.Skipped, RetentionSkip{ReplayID: tree.root.ID, Reason: "the action store cannot drop single TICKs"})
+				continue
+			}
+			// the whole tree is compacted, so reruns still line up with
+			// their original
+			for _, member := range tree.members {
+				if member.Compacted {
+					continue
+				}
+				dropped, err := fx.compactTicks(member.ID, dryRun)
+				if err != nil {
+					return report, fmt.Errorf("compacting replay %d: %w", member.ID, err)
+				}
+				report.Compacted = append(report.Compacted, member.ID)
+				report.TicksDropped += dropped
+			}
+		}
+	}
+	return report, nil
+}
+
+func (fx *ActionLogger) countPendingOutbox(replayIDs []int64) (int64, error) {
+	var pending int64
+	for _, replayID := range replayIDs {
+		var n int64
+		if err := fx.queryRow("SELECT COUNT(*) FROM outbox WHERE replay_id = ? AND status = ?;", replayID, string(OUTBOX_PENDING)).Scan(&n); err != nil {
+			return 0, err
+		}
+		pending += n
+	}
+	return pending, nil
+}
+
+// isEngineTick tells a TICK of the engine's tick generator from the timers
+// and dead letters of the TICK topic
+func isEngineTick(row ActionRow) bool {
+	return row.Topic == string(TICK) && row.MessageType == string(INPUT) && row.ActionType == string(INPUT) && row.Direction == string(IN)
+}
+
+// compactTicks drops every engine TICK of a replay that another one follows
+// right away, keeping the last TICK of each run, and marks the replay compacted
+func (fx *ActionLogger) compactTicks(replayID int64, dryRun bool) (int64, error) {
+	var drop []int64
+	var previous ActionRow
+	err := fx.actions.eachAction(replayID, func(row ActionRow) error {
+		if isEngineTick(previous) && isEngineTick(row) {
+			drop = append(drop, previous.ID)
+		}
+		previous = row
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if dryRun {
+		return int64(len(drop)), nil
+	}
+
+	var dropped int64
+	err = fx.writeTx(func(tx *sql.Tx) error {
+		if dropped, err = fx.actions.deleteActions(tx, drop); err != nil {
+			return err
+		}
+		_, err = fx.txExec(tx, "UPDATE replay_input SET compacted = ? WHERE id = ?;", true, replayID)
+		return err
+	})
+	return dropped, err
+}
+
+// bundleRecord is one line of an archive bundle, with one of its fields set
+type bundleRecord struct {
+	Replay   *Replay         `json:"replay,omitempty"`
+	Action   *ActionRow      `json:"action,omitempty"`
+	Timer    *Timer          `json:"timer,omitempty"`
+	Outbox   *OutboxEntry    `json:"outbox,omitempty"`
+	Snapshot *bundleSnapshot `json:"snapshot,omitempty"`
+	// Comparison is kept with the original replay of the report
+	Comparison *ComparisonReport `json:"comparison,omitempty"`
+}
+
+type bundleSnapshot struct {
+	ReplayID  int64           `json:"replay_id"`
+	MessageID string          `json:"message_id"`
+	State     json.RawMessage `json:"state"`
+}
+
+// archiveTree writes every row of a tree to a gzipped JSON lines bundle in
+// dir, synced to disk before it returns its path. Each replay comes before
+// its actions, timers, outbox entries, snapshot and comparison reports.
+func (fx *ActionLogger) archiveTree(tree replayTree, dir string, now time.Time) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("replay-%d-%s.jsonl.gz", tree.root.ID, now.UTC().Format("20060102T150405Z")))
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	buffered := bufio.NewWriter(out)
+	zipped := gzip.NewWriter(buffered)
+	encoder := json.NewEncoder(zipped)
+	for _, replay := range tree.members {
+		replay := replay
+		if replay.Tags, err = fx.replayTags(replay.ID); err != nil {
+			return "", err
+		}
+		if err = encoder.Encode(bundleRecord{Replay: &replay}); err != nil {
+			return "", err
+		}
+		err = fx.actions.eachAction(replay.ID, func(row ActionRow) error {
+			return encoder.Encode(bundleRecord{Action: &row})
+		})
+		if err != nil {
+			return "", err
+		}
+		rows, err := fx.query("SELECT id, replay_id, message_id, topic, caused_by, payload, fire_at, status, created_at FROM timer WHERE replay_id = ? ORDER BY id ASC;", replay.ID)
+		if err != nil {
+			return "", err
+		}
+		timers, err := scanTimers(rows)
+		if err != nil {
+			return "", err
+		}
+		for i := range timers {
+			if err = encoder.Encode(bundleRecord{Timer: &timers[i]}); err != nil {
+				return "", err
+			}
+		}
+		rows, err = fx.query("SELECT "+outboxColumns+" FROM outbox WHERE replay_id = ? ORDER BY id ASC;", replay.ID)
+		if err != nil {
+			return "", err
+		}
+		entries, err := scanOutbox(rows)
+		if err != nil {
+			return "", err
+		}
+		for i := range entries {
+			if err = encoder.Encode(bundleRecord{Outbox: &entries[i]}); err != nil {
+				return "", err
+			}
+		}
+		messageID, state, found, err := fx.GetSnapshot(replay.ID)
+		if err != nil {
+			return "", err
+		}
+		if found {
+			snapshot := &bundleSnapshot{ReplayID: replay.ID, MessageID: messageID, State: json.RawMessage(state)}
+			if err = encoder.Encode(bundleRecord{Snapshot: snapshot}); err != nil {
+				return "", err
+			}
+		}
+		rows, err = fx.query("SELECT "+comparisonReportColumns+" FROM comparison_report WHERE original_replay_id = ? ORDER BY id ASC;", replay.ID)
+		if err != nil {
+			return "", err
+		}
+		reports, err := scanComparisonReports(rows)
+		if err != nil {
+			return "", err
+		}
+		for i := range reports {
+			if err = encoder.Encode(bundleRecord{Comparison: &reports[i]}); err != nil {
+				return "", err
+			}
+		}
+	}
+	if err = zipped.Close(); err != nil {
+		return "", err
+	}
+	if err = buffered.Flush(); err != nil {
+		return "", err
+	}
+	if err = out.Sync(); err != nil {
+		return "", err
+	}
+	if err = out.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+// deleteTree deletes every row of a tree in one transaction, children before
+// their parents
+func (fx *ActionLogger) deleteTree(tree replayTree) error {
+	ids := tree.ids()
+	childrenFirst := make([]int64, len(ids))
+	for i, id := range ids {
+		childrenFirst[len(ids)-1-i] = id
+	}
+
+	return fx.writeTx(func(tx *sql.Tx) error {
+		for _, sqlTextFormat := range []string{
+			"DELETE FROM timer WHERE replay_id IN (%s);",
+			"DELETE FROM outbox WHERE replay_id IN (%s);",
+			"DELETE FROM idempotency_key WHERE replay_id IN (%s);",
+			"DELETE FROM state_snapshot WHERE replay_id IN (%s);",
+			"DELETE FROM handled_visitor WHERE replay_id IN (%s);",
+			"DELETE FROM replay_tag WHERE replay_id IN (%s);",
+			"DELETE FROM comparison_report WHERE original_replay_id IN (%s);",
+			// a subtree may hold debug runs compared to a replay above it
+			"DELETE FROM comparison_report WHERE debug_replay_id IN (%s);",
+		} {
+			if _, err := fx.deleteIn(tx, sqlTextFormat, ids); err != nil {
+				return err
+			}
+		}
+		if _, err := fx.deleteIn(tx, "DELETE FROM replay_input WHERE id IN (%s);", childrenFirst); err != nil {
+			return err
+		}
+		// the journal cannot roll back, so it goes last
+		return fx.actions.deleteReplays(tx, ids)
+	})
+}
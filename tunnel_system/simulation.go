@@ -0,0 +1,286 @@
+package tunnel_system
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// TopicWeight declares how often a topic is generated relative to the others
+// and how its payloads are drawn
+type TopicWeight struct {
+	Topic   ActionName
+	Weight  int
+	Payload func(r *rand.Rand) string
+}
+
+// Invariant must hold on the application state after every visitor
+type Invariant struct {
+	Name  string
+	Check func(state *State) error
+}
+
+// SimulationGenerator produces a randomized but reproducible input stream:
+// the same seed always yields the same visitors, message IDs included
+type SimulationGenerator struct {
+	Seed       int64
+	Steps      int
+	Topics     []TopicWeight
+	Invariants []Invariant
+}
+
+type SimulationResult struct {
+	Seed      int64  `json:"seed"`
+	Steps     int    `json:"steps"`
+	Failed    bool   `json:"failed"`
+	Invariant string `json:"invariant,omitempty"`
+	Failure   string `json:"failure,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+	ReplayID  int64  `json:"replay_id,omitempty"`
+}
+
+func NewSimulationGenerator(seed int64, steps int, topics []TopicWeight, invariants ...Invariant) *SimulationGenerator {
+	return &SimulationGenerator{
+		Seed:       seed,
+		Steps:      steps,
+		Topics:     topics,
+		Invariants: invariants,
+	}
+}
+
+// PayloadOneOf draws a payload from a fixed set of values
+func PayloadOneOf(values ...string) func(r *rand.Rand) string {
+	return func(r *rand.Rand) string {
+		return values[r.Intn(len(values))]
+	}
+}
+
+// PayloadIntRange draws an integer payload in [min, max]
+func PayloadIntRange(min int, max int) func(r *rand.Rand) string {
+	return func(r *rand.Rand) string {
+		return strconv.Itoa(min + r.Intn(max-min+1))
+	}
+}
+
+// ParseTopicWeight reads the compact form used on the command line:
+// "TOPIC=weight", optionally followed by ":a,b,c" to draw the payload from a
+// set of values or ":min..max" to draw an integer
+func ParseTopicWeight(spec string) (TopicWeight, error) {
+	topic, rest, found := strings.Cut(spec, "=")
+	if !found || topic == "" {
+		return TopicWeight{}, fmt.Errorf("invalid topic %q, use TOPIC=weight[:payloads]", spec)
+	}
+	if !knownTopic(ActionName(topic)) {
+		return TopicWeight{}, fmt.Errorf("no handler for topic %s", topic)
+	}
+	weightText, payloads, hasPayloads := strings.Cut(rest, ":")
+	weight, err := strconv.Atoi(weightText)
+	if err != nil || weight <= 0 {
+		return TopicWeight{}, fmt.Errorf("invalid weight %q for topic %s", weightText, topic)
+	}
+
+	tw := TopicWeight{Topic: ActionName(topic), Weight: weight}
+	if !hasPayloads {
+		return tw, nil
+	}
+	if low, high, isRange := strings.Cut(payloads, ".."); isRange {
+		min, errMin := strconv.Atoi(low)
+		max, errMax := strconv.Atoi(high)
+		if errMin != nil || errMax != nil || min > max {
+			return TopicWeight{}, fmt.Errorf("invalid payload range %q for topic %s", payloads, topic)
+		}
+		tw.Payload = PayloadIntRange(min, max)
+		return tw, nil
+	}
+	tw.Payload = PayloadOneOf(strings.Split(payloads, ",")...)
+	return tw, nil
+}
+
+// StateInvariant makes an invariant of a state assertion such as
+// logged_on.bob<2, in the form ParsePayloadPredicate reads
+func StateInvariant(assertion string) (Invariant, error) {
+	p, err := ParsePayloadPredicate(assertion)
+	if err != nil {
+		return Invariant{}, err
+	}
+	return Invariant{
+		Name: assertion,
+		Check: func(state *State) error {
+			doc, err := json.Marshal(state)
+			if err == nil && violates(p, string(doc)) {
+				return fmt.Errorf("assertion %s violated", p)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// FuzzSimulation fuzzes outside of a running engine, saving the failing seeds
+// to the configured action log
+func FuzzSimulation(config Config, g SimulationGenerator, firstSeed int64, seeds int) ([]SimulationResult, error) {
+	actionLogger := config.actionLogger(config.logger())
+	defer actionLogger.Close()
+	return Fuzz(actionLogger, g, firstSeed, seeds)
+}
+
+// Inputs generates the input stream for the generator's seed
+func (g *SimulationGenerator) Inputs() []*Visitor {
+	r := rand.New(rand.NewSource(g.Seed))
+
+	total := 0
+	for _, topic := range g.Topics {
+		total += topic.Weight
+	}
+
+	inputs := make([]*Visitor, 0, g.Steps)
+	if total <= 0 {
+		return inputs
+	}
+	for i := 0; i < g.Steps; i++ {
+		pick := r.Intn(total)
+		var topic TopicWeight
+		for _, topic = range g.Topics {
+			if pick < topic.Weight {
+				break
+			}
+			pick -= topic.Weight
+		}
+
+		payload := ""
+		if topic.Payload != nil {
+			payload = topic.Payload(r)
+		}
+		v := NewInputAction(topic.Topic, payload)
+		v.MessageId = seededMessageId(r)
+		inputs = append(inputs, v)
+	}
+	return inputs
+}
+
+// Start feeds the stream into a running engine at full speed, checking every
+// invariant on the run's state after each visitor is handled. A violation
+// stops the stream and saves the inputs fed so far as a replay.
+func (g *SimulationGenerator) Start(ts *TunnelSystem) {
+	main := ts.mainEntrance
+	go func() {
+		var fed []ActionRow
+		for _, v := range g.Inputs() {
+			main.Enter(v)
+			engineMetrics.generatorEmits.Inc("simulation", string(v.ActionName))
+			fed = append(fed, actionRowOf(v, string(v.ActionType)))
+			if len(g.Invariants) == 0 {
+				continue
+			}
+			main.waitHandled(main.entered.Load())
+			result, failed := g.check(main.State(main.replayId))
+			if !failed {
+				continue
+			}
+			result.Steps, result.MessageID = len(fed), v.MessageId
+			if main.actionLogger != nil {
+				result.ReplayID, _ = saveSeed(main.actionLogger, result, fed)
+			}
+			ts.logger.Error("simulation invariant violated", "seed", g.Seed, "invariant", result.Invariant, "error", result.Failure, "message_id", v.MessageId, "saved_as", result.ReplayID)
+			return
+		}
+		ts.logger.Info("simulation generator finished", "seed", g.Seed, "steps", g.Steps)
+	}()
+	ts.logger.Info("started simulation generator", "seed", g.Seed, "steps", g.Steps)
+}
+
+// check runs every invariant on a state and reports the first that fails
+func (g *SimulationGenerator) check(state *State) (SimulationResult, bool) {
+	for _, invariant := range g.Invariants {
+		if err := invariant.Check(state); err != nil {
+			return SimulationResult{Seed: g.Seed, Failed: true, Invariant: invariant.Name, Failure: err.Error()}, true
+		}
+	}
+	return SimulationResult{Seed: g.Seed}, false
+}
+
+// Run handles the stream in a sandbox with the real handlers, checking every
+// invariant after each visitor. A handler failure counts as a failed run.
+func (g *SimulationGenerator) Run() SimulationResult {
+	result, _ := g.run()
+	return result
+}
+
+func (g *SimulationGenerator) run() (SimulationResult, sandboxRun) {
+	result := SimulationResult{Seed: g.Seed}
+	failedInvariant := ""
+
+	run := runSandbox(g.Inputs(), func(state *State) error {
+		violation, failed := g.check(state)
+		if !failed {
+			return nil
+		}
+		failedInvariant = violation.Invariant
+		return errors.New(violation.Failure)
+	})
+	result.Steps = run.handled
+
+	switch {
+	case len(run.deadLetters) > 0:
+		dead := run.deadLetters[0]
+		result.Failed = true
+		result.MessageID = dead.MessageId
+		for _, row := range run.rows {
+			if row.MessageID == dead.MessageId && row.ActionType == string(DEAD_LETTER) {
+				result.Failure = row.Payload
+			}
+		}
+	case run.checkFailure != nil:
+		result.Failed = true
+		result.Invariant = failedInvariant
+		result.Failure = run.checkFailure.Error()
+		result.MessageID = run.rows[len(run.rows)-1].MessageID
+	}
+	return result, run
+}
+
+// Fuzz runs the generator for seeds firstSeed..firstSeed+seeds-1 and saves
+// the inputs of every failing seed as a replay, so it can be rerun, debugged
+// and minimized. It returns the failing results.
+func Fuzz(actionLogger *ActionLogger, g SimulationGenerator, firstSeed int64, seeds int) ([]SimulationResult, error) {
+	failures := make([]SimulationResult, 0)
+	for seed := firstSeed; seed < firstSeed+int64(seeds); seed++ {
+		g.Seed = seed
+		result, run := g.run()
+		if !result.Failed {
+			continue
+		}
+
+		replayID, err := saveSeed(actionLogger, result, run.rows)
+		if err != nil {
+			return failures, err
+		}
+		result.ReplayID = replayID
+		failures = append(failures, result)
+	}
+	return failures, nil
+}
+
+// saveSeed saves the rows of a failing seed as a replay
+func saveSeed(actionLogger *ActionLogger, result SimulationResult, rows []ActionRow) (int64, error) {
+	name := fmt.Sprintf("Simulation seed %d failed: %s", result.Seed, result.Failure)
+	replayID, err := actionLogger.InsertReplay(name, generateFileName(), 1, nil, "")
+	if err != nil {
+		return 0, err
+	}
+	for _, row := range rows {
+		actionLogger.InsertAction(replayID, row.MessageID, row.Topic, row.CausedBy, row.MessageType, row.Direction, row.Payload, row.ActionType, row.VirtualTime)
+	}
+	return replayID, nil
+}
+
+func seededMessageId(r *rand.Rand) string {
+	charset := "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	messageId := "M"
+	for i := 0; i < 5; i++ {
+		messageId = messageId + string(charset[r.Intn(len(charset))])
+	}
+	return messageId
+}
@@ -0,0 +1,380 @@
+package tunnel_system
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sink delivers the visitors leaving the engine to the outside world, the
+// mirror of InputGenerator. key identifies the delivery: it stays the same
+// when a delivery is retried and differs for every output.
+type Sink interface {
+	Name() string
+	Deliver(v *Visitor, key string) error
+}
+
+// deliveryKey is the key of a message's delivery to a sink. Message IDs are
+// short enough to repeat across runs, so the key is scoped to the replay.
+func deliveryKey(replayID int64, messageID string, sink string) string {
+	return fmt.Sprintf("%d/%s/%s", replayID, messageID, sink)
+}
+
+// RetryPolicy is how often and how patiently a failing delivery is retried.
+// The wait doubles after every attempt, starting at InitialBackoff and
+// capped at MaxBackoff.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+	}
+}
+
+// backoff is the wait before the given retry, counting from 1
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	wait := p.InitialBackoff
+	for i := 1; i < retry && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	return wait
+}
+
+// SinkRoute sends the visitors of some topics to a sink, or of every topic
+// when Topics is empty. A zero Retry means DefaultRetryPolicy.
+type SinkRoute struct {
+	Sink   Sink
+	Topics []ActionName
+	Retry  RetryPolicy
+}
+
+func (r SinkRoute) matches(name ActionName) bool {
+	if len(r.Topics) == 0 {
+		return true
+	}
+	for _, topic := range r.Topics {
+		if topic == name {
+			return true
+		}
+	}
+	return false
+}
+
+// permanentError marks a delivery failure that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent wraps a Deliver error so the dispatcher gives up without retrying
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// outboxPollInterval is how often a sink looks for entries it was not woken
+// for, such as those left over from before a restart
+const outboxPollInterval = time.Second
+
+// outboxBatchSize is how many entries a sink reads from the outbox at once
+const outboxBatchSize = 100
+
+// sinkDispatcher queues exiting visitors in the outbox and delivers them from
+// there. The outbox entries are written in the same transaction as the exit
+// action, so a crash can neither lose a logged output nor deliver one that was
+// never logged. An output delivered but not yet marked when the process dies
+// is delivered again after the restart with the same delivery key, which
+// sinks such as WebhookSink pass on for the receiver to drop it.
+//
+// Every sink delivers its entries in order on its own goroutine, so a slow
+// webhook holds up neither the tunnel nor the other sinks.
+type sinkDispatcher struct {
+	workers []*sinkWorker
+}
+
+type sinkWorker struct {
+	route        SinkRoute
+	actionLogger *ActionLogger
+	wake         chan struct{}
+	logger       *slog.Logger
+}
+
+func newSinkDispatcher(routes []SinkRoute, actionLogger *ActionLogger, logger *slog.Logger) *sinkDispatcher {
+	d := &sinkDispatcher{}
+	names := make(map[string]bool)
+	for _, route := range routes {
+		// the outbox keys deliveries by sink name, so two sinks cannot share one
+		if names[route.Sink.Name()] {
+			panic("sink " + route.Sink.Name() + " is configured twice")
+		}
+		names[route.Sink.Name()] = true
+		if route.Retry.MaxAttempts <= 0 {
+			route.Retry = DefaultRetryPolicy()
+		}
+		worker := &sinkWorker{
+			route:        route,
+			actionLogger: actionLogger,
+			wake:         make(chan struct{}, 1),
+			logger:       logger.With("component", "sink", "sink", route.Sink.Name()),
+		}
+		d.workers = append(d.workers, worker)
+		go worker.run()
+		worker.logger.Info("started sink", "topics", route.Topics)
+	}
+	return d
+}
+
+// sinksFor names the sinks a visitor is routed to. Debug visitors never leave
+// the engine, so reruns cannot send anything to the outside world again.
+func (d *sinkDispatcher) sinksFor(v *Visitor) []string {
+	if d == nil || v.IsDebug {
+		return nil
+	}
+	var sinks []string
+	for _, worker := range d.workers {
+		if worker.route.matches(v.ActionName) {
+			sinks = append(sinks, worker.route.Sink.Name())
+		}
+	}
+	return sinks
+}
+
+// notify wakes the sinks a visitor was just queued for
+func (d *sinkDispatcher) notify(sinks []string) {
+	if d == nil {
+		return
+	}
+	for _, worker := range d.workers {
+		for _, sink := range sinks {
+			if worker.route.Sink.Name() == sink {
+				worker.notify()
+			}
+		}
+	}
+}
+
+func (d *sinkDispatcher) notifyAll() {
+	if d == nil {
+		return
+	}
+	for _, worker := range d.workers {
+		worker.notify()
+	}
+}
+
+func (w *sinkWorker) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *sinkWorker) run() {
+	for {
+		wait := w.drain()
+		if wait <= 0 || wait > outboxPollInterval {
+			wait = outboxPollInterval
+		}
+		select {
+		case <-w.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// drain delivers the pending entries in order until the outbox is empty or
+// the oldest entry is waiting for its next attempt, and returns how long that
+// is
+func (w *sinkWorker) drain() time.Duration {
+	name := w.route.Sink.Name()
+	for {
+		entries, err := w.actionLogger.pendingOutbox(name, outboxBatchSize)
+		if err != nil {
+			w.logger.Error("reading the outbox failed", "error", err)
+			return 0
+		}
+		if len(entries) == 0 {
+			return 0
+		}
+		for _, entry := range entries {
+			if wait := time.Until(time.UnixMilli(entry.NextAttemptAt)); wait > 0 {
+				return wait
+			}
+			retryIn, err := w.deliver(entry)
+			if err != nil {
+				w.logger.Error("updating the outbox failed", "outbox_id", entry.ID, "error", err)
+				return 0
+			}
+			if retryIn > 0 {
+				return retryIn
+			}
+		}
+	}
+}
+
+// deliver makes one attempt at an entry and records its outcome. It returns
+// the backoff when the entry stays pending for another attempt.
+func (w *sinkWorker) deliver(entry OutboxEntry) (time.Duration, error) {
+	name := w.route.Sink.Name()
+	attempt := entry.Attempts + 1
+
+	var v Visitor
+	err := json.Unmarshal([]byte(entry.Visitor), &v)
+	if err != nil {
+		err = Permanent(fmt.Errorf("invalid outbox entry: %w", err))
+	} else {
+		start := time.Now()
+		err = w.route.Sink.Deliver(&v, entry.DeliveryKey)
+		engineMetrics.sinkDuration.ObserveSince(start, name)
+	}
+
+	if err == nil {
+		engineMetrics.sinkDeliveries.Inc(name, "delivered")
+		_, err = w.actionLogger.markOutboxDelivered(entry.ID, attempt)
+		return 0, err
+	}
+
+	var permanent permanentError
+	if errors.As(err, &permanent) || attempt >= w.route.Retry.MaxAttempts {
+		engineMetrics.sinkDeliveries.Inc(name, "failed")
+		w.logger.Error("sink delivery failed", "message_id", entry.MessageID, "action_name", v.ActionName, "attempts", attempt, "error", err)
+		return 0, w.actionLogger.failOutbox(entry.ID, attempt, err.Error())
+	}
+
+	wait := w.route.Retry.backoff(attempt)
+	engineMetrics.sinkDeliveries.Inc(name, "retried")
+	w.logger.Warn("sink delivery failed, retrying", "message_id", entry.MessageID, "attempt", attempt, "backoff", wait, "error", err)
+	return wait, w.actionLogger.retryOutbox(entry.ID, attempt, time.Now().Add(wait).UnixMilli(), err.Error())
+}
+
+// WebhookSink posts every visitor as JSON to a URL. The delivery key is sent
+// as the Idempotency-Key header so receivers can drop redeliveries.
+type WebhookSink struct {
+	SinkName string
+	URL      string
+	Headers  map[string]string
+	Client   *http.Client
+}
+
+func NewWebhookSink(name string, url string) *WebhookSink {
+	return &WebhookSink{
+		SinkName: name,
+		URL:      url,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *WebhookSink) Name() string {
+	return s.SinkName
+}
+
+func (s *WebhookSink) Deliver(v *Visitor, key string) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return Permanent(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	for k, value := range s.Headers {
+		req.Header.Set(k, value)
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return Permanent(fmt.Errorf("webhook answered %s", resp.Status))
+}
+
+// FileSink appends every visitor as a JSON line to a file
+type FileSink struct {
+	SinkName string
+	Path     string
+
+	mu sync.Mutex
+}
+
+func NewFileSink(name string, path string) *FileSink {
+	return &FileSink{SinkName: name, Path: path}
+}
+
+func (s *FileSink) Name() string {
+	return s.SinkName
+}
+
+func (s *FileSink) Deliver(v *Visitor, key string) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return Permanent(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = out.Write(append(line, '\n')); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// StdoutSink writes every visitor as a JSON line to standard output
+type StdoutSink struct {
+	mu sync.Mutex
+}
+
+func NewStdoutSink() *StdoutSink {
+	return &StdoutSink{}
+}
+
+func (s *StdoutSink) Name() string {
+	return "stdout"
+}
+
+func (s *StdoutSink) Deliver(v *Visitor, key string) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return Permanent(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = os.Stdout.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,104 @@
+package tunnel_system
+
+import "sync"
+
+// State is the application state a tunnel builds up while handling visitors
+type State struct {
+	Processed     int                `json:"processed"`
+	ActionCounts  map[ActionName]int `json:"action_counts"`
+	LoggedOn      map[string]int     `json:"logged_on"`
+	LastTick      string             `json:"last_tick,omitempty"`
+	LastMessageID string             `json:"last_message_id,omitempty"`
+	// Values holds whatever registered handlers keep between visitors
+	Values map[string]string `json:"values,omitempty"`
+}
+
+func NewState() *State {
+	return &State{
+		ActionCounts: make(map[ActionName]int),
+		LoggedOn:     make(map[string]int),
+		Values:       make(map[string]string),
+	}
+}
+
+// apply records a successfully handled visitor
+func (s *State) apply(v *Visitor) {
+	s.Processed++
+	s.ActionCounts[v.ActionName]++
+	s.LastMessageID = v.MessageId
+
+	switch v.ActionName {
+	case TICK:
+		s.LastTick = v.Payload
+	case LOGON:
+		s.LoggedOn[v.Payload]++
+	}
+}
+
+func (s *State) Clone() *State {
+	clone := &State{
+		Processed:     s.Processed,
+		ActionCounts:  make(map[ActionName]int, len(s.ActionCounts)),
+		LoggedOn:      make(map[string]int, len(s.LoggedOn)),
+		LastTick:      s.LastTick,
+		LastMessageID: s.LastMessageID,
+		Values:        make(map[string]string, len(s.Values)),
+	}
+	for k, v := range s.ActionCounts {
+		clone.ActionCounts[k] = v
+	}
+	for k, v := range s.LoggedOn {
+		clone.LoggedOn[k] = v
+	}
+	for k, v := range s.Values {
+		clone.Values[k] = v
+	}
+	return clone
+}
+
+// stateStore keeps one State per replay so every debug rerun starts from scratch
+type stateStore struct {
+	mu     sync.Mutex
+	states map[int64]*State
+}
+
+func newStateStore() *stateStore {
+	return &stateStore{states: make(map[int64]*State)}
+}
+
+// with hands the live state of a replay to fn while holding the store's lock
+func (s *stateStore) with(replayID int64, fn func(state *State)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[replayID]
+	if !ok {
+		state = NewState()
+		s.states[replayID] = state
+	}
+	fn(state)
+}
+
+// get returns a copy of the state of a replay, or an empty state if nothing was handled yet
+func (s *stateStore) get(replayID int64) *State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[replayID]
+	if !ok {
+		return NewState()
+	}
+	return state.Clone()
+}
+
+// set replaces the state of a replay, as recovering a crashed run does
+func (s *stateStore) set(replayID int64, state *State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[replayID] = state
+}
+
+// drop forgets the state of a replay that is gone
+func (s *stateStore) drop(replayID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.states, replayID)
+}
@@ -0,0 +1,280 @@
+package tunnel_system
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type TimerStatus string
+
+const (
+	TIMER_PENDING  TimerStatus = "pending"
+	TIMER_FIRED    TimerStatus = "fired"
+	TIMER_CANCELED TimerStatus = "canceled"
+	// TIMER_ADOPTED marks a timer a later run took over through ADOPT_TIMER
+	TIMER_ADOPTED TimerStatus = "adopted"
+)
+
+// Timer is a visitor a handler asked to fire later. FireAt is engine time in
+// unix nanoseconds, the clock the TICK payloads carry.
+type Timer struct {
+	ID        int64       `json:"id"`
+	ReplayID  int64       `json:"replay_id"`
+	MessageID string      `json:"message_id"`
+	Topic     string      `json:"topic"`
+	CausedBy  string      `json:"caused_by"`
+	Payload   string      `json:"payload"`
+	FireAt    int64       `json:"fire_at"`
+	Status    TimerStatus `json:"status"`
+	CreatedAt int64       `json:"created_at"`
+}
+
+// Handler runs application logic for one topic. Returning an error fails the
+// visitor the same way an unknown topic does.
+type Handler func(ctx *HandlerContext, v *Visitor) error
+
+// HandlerContext is what a handler may touch while it handles a visitor
+type HandlerContext struct {
+	// Now is the engine time of the visitor, taken from the last tick so a
+	// rerun sees the same time as the original run
+	Now   time.Time
+	State *State
+
+	visitor   *Visitor
+	scheduled []Timer
+	canceled  []string
+}
+
+// Schedule fires a visitor for topic once the engine clock has moved on by
+// after, caused by the visitor being handled. Timers are checked on every
+// tick, so they fire on the first tick at or past their time. It returns the
+// message ID the visitor will carry, which Cancel takes.
+func (c *HandlerContext) Schedule(after time.Duration, topic ActionName, payload string) string {
+	timer := Timer{
+		ReplayID:  c.visitor.ReplayId,
+		MessageID: fmt.Sprintf("T%s-%d", c.visitor.MessageId, len(c.scheduled)+1),
+		Topic:     string(topic),
+		CausedBy:  c.visitor.MessageId,
+		Payload:   payload,
+		FireAt:    c.Now.Add(after).UnixNano(),
+		Status:    TIMER_PENDING,
+	}
+	c.scheduled = append(c.scheduled, timer)
+	return timer.MessageID
+}
+
+// Cancel drops a pending timer of the replay, if it has not fired yet
+func (c *HandlerContext) Cancel(messageID string) {
+	c.canceled = append(c.canceled, messageID)
+}
+
+var handlers = struct {
+	sync.RWMutex
+	byName map[ActionName]Handler
+}{byName: make(map[ActionName]Handler)}
+
+// RegisterHandler adds the handler for a topic. TICK and LOGON keep their
+// built-in handling and run the registered handler after it.
+func RegisterHandler(name ActionName, handler Handler) {
+	handlers.Lock()
+	defer handlers.Unlock()
+	if handler == nil {
+		panic("tunnel_system: nil handler for " + string(name))
+	}
+	if _, exists := handlers.byName[name]; exists {
+		panic("tunnel_system: multiple registrations for " + string(name))
+	}
+	handlers.byName[name] = handler
+}
+
+func lookupHandler(name ActionName) (Handler, bool) {
+	handlers.RLock()
+	defer handlers.RUnlock()
+	handler, ok := handlers.byName[name]
+	return handler, ok
+}
+
+// engineTime is the engine clock at a visitor: a tick's own reading, or the
+// reading of the last tick handled before it. Wall time never leaks in, so
+// timers are scheduled and fired at the same points on every rerun.
+func engineTime(state *State, v *Visitor) int64 {
+	reading := state.LastTick
+	if v.ActionName == TICK {
+		reading = v.Payload
+	}
+	now, err := strconv.ParseInt(reading, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return now
+}
+
+// timerStore keeps the pending timers of every replay a tunnel handles
+type timerStore interface {
+	scheduleTimer(timer Timer) error
+	cancelTimer(replayID int64, messageID string) error
+	dueTimers(replayID int64, now int64) ([]Timer, error)
+	markTimerFired(id int64) error
+}
+
+// discardTimers is the timer store of a tunnel rebuilding state from the
+// action log, where every timer that fired is logged as a visitor of its own
+type discardTimers struct{}
+
+func (discardTimers) scheduleTimer(timer Timer) error                      { return nil }
+func (discardTimers) cancelTimer(replayID int64, messageID string) error   { return nil }
+func (discardTimers) dueTimers(replayID int64, now int64) ([]Timer, error) { return nil, nil }
+func (discardTimers) markTimerFired(id int64) error                        { return nil }
+
+// memoryTimers is the timer store of sandboxes, which write nothing to disk
+type memoryTimers struct {
+	timers []Timer
+}
+
+func newMemoryTimers() *memoryTimers {
+	return &memoryTimers{}
+}
+
+func (m *memoryTimers) scheduleTimer(timer Timer) error {
+	timer.ID = int64(len(m.timers) + 1)
+	m.timers = append(m.timers, timer)
+	return nil
+}
+
+func (m *memoryTimers) cancelTimer(replayID int64, messageID string) error {
+	for i := range m.timers {
+		timer := &m.timers[i]
+		if timer.ReplayID == replayID && timer.MessageID == messageID && timer.Status == TIMER_PENDING {
+			timer.Status = TIMER_CANCELED
+		}
+	}
+	return nil
+}
+
+func (m *memoryTimers) dueTimers(replayID int64, now int64) ([]Timer, error) {
+	due := make([]Timer, 0)
+	for _, timer := range m.timers {
+		if timer.ReplayID == replayID && timer.Status == TIMER_PENDING && timer.FireAt <= now {
+			due = append(due, timer)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].FireAt < due[j].FireAt })
+	return due, nil
+}
+
+func (m *memoryTimers) markTimerFired(id int64) error {
+	m.timers[id-1].Status = TIMER_FIRED
+	return nil
+}
+
+// saveTimers persists what a handler scheduled and canceled. It runs only
+// once the handler succeeded, so a failed visitor leaves no timers behind.
+func (t *Tunnel) saveTimers(ctx *HandlerContext) {
+	for _, timer := range ctx.scheduled {
+		if err := t.timers.scheduleTimer(timer); err != nil {
+			panic("scheduling timer " + timer.MessageID + " failed because: " + err.Error())
+		}
+	}
+	for _, messageID := range ctx.canceled {
+		if err := t.timers.cancelTimer(ctx.visitor.ReplayId, messageID); err != nil {
+			panic("canceling timer " + messageID + " failed because: " + err.Error())
+		}
+	}
+}
+
+// adoptTimers enters an ADOPT_TIMER visitor for every timer still pending in
+// an earlier normal run, so timers scheduled before a restart fire in the run
+// after it. The timer is scheduled when the visitor is handled, so a rerun of
+// the run schedules it as well. It returns how many timers were adopted.
+func (t *Tunnel) adoptTimers() (int, error) {
+	timers, err := t.actionLogger.orphanedTimers(t.replayId)
+	if err != nil {
+		return 0, err
+	}
+	adopted := 0
+	for _, timer := range timers {
+		payload, err := json.Marshal(timer)
+		if err != nil {
+			return adopted, err
+		}
+		v := NewInputAction(ADOPT_TIMER, string(payload))
+		v.CausedBy = timer.MessageID
+		t.admit(v)
+		if !t.actionLogger.InsertTimerAdoption(timer.ID, v.ReplayId, v.MessageId, string(v.ActionName), v.CausedBy, string(v.ActionType), string(v.ActionDirection), v.Payload, string(v.ActionType), v.VirtualTime) {
+			continue
+		}
+		t.logVisitor("visitor entered", v)
+		t.enqueue(v)
+		adopted++
+	}
+	return adopted, nil
+}
+
+// adoptTimer schedules the timer an ADOPT_TIMER visitor carries in the
+// visitor's replay
+func (t *Tunnel) adoptTimer(v *Visitor) {
+	var timer Timer
+	if err := json.Unmarshal([]byte(v.Payload), &timer); err != nil {
+		panic("adopting timer failed because: " + err.Error())
+	}
+	timer.ID = 0
+	timer.ReplayID = v.ReplayId
+	timer.Status = TIMER_PENDING
+	if err := t.timers.scheduleTimer(timer); err != nil {
+		panic("scheduling timer " + timer.MessageID + " failed because: " + err.Error())
+	}
+}
+
+// fireTimers runs the timers of a replay that are due at a tick. A timer is
+// marked fired in the transaction that logs its visitor, before the visitor is
+// handled: a crash in between leaves a logged visitor for recovery to
+// re-queue, and one whose handler fails is not retried on every following
+// tick. Timers scheduled for zero delay while firing wait for the next tick.
+func (t *Tunnel) fireTimers(tick *Visitor, now int64) {
+	due, err := t.timers.dueTimers(tick.ReplayId, now)
+	if err != nil {
+		panic("loading due timers failed because: " + err.Error())
+	}
+	for _, timer := range due {
+		v := &Visitor{
+			MessageId:       timer.MessageID,
+			ActionName:      ActionName(timer.Topic),
+			CausedBy:        timer.CausedBy,
+			Payload:         timer.Payload,
+			ActionType:      TIMER,
+			ActionDirection: IN,
+			IsDebug:         tick.IsDebug,
+			ReplayId:        tick.ReplayId,
+			VirtualTime:     tick.VirtualTime,
+		}
+		t.logVisitor("timer fired", v)
+		t.recordFiredTimer(timer, v)
+		engineMetrics.visitorsEntered.Inc(t.name, string(v.ActionName), string(v.ActionType))
+
+		var out *Visitor
+		if t.deadLetter {
+			out = t.handleOrDeadLetter(v)
+		} else {
+			out = t.handle(v)
+		}
+		if out != nil {
+			t.Exit(out)
+		}
+	}
+}
+
+// recordFiredTimer marks a timer fired and logs the visitor it fires
+func (t *Tunnel) recordFiredTimer(timer Timer, v *Visitor) {
+	if t.actionLogger == nil {
+		if err := t.timers.markTimerFired(timer.ID); err != nil {
+			panic("marking timer " + timer.MessageID + " fired failed because: " + err.Error())
+		}
+		t.record(v, string(v.ActionType), v.Payload)
+		return
+	}
+	t.actionLogger.InsertFiredTimer(timer.ID, v.ReplayId, v.MessageId, string(v.ActionName), v.CausedBy, string(v.ActionType), string(v.ActionDirection), v.Payload, string(v.ActionType), v.VirtualTime)
+}
@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"fund78/assert"
-	"log"
+	"log/slog"
 	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ActionType string
@@ -15,6 +18,15 @@ const (
 	INPUT   ActionType = "INPUT"
 	REQUEST ActionType = "REQUEST"
 	REPLY   ActionType = "REPLY"
+
+	// TIMER marks a visitor fired by a timer a handler scheduled
+	TIMER ActionType = "TIMER"
+
+	// AUDIT marks a row recording an operator action, such as pausing a generator
+	AUDIT ActionType = "AUDIT"
+
+	// DEAD_LETTER marks the action row of a visitor whose handler failed
+	DEAD_LETTER ActionType = "DEAD_LETTER"
 )
 
 type ActionDirection string
@@ -29,12 +41,50 @@ type ActionName string
 const (
 	TICK  ActionName = "TICK"
 	LOGON ActionName = "LOGON"
+	// ADOPT_TIMER schedules a timer still pending in an earlier run, whose
+	// JSON it carries, in the run handling it
+	ADOPT_TIMER ActionName = "ADOPT_TIMER"
 )
 
 type Tunnel struct {
+	name         string
 	queue        chan *Visitor
 	replayId     int64
 	actionLogger *ActionLogger
+	logger       *slog.Logger
+	logTicks     bool
+	states       *stateStore
+	debugger     *Debugger
+	deadLetter   bool
+	timers       timerStore
+
+	// recordRow receives the action rows of a tunnel without an action logger
+	recordRow func(row ActionRow)
+
+	// sinks deliver the visitors exiting the tunnel, nil when there are none
+	sinks *sinkDispatcher
+
+	// idempotencyWindow is how long EnterOnce remembers an idempotency key
+	idempotencyWindow time.Duration
+
+	// snapshotEvery is how many visitors pass between state snapshots, zero
+	// for none
+	snapshotEvery int
+	sinceSnapshot int
+	// inFlight counts the visitors entered and not yet through the tunnel
+	inFlight atomic.Int64
+	// entered and handled count the visitors queued and through the tunnel
+	// since it opened
+	entered atomic.Int64
+	handled atomic.Int64
+	// handledWake is closed when the tunnel gets through a visitor, to wake
+	// up waitHandled
+	handledMu   sync.Mutex
+	handledWake chan struct{}
+
+	subscribersMu  sync.Mutex
+	subscribers    map[int]func(v *Visitor)
+	nextSubscriber int
 }
 
 type Visitor struct {
@@ -46,9 +96,52 @@ type Visitor struct {
 	ActionDirection ActionDirection `json:"actionDirection"`
 	IsDebug         bool            `json:"isDebug"`
 	ReplayId        int64           `json:"replayId"`
+	// VirtualTime is the simulated time in unix nanoseconds the visitor was
+	// generated at, zero when running on the wall clock
+	VirtualTime int64 `json:"virtualTime,omitempty"`
 }
 
 func (t *Tunnel) Enter(v *Visitor) {
+	t.admit(v)
+	t.logVisitor("visitor entered", v)
+	t.record(v, string(v.ActionType), v.Payload)
+	t.enqueue(v)
+}
+
+// EnterOnce enters a visitor unless an input with the same idempotency key
+// entered within the tunnel's idempotency window. It returns the message ID the
+// key stands for: the visitor's own, or that of the first input for a
+// duplicate. An empty key always enters.
+func (t *Tunnel) EnterOnce(v *Visitor, key string) (string, bool) {
+	if key == "" || t.actionLogger == nil {
+		t.Enter(v)
+		return v.MessageId, false
+	}
+
+	t.admit(v)
+	windowStart := time.Now().Add(-t.idempotencyWindow).Unix()
+	messageID, duplicate := t.actionLogger.InsertActionOnce(key, windowStart, v.ReplayId, v.MessageId, string(v.ActionName), v.CausedBy, string(v.ActionType), string(v.ActionDirection), v.Payload, string(v.ActionType), v.VirtualTime)
+	if duplicate {
+		t.logger.Debug("dropped duplicate visitor", "idempotency_key", key, "message_id", messageID, "action_name", v.ActionName)
+		engineMetrics.duplicateInputs.Inc(t.name, string(v.ActionName))
+		return messageID, true
+	}
+	t.logVisitor("visitor entered", v)
+	t.enqueue(v)
+	return messageID, false
+}
+
+// enterWithCheckpoint enters a visitor and saves a generator checkpoint in
+// the same transaction as its action row
+func (t *Tunnel) enterWithCheckpoint(v *Visitor, name string, value string) {
+	t.admit(v)
+	t.logVisitor("visitor entered", v)
+	t.actionLogger.InsertActionWithCheckpoint(name, value, v.ReplayId, v.MessageId, string(v.ActionName), v.CausedBy, string(v.ActionType), string(v.ActionDirection), v.Payload, string(v.ActionType), v.VirtualTime)
+	t.enqueue(v)
+}
+
+// admit checks a visitor may enter and gives it the tunnel's replay ID
+func (t *Tunnel) admit(v *Visitor) {
 	assert.IsTrue(v != nil)
 
 	if v.IsDebug {
@@ -62,29 +155,45 @@ func (t *Tunnel) Enter(v *Visitor) {
 	}
 
 	assert.IsTrue(v.ReplayId != 0)
+}
 
-	val, err := json.Marshal(v)
-	if err != nil {
-		println(err.Error())
-	}
-	println(string(val))
-	t.actionLogger.InsertAction(v.ReplayId, v.MessageId, string(v.ActionName), v.CausedBy, string(v.ActionType), string(v.ActionDirection), v.Payload, string(v.ActionType))
+func (t *Tunnel) enqueue(v *Visitor) {
+	t.inFlight.Add(1)
+	t.entered.Add(1)
 	t.queue <- v
+	engineMetrics.visitorsEntered.Inc(t.name, string(v.ActionName), string(v.ActionType))
+	engineMetrics.queueDepth.Set(float64(len(t.queue)), t.name)
 }
 
 func (t *Tunnel) NextVisitor() (*Visitor, error) {
 	v := <-t.queue
+	engineMetrics.queueDepth.Set(float64(len(t.queue)), t.name)
+
+	start := time.Now()
+	defer engineMetrics.handlerDuration.ObserveSince(start, t.name, string(v.ActionName))
+
+	if t.deadLetter {
+		return t.handleOrDeadLetter(v), nil
+	}
+	return t.handle(v), nil
+}
 
+// handle runs the handler for a visitor and returns it if it has to exit
+func (t *Tunnel) handle(v *Visitor) *Visitor {
+	handler, registered := lookupHandler(v.ActionName)
 	switch v.ActionType {
-	case INPUT:
+	case INPUT, TIMER:
 		switch v.ActionName {
 		case TICK:
-			println("Not doing anything for the tick...")
-			return nil, nil
-		case LOGON:
+			if t.logTicks {
+				t.visitorLogger(v).Debug("tick", "message_id", v.MessageId, "payload", v.Payload)
+			}
+		case LOGON, ADOPT_TIMER:
 			break
 		default:
-			panic("unrecognized actionName: " + v.ActionName)
+			if !registered {
+				panic("unrecognized actionName: " + v.ActionName)
+			}
 		}
 	case REQUEST:
 		panic("There are no request topics yet...")
@@ -93,22 +202,261 @@ func (t *Tunnel) NextVisitor() (*Visitor, error) {
 	default:
 		panic("unrecognized actionDirection")
 	}
-	return v, nil
+
+	var now int64
+	var ctx *HandlerContext
+	t.states.with(v.ReplayId, func(state *State) {
+		now = engineTime(state, v)
+		if registered {
+			ctx = &HandlerContext{Now: time.Unix(0, now).UTC(), State: state, visitor: v}
+			if err := handler(ctx, v); err != nil {
+				panic("handler for " + string(v.ActionName) + " failed: " + err.Error())
+			}
+		}
+		state.apply(v)
+	})
+	if ctx != nil {
+		t.saveTimers(ctx)
+	}
+
+	switch v.ActionName {
+	case TICK:
+		// the timers a tick fires are handled after it, and marked after it
+		t.markHandled(v)
+		t.fireTimers(v, now)
+		return nil
+	case ADOPT_TIMER:
+		t.adoptTimer(v)
+		t.markHandled(v)
+		return nil
+	}
+	return v
+}
+
+// handleOrDeadLetter records a failing handler instead of crashing, so a bad
+// rerun cannot take the engine down
+func (t *Tunnel) handleOrDeadLetter(v *Visitor) (out *Visitor) {
+	defer func() {
+		if r := recover(); r != nil {
+			reason := fmt.Sprint(r)
+			t.visitorLogger(v).Error("visitor dead-lettered", "message_id", v.MessageId, "action_name", v.ActionName, "error", reason)
+			t.recordDeadLetter(v, reason)
+			out = nil
+		}
+	}()
+	return t.handle(v)
+}
+
+// done counts a visitor the tunnel is through with
+func (t *Tunnel) done() {
+	t.handledMu.Lock()
+	defer t.handledMu.Unlock()
+	t.handled.Add(1)
+	t.inFlight.Add(-1)
+	if t.handledWake != nil {
+		close(t.handledWake)
+		t.handledWake = nil
+	}
+}
+
+// waitHandled blocks until the tunnel got through count visitors since it
+// opened. The queue is first in first out, so once it got through as many
+// visitors as were entered by some point, it got through those.
+func (t *Tunnel) waitHandled(count int64) {
+	for {
+		t.handledMu.Lock()
+		if t.handled.Load() >= count {
+			t.handledMu.Unlock()
+			return
+		}
+		if t.handledWake == nil {
+			t.handledWake = make(chan struct{})
+		}
+		wake := t.handledWake
+		t.handledMu.Unlock()
+		<-wake
+	}
+}
+
+// rerun enters the visitors of a debug rerun in the background and marks the
+// rerun finished once the tunnel has handled them, so it is not deleted while
+// it still executes. A rerun the debugger has a session for enters one
+// visitor at a time, each once the session lets it through and the one
+// before it is handled, so pausing it holds back no other rerun.
+func (t *Tunnel) rerun(replayID int64, visitors []*Visitor) {
+	go func() {
+		if t.debugger != nil && t.debugger.debugging(replayID) {
+			defer t.debugger.end(replayID)
+			for _, v := range visitors {
+				t.debugger.await(v)
+				t.Enter(v)
+				t.waitHandled(t.entered.Load())
+				t.debugger.handled(v)
+			}
+		} else {
+			for _, v := range visitors {
+				t.Enter(v)
+			}
+			t.waitHandled(t.entered.Load())
+		}
+		if err := t.actionLogger.SetReplayStatus(replayID, REPLAY_FINISHED); err != nil {
+			t.logger.Error("marking the rerun finished failed", "replay_id", replayID, "error", err)
+		}
+	}()
+}
+
+// passThrough enters a visitor and handles it right away, for callers that
+// drive a tunnel themselves instead of running its loop
+func (t *Tunnel) passThrough(v *Visitor) error {
+	t.Enter(v)
+	defer t.done()
+	out, err := t.NextVisitor()
+	if err != nil {
+		return err
+	}
+	if out != nil {
+		_, err = t.Exit(out)
+	}
+	return err
+}
+
+// State returns a copy of the application state built for a replay
+func (t *Tunnel) State(replayID int64) *State {
+	return t.states.get(replayID)
 }
 
 func (t *Tunnel) Exit(v *Visitor) (*Visitor, error) {
 	// Only record if we have a valid replay ID
 	if v.ReplayId == 0 {
-		log.Printf("WARNING: Skipping RecordOut - visitor has no replay ID (message: %s)", v.MessageId)
+		t.logger.Warn("skipping exit, visitor has no replay ID", "message_id", v.MessageId)
 		return nil, fmt.Errorf("RecordOut called with nil visitor")
 	}
-	val, err := json.Marshal(v)
+	t.logVisitor("visitor exited", v)
+	t.recordExit(v)
+	engineMetrics.visitorsExited.Inc(t.name, string(v.ActionName), string(v.ActionType))
+	t.notifyExit(v)
+	return v, nil
+}
+
+// subscribe calls fn with every visitor exiting the tunnel until the returned
+// function is called. fn runs on the tunnel's loop and must not block.
+func (t *Tunnel) subscribe(fn func(v *Visitor)) func() {
+	t.subscribersMu.Lock()
+	defer t.subscribersMu.Unlock()
+	if t.subscribers == nil {
+		t.subscribers = make(map[int]func(v *Visitor))
+	}
+	id := t.nextSubscriber
+	t.nextSubscriber++
+	t.subscribers[id] = fn
+	return func() {
+		t.subscribersMu.Lock()
+		defer t.subscribersMu.Unlock()
+		delete(t.subscribers, id)
+	}
+}
+
+func (t *Tunnel) notifyExit(v *Visitor) {
+	t.subscribersMu.Lock()
+	defer t.subscribersMu.Unlock()
+	for _, fn := range t.subscribers {
+		fn(v)
+	}
+}
+
+// record writes an action row for a visitor to the action log
+func (t *Tunnel) record(v *Visitor, actionType string, payload string) {
+	if t.actionLogger == nil {
+		if t.recordRow != nil {
+			row := actionRowOf(v, actionType)
+			row.Payload = payload
+			t.recordRow(row)
+		}
+		return
+	}
+	t.actionLogger.InsertAction(v.ReplayId, v.MessageId, string(v.ActionName), v.CausedBy, string(v.ActionType), string(v.ActionDirection), payload, actionType, v.VirtualTime)
+}
+
+// recordExit records an exiting visitor as handled and, in the same
+// transaction, queues it in the outbox of every sink it is routed to
+func (t *Tunnel) recordExit(v *Visitor) {
+	if t.actionLogger == nil {
+		t.record(v, string(v.ActionType), v.Payload)
+		return
+	}
+	sinks := t.sinks.sinksFor(v)
+	var visitor []byte
+	if len(sinks) > 0 {
+		var err error
+		if visitor, err = json.Marshal(v); err != nil {
+			t.logger.Error("encoding visitor for the outbox failed", "message_id", v.MessageId, "error", err)
+			sinks = nil
+		}
+	}
+	t.actionLogger.InsertHandledAction(v.ReplayId, v.MessageId, string(v.ActionName), v.CausedBy, string(v.ActionType), string(v.ActionDirection), v.Payload, string(v.ActionType), v.VirtualTime, string(visitor), sinks, !v.IsDebug)
+	t.sinks.notify(sinks)
+}
+
+// recordDeadLetter records a visitor whose handler failed as handled
+func (t *Tunnel) recordDeadLetter(v *Visitor, reason string) {
+	if t.actionLogger == nil {
+		t.record(v, string(DEAD_LETTER), reason)
+		return
+	}
+	t.actionLogger.InsertHandledAction(v.ReplayId, v.MessageId, string(v.ActionName), v.CausedBy, string(v.ActionType), string(v.ActionDirection), reason, string(DEAD_LETTER), v.VirtualTime, "", nil, !v.IsDebug)
+}
+
+// markHandled records that a visitor which does not exit got through, for
+// recovery to know where a crashed run stood
+func (t *Tunnel) markHandled(v *Visitor) {
+	if t.actionLogger == nil || v.IsDebug {
+		return
+	}
+	t.actionLogger.MarkHandled(v.ReplayId, v.MessageId)
+}
+
+// snapshot saves the state after a visitor passed the tunnel, every
+// snapshotEvery visitors, so recovering a crashed run replays little of it
+func (t *Tunnel) snapshot(v *Visitor) {
+	if t.snapshotEvery <= 0 || t.actionLogger == nil {
+		return
+	}
+	t.sinceSnapshot++
+	if t.sinceSnapshot < t.snapshotEvery {
+		return
+	}
+	t.sinceSnapshot = 0
+
+	state, err := json.Marshal(t.State(v.ReplayId))
+	if err == nil {
+		err = t.actionLogger.SaveSnapshot(v.ReplayId, v.MessageId, string(state))
+	}
 	if err != nil {
-		println(err.Error())
+		t.logger.Error("saving state snapshot failed", "message_id", v.MessageId, "error", err)
 	}
-	println(string(val))
-	t.actionLogger.InsertAction(v.ReplayId, v.MessageId, string(v.ActionName), v.CausedBy, string(v.ActionType), string(v.ActionDirection), v.Payload, string(v.ActionType))
-	return v, nil
+}
+
+// visitorLogger is the logger for lines about a visitor. The main entrance
+// logger carries its run already; the side entrance handles many replays.
+func (t *Tunnel) visitorLogger(v *Visitor) *slog.Logger {
+	if t.replayId != 0 {
+		return t.logger
+	}
+	return t.logger.With("replay_id", v.ReplayId)
+}
+
+func (t *Tunnel) logVisitor(msg string, v *Visitor) {
+	if v.ActionName == TICK && !t.logTicks {
+		return
+	}
+	t.visitorLogger(v).Debug(msg,
+		"message_id", v.MessageId,
+		"action_name", v.ActionName,
+		"action_type", v.ActionType,
+		"direction", v.ActionDirection,
+		"caused_by", v.CausedBy,
+		"payload", v.Payload,
+	)
 }
 
 func NewInputAction(topic ActionName, payload string) *Visitor {
@@ -137,28 +485,71 @@ func NewVisitorFromActionRow(messageID, topic, causedBy, messageType, direction,
 	}
 }
 
-func NewNormalTunnel(actionLogger *ActionLogger) *Tunnel {
+// NewVisitorsFromActionRows rebuilds a visitor from every action row of a
+// replay, in order, ready to be handled again under replayID. Timer visitors
+// are left out, as handling their causes schedules them again, and so are
+// audit rows and dead letters, which hold a failure instead of a payload.
+func NewVisitorsFromActionRows(messages []ActionRow, replayID int64) []*Visitor {
+	visitors := make([]*Visitor, 0, len(messages))
+	for _, msg := range messages {
+		if msg.MessageType == string(TIMER) || msg.MessageType == string(AUDIT) || msg.ActionType == string(DEAD_LETTER) {
+			continue
+		}
+
+		v := NewVisitorFromActionRow(
+			msg.MessageID,
+			msg.Topic,
+			msg.CausedBy,
+			msg.MessageType,
+			msg.Direction,
+			msg.Payload,
+			replayID,
+		)
+		v.VirtualTime = msg.VirtualTime
+		visitors = append(visitors, v)
+	}
+	return visitors
+}
+
+func NewNormalTunnel(actionLogger *ActionLogger, logger *slog.Logger, logTicks bool) *Tunnel {
 	fileName := generateFileName()
 	assert.IsTrue(fileName != "")
 
-	fileId, err := actionLogger.InsertReplay("Normal Run Created", fileName, 1, nil)
+	replayId, err := actionLogger.InsertRun("Normal Run Created", fileName, nil)
 	if err != nil {
 		assert.IsTrue(false) // This cannot happen and should not happen
 	}
-	replayId := fileId
+	return newMainTunnel(actionLogger, logger, logTicks, replayId)
+}
 
+// newMainTunnel opens the main entrance on a run already in the action log
+func newMainTunnel(actionLogger *ActionLogger, logger *slog.Logger, logTicks bool, replayId int64) *Tunnel {
 	return &Tunnel{
+		name:         "main",
 		queue:        make(chan *Visitor, 100),
 		replayId:     replayId,
 		actionLogger: actionLogger,
+		logger:       logger.With("tunnel", "main", "replay_id", replayId),
+		logTicks:     logTicks,
+		states:       newStateStore(),
+		timers:       actionLogger,
+
+		idempotencyWindow: DefaultIdempotencyWindow,
 	}
 }
 
-func NewDebugTunnel(actionLogger *ActionLogger) *Tunnel {
+func NewDebugTunnel(actionLogger *ActionLogger, logger *slog.Logger, logTicks bool) *Tunnel {
 	return &Tunnel{
+		name:         "side",
 		queue:        make(chan *Visitor, 100),
 		replayId:     0,
 		actionLogger: actionLogger,
+		logger:       logger.With("tunnel", "side"),
+		logTicks:     logTicks,
+		states:       newStateStore(),
+		debugger:     NewDebugger(),
+		deadLetter:   true,
+		timers:       actionLogger,
 	}
 }
 
@@ -3,6 +3,7 @@ package tunnel_system
 import (
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
+	"log/slog"
 	"strconv"
 	"time"
 )
@@ -10,26 +11,82 @@ import (
 type TunnelSystem struct {
 	mainEntrance *Tunnel
 	sideEntrance *Tunnel
+	debugger     *Debugger
+	logger       *slog.Logger
+	clock        Clock
+	generators   *generatorRegistry
+	// engineTick drives the clock timers fire on; it cannot be paused or removed
+	engineTick InputGenerator
 }
 
 // VisitorInput represents the JSON structure for incoming visitor events
 type VisitorInput struct {
 	Topic   string `json:"topic"`
 	Payload string `json:"payload"`
+	// IdempotencyKey, when set, enters the input only once however often a
+	// client retries it within the idempotency window
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
 }
 
 func NewTunnelSystem(config Config, generators []InputGenerator) {
-	// If empty config passed, use defaults
-	if config.HTTPPort == "" && config.WebSocketPort == "" && !config.EnableHTTP && !config.EnableWebSocket {
-		config = DefaultConfig()
+	// If no built-in generators were configured, use the default ones
+	if config.HTTPPort == "" && config.WebSocketPort == "" && config.GRPCPort == "" && !config.EnableHTTP && !config.EnableWebSocket && !config.EnableGRPC {
+		defaults := DefaultConfig()
+		config.EnableHTTP, config.HTTPPort = defaults.EnableHTTP, defaults.HTTPPort
+		config.EnableWebSocket, config.WebSocketPort = defaults.EnableWebSocket, defaults.WebSocketPort
+		config.EnableGRPC, config.GRPCPort = defaults.EnableGRPC, defaults.GRPCPort
 	}
 
-	actionLogger := NewActionLogger()
-	mainEntrance := NewNormalTunnel(actionLogger)
-	sideEntrance := NewDebugTunnel(actionLogger)
+	logger := config.logger()
+	actionLogger := config.actionLogger(logger)
+	mainEntrance, crashed := openMainEntrance(config, actionLogger, logger)
+	sideEntrance := NewDebugTunnel(actionLogger, logger, config.LogTicks)
 	tunnelSystem := &TunnelSystem{
 		mainEntrance: mainEntrance,
 		sideEntrance: sideEntrance,
+		debugger:     sideEntrance.debugger,
+		logger:       logger,
+		clock:        systemClock{},
+		generators:   newGeneratorRegistry(),
+	}
+	// the leases have to outlast a long recovery
+	go tunnelSystem.renewLeases()
+	if config.IdempotencyWindow > 0 {
+		mainEntrance.idempotencyWindow = config.IdempotencyWindow
+	}
+	mainEntrance.snapshotEvery = config.SnapshotEvery
+	if mainEntrance.snapshotEvery <= 0 {
+		mainEntrance.snapshotEvery = DefaultSnapshotEvery
+	}
+
+	var recovered []*Visitor
+	if crashed != nil {
+		var err error
+		if recovered, err = tunnelSystem.recover(crashed); err != nil {
+			panic("recovering run " + strconv.FormatInt(crashed.ID, 10) + " failed because: " + err.Error())
+		}
+	}
+
+	aborted, err := actionLogger.AbortReruns()
+	if err != nil {
+		logger.Error("aborting unfinished reruns failed", "error", err)
+	} else if aborted > 0 {
+		logger.Info("aborted reruns left unfinished", "replays", aborted)
+	}
+
+	var virtualClock *VirtualClock
+	if config.Simulation != nil {
+		start := config.Simulation.Start
+		if start.IsZero() {
+			start = time.Now()
+		}
+		virtualClock = NewVirtualClock(start)
+		tunnelSystem.clock = virtualClock
+
+		// Connections from the outside world cannot run on virtual time
+		config.EnableHTTP = false
+		config.EnableWebSocket = false
+		config.EnableGRPC = false
 	}
 
 	if config.EnableHTTP {
@@ -40,6 +97,14 @@ func NewTunnelSystem(config Config, generators []InputGenerator) {
 		generators = append([]InputGenerator{httpGen}, generators...)
 	}
 
+	if config.EnableGRPC {
+		if config.GRPCPort == "" {
+			config.GRPCPort = ":8083"
+		}
+		grpcGen := createGRPCGenerator(config.GRPCPort)
+		generators = append([]InputGenerator{grpcGen}, generators...)
+	}
+
 	if config.EnableWebSocket {
 		if config.WebSocketPort == "" {
 			config.WebSocketPort = ":8082"
@@ -52,36 +117,180 @@ func NewTunnelSystem(config Config, generators []InputGenerator) {
 		func() VisitorInput {
 			return VisitorInput{
 				Topic:   string(TICK),
-				Payload: strconv.FormatInt(time.Now().UTC().UnixNano(), 10),
+				Payload: strconv.FormatInt(tunnelSystem.clock.Now().UTC().UnixNano(), 10),
 			}
 		},
 		1*time.Second,
 	)
+	engineTickGenerator.Name = "engine-tick"
+	engineTickGenerator.Topic = string(TICK)
+	tunnelSystem.engineTick = engineTickGenerator
 
 	generators = append(generators, engineTickGenerator)
 
-	startInputGenerators(tunnelSystem, generators)
+	if virtualClock != nil {
+		if len(config.Sinks) > 0 {
+			logger.Warn("sinks are not used on virtual time", "sinks", len(config.Sinks))
+		}
+		tunnelSystem.simulate(virtualClock, config.Simulation.Duration, generators)
+		return
+	}
+
+	mainEntrance.sinks = newSinkDispatcher(config.Sinks, actionLogger, logger)
+	go tunnelSystem.pruneIdempotencyKeys()
+	if config.Retention != nil {
+		go tunnelSystem.enforceRetention(*config.Retention)
+	}
+	go tunnelSystem.shutdownOnSignal()
+	// the recovered visitors and adopted timers may not fit the queue before
+	// the main loop runs, and go ahead of any new input
+	go func() {
+		if len(recovered) > 0 {
+			tunnelSystem.reenter(recovered, crashed)
+		}
+		adopted, err := mainEntrance.adoptTimers()
+		if err != nil {
+			logger.Error("adopting pending timers failed", "error", err)
+		} else if adopted > 0 {
+			logger.Info("adopted pending timers from earlier runs", "timers", adopted, "replay_id", mainEntrance.replayId)
+		}
+		startInputGenerators(tunnelSystem, generators)
+	}()
 
 	srv := newTunnelServer(tunnelSystem)
 	srv.start(":8080")
 
+	go tunnelSystem.pass(tunnelSystem.sideEntrance)
 	tunnelSystem.openUp()
 }
 
+// simulationBatchSize is the number of visitors committed per transaction in a virtual run
+const simulationBatchSize = 10000
+
+// simulate runs the scheduled generators on the virtual clock, handling every
+// visitor before the next one fires so the run is deterministic
+func (t *TunnelSystem) simulate(clock *VirtualClock, duration time.Duration, generators []InputGenerator) {
+	scheduler := NewVirtualScheduler(clock)
+	for _, gen := range generators {
+		scheduled, ok := gen.(scheduledGenerator)
+		if !ok {
+			t.logger.Warn("generator cannot run on virtual time, skipping it", "generator", fmt.Sprintf("%T", gen))
+			continue
+		}
+		scheduler.add(scheduled)
+	}
+
+	actionLogger := t.mainEntrance.actionLogger
+	start := clock.Now()
+	wallStart := time.Now()
+	failure := actionLogger.beginBatch()
+	handled := 0
+	fired := scheduler.run(start.Add(duration), func(at time.Time, input VisitorInput) {
+		if failure != nil {
+			return
+		}
+		v := NewInputAction(ActionName(input.Topic), input.Payload)
+		v.VirtualTime = at.UnixNano()
+		if failure = t.mainEntrance.passThrough(v); failure != nil {
+			return
+		}
+		handled++
+		if handled%simulationBatchSize == 0 {
+			if failure = actionLogger.commitBatch(); failure == nil {
+				failure = actionLogger.beginBatch()
+			}
+		}
+	})
+	if err := actionLogger.commitBatch(); failure == nil {
+		failure = err
+	}
+	// a simulation is never resumed, whether it failed or not
+	if err := actionLogger.SetReplayStatus(t.mainEntrance.replayId, REPLAY_FINISHED); err != nil {
+		t.logger.Error("marking the simulation finished failed", "error", err)
+	}
+	if failure != nil {
+		t.logger.Error("simulation failed", "error", failure)
+		return
+	}
+
+	t.logger.Info("simulation finished",
+		"replay_id", t.mainEntrance.replayId,
+		"visitors", fired,
+		"virtual_start", start,
+		"virtual_end", clock.Now(),
+		"elapsed", time.Since(wallStart),
+	)
+}
+
 func (t *TunnelSystem) openUp() {
+	t.pass(t.mainEntrance)
+}
+
+// pass moves visitors through a tunnel until it fails
+func (t *TunnelSystem) pass(tunnel *Tunnel) {
 	for {
-		v, err := t.mainEntrance.NextVisitor()
+		v, err := tunnel.NextVisitor()
 		if err != nil {
-			fmt.Println(err)
+			t.logger.Error("next visitor failed", "tunnel", tunnel.name, "error", err)
 			return
 		}
-		if v == nil {
-			continue
+		if v != nil {
+			v, err = tunnel.Exit(v)
+			if err != nil {
+				t.logger.Error("exit failed", "tunnel", tunnel.name, "error", err)
+				return
+			}
+			tunnel.snapshot(v)
+		}
+		tunnel.done()
+	}
+}
+
+// pruneIdempotencyKeys forgets the idempotency keys that fell out of the window
+// every hour, so the table holds about one window of keys
+func (t *TunnelSystem) pruneIdempotencyKeys() {
+	for {
+		windowStart := time.Now().Add(-t.mainEntrance.idempotencyWindow).Unix()
+		pruned, err := t.mainEntrance.actionLogger.PruneIdempotencyKeys(windowStart)
+		if err != nil {
+			t.logger.Error("pruning idempotency keys failed", "error", err)
+		} else if pruned > 0 {
+			t.logger.Debug("pruned idempotency keys", "keys", pruned)
 		}
-		v, err = t.mainEntrance.Exit(v)
+		time.Sleep(time.Hour)
+	}
+}
+
+// renewLeases keeps the running replays of this process leased to it, so
+// engines sharing the action log leave them alone
+func (t *TunnelSystem) renewLeases() {
+	for {
+		time.Sleep(replayLeaseRenewal)
+		if err := t.mainEntrance.actionLogger.RenewLeases(time.Now()); err != nil {
+			t.logger.Error("renewing replay leases failed", "error", err)
+		}
+	}
+}
+
+// enforceRetention applies the retention policy every policy.Every
+func (t *TunnelSystem) enforceRetention(policy RetentionPolicy) {
+	every := policy.Every
+	if every <= 0 {
+		every = DefaultRetentionEvery
+	}
+	for {
+		report, err := t.mainEntrance.actionLogger.EnforceRetention(policy, time.Now(), false)
 		if err != nil {
-			fmt.Println(err)
-			return
+			t.logger.Error("enforcing retention failed", "error", err)
+		} else {
+			t.logger.Info("enforced retention",
+				"deleted", len(report.Deleted),
+				"archives", len(report.Archives),
+				"compacted", len(report.Compacted),
+				"ticks_dropped", report.TicksDropped,
+				"skipped", len(report.Skipped),
+			)
 		}
+		time.Sleep(every)
 	}
 }